@@ -1,29 +1,122 @@
 package main
 
 import (
+	"crypto/rsa"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/bitsbeats/drone-tree-config/plugin"
 
 	"github.com/drone/drone-go/plugin/config"
 	"github.com/kelseyhightower/envconfig"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 )
 
 type (
 	spec struct {
-		Concat   bool   `envconfig:"PLUGIN_CONCAT"`
-		MaxDepth int    `envconfig:"PLUGIN_MAXDEPTH" default:"2"`
-		Fallback bool   `envconfig:"PLUGIN_FALLBACK"`
-		Debug    bool   `envconfig:"PLUGIN_DEBUG"`
-		Address  string `envconfig:"PLUGIN_ADDRESS" default:":3000"`
-		Secret   string `envconfig:"PLUGIN_SECRET"`
-		Token    string `envconfig:"SCM_TOKEN"`
-		Server   string `envconfig:"SCM_SERVER"`
+		Concat                bool          `envconfig:"PLUGIN_CONCAT"`
+		MaxDepth              int           `envconfig:"PLUGIN_MAXDEPTH" default:"2"`
+		Fallback              bool          `envconfig:"PLUGIN_FALLBACK"`
+		Debug                 bool          `envconfig:"PLUGIN_DEBUG"`
+		Address               string        `envconfig:"PLUGIN_ADDRESS" default:":3000"`
+		Secret                string        `envconfig:"PLUGIN_SECRET" redact:"true"`
+		Token                 string        `envconfig:"SCM_TOKEN" redact:"true"`
+		Tokens                []string      `envconfig:"SCM_TOKENS" redact:"true"`
+		Server                string        `envconfig:"SCM_SERVER"`
+		Provider              string        `envconfig:"PLUGIN_SCM_PROVIDER" default:"github"`
+		CacheTTL              time.Duration `envconfig:"PLUGIN_CACHE_TTL"`
+		Concurrency           int           `envconfig:"PLUGIN_CONCURRENCY" default:"4"`
+		RetryCount            int           `envconfig:"PLUGIN_RETRY_COUNT"`
+		RetryBackoff          time.Duration `envconfig:"PLUGIN_RETRY_BACKOFF" default:"1s"`
+		RateLimitWait         bool          `envconfig:"PLUGIN_RATELIMIT_WAIT"`
+		RateLimitMaxWait      time.Duration `envconfig:"PLUGIN_RATELIMIT_MAX_WAIT" default:"1m"`
+		Metrics               bool          `envconfig:"PLUGIN_METRICS"`
+		ConfigNames           []string      `envconfig:"PLUGIN_CONFIG_NAMES"`
+		Include               []string      `envconfig:"PLUGIN_INCLUDE"`
+		Exclude               []string      `envconfig:"PLUGIN_EXCLUDE"`
+		Starlark              bool          `envconfig:"PLUGIN_STARLARK"`
+		Jsonnet               bool          `envconfig:"PLUGIN_JSONNET"`
+		AllowRepos            []string      `envconfig:"PLUGIN_ALLOW_REPOS"`
+		DenyRepos             []string      `envconfig:"PLUGIN_DENY_REPOS"`
+		GithubAppID           int64         `envconfig:"PLUGIN_GITHUB_APP_ID"`
+		GithubAppInstallation int64         `envconfig:"PLUGIN_GITHUB_APP_INSTALLATION"`
+		GithubAppKeyFile      string        `envconfig:"PLUGIN_GITHUB_APP_PRIVATE_KEY_FILE"`
+		Template              string        `envconfig:"PLUGIN_TEMPLATE"`
+		SkipNotFound          bool          `envconfig:"PLUGIN_SKIP_VERIFY_NOT_FOUND"`
+		FallbackConfig        string        `envconfig:"PLUGIN_FALLBACK_CONFIG"`
+		UpMaxDepth            int           `envconfig:"PLUGIN_UP_MAXDEPTH"`
+		LogFormat             string        `envconfig:"PLUGIN_LOG_FORMAT" default:"text"`
+		SourcesComment        bool          `envconfig:"PLUGIN_SOURCES_COMMENT"`
+		FallbackBranches      []string      `envconfig:"PLUGIN_FALLBACK_BRANCHES"`
+		ScmTimeout            time.Duration `envconfig:"PLUGIN_SCM_TIMEOUT" default:"30s"`
+		DisableCleanup        bool          `envconfig:"PLUGIN_DISABLE_CLEANUP"`
+		ConfigRef             string        `envconfig:"PLUGIN_CONFIG_REF"`
+		Username              string        `envconfig:"SCM_USERNAME"`
+		CronPaths             []string      `envconfig:"PLUGIN_CRON_PATHS"`
+		Order                 string        `envconfig:"PLUGIN_ORDER" default:"discovery"`
+		ConfigDir             string        `envconfig:"PLUGIN_CONFIG_DIR"`
+		MaxFileSize           int           `envconfig:"PLUGIN_MAX_FILE_SIZE"`
+		MaxConfigSize         int           `envconfig:"PLUGIN_MAX_CONFIG_SIZE"`
+		ShutdownGrace         time.Duration `envconfig:"PLUGIN_SHUTDOWN_GRACE" default:"30s"`
+		AlwaysRoot            bool          `envconfig:"PLUGIN_ALWAYS_ROOT"`
+		DeepestOnly           bool          `envconfig:"PLUGIN_DEEPEST_ONLY"`
+		ScmCACert             string        `envconfig:"PLUGIN_SCM_CA_CERT"`
+		ScmInsecureSkipVerify bool          `envconfig:"PLUGIN_SCM_INSECURE_SKIP_VERIFY"`
+		TokenScheme           string        `envconfig:"PLUGIN_TOKEN_SCHEME" default:"bearer"`
+		StrictAnchors         bool          `envconfig:"PLUGIN_STRICT_ANCHORS"`
+		RequestIDHeader       string        `envconfig:"PLUGIN_REQUEST_ID_HEADER"`
+		SingleConfig          bool          `envconfig:"PLUGIN_SINGLE_CONFIG"`
+		Submodules            bool          `envconfig:"PLUGIN_SUBMODULES"`
+		ForceBefore           string        `envconfig:"PLUGIN_FORCE_BEFORE"`
+		ForceAfter            string        `envconfig:"PLUGIN_FORCE_AFTER"`
+		PullRequestCacheTTL   time.Duration `envconfig:"PLUGIN_PR_CACHE_TTL"`
+		FlatRepos             []string      `envconfig:"PLUGIN_FLAT_REPOS"`
+		AzureOrganization     string        `envconfig:"PLUGIN_AZURE_ORGANIZATION"`
+		SkipInvalid           bool          `envconfig:"PLUGIN_SKIP_INVALID"`
+		Includes              bool          `envconfig:"PLUGIN_INCLUDES"`
+		Pprof                 bool          `envconfig:"PLUGIN_PPROF"`
+		PprofAddress          string        `envconfig:"PLUGIN_PPROF_ADDRESS" default:"127.0.0.1:6060"`
+		MaxInflight           int           `envconfig:"PLUGIN_MAX_INFLIGHT"`
+		InflightTimeout       time.Duration `envconfig:"PLUGIN_INFLIGHT_TIMEOUT" default:"30s"`
+		Archive               bool          `envconfig:"PLUGIN_ARCHIVE"`
+		FullScanTriggers      []string      `envconfig:"PLUGIN_FULLSCAN_TRIGGERS" default:"@cron"`
+		GlobalPrepend         string        `envconfig:"PLUGIN_GLOBAL_PREPEND"`
+		GlobalAppend          string        `envconfig:"PLUGIN_GLOBAL_APPEND"`
+		NamespaceTokens       []string      `envconfig:"PLUGIN_NAMESPACE_TOKENS" redact:"true"`
+		EmitDigest            bool          `envconfig:"PLUGIN_EMIT_DIGEST"`
+		FailClosed            bool          `envconfig:"PLUGIN_FAIL_CLOSED"`
+		PrefixDuplicates      bool          `envconfig:"PLUGIN_PREFIX_DUPLICATE_NAMES"`
+		PathPrefix            string        `envconfig:"PLUGIN_PATH_PREFIX"`
+		EventConfigs          bool          `envconfig:"PLUGIN_EVENT_CONFIGS"`
+		PropagationDelay      time.Duration `envconfig:"PLUGIN_PROPAGATION_DELAY"`
+		PropagationWindow     time.Duration `envconfig:"PLUGIN_PROPAGATION_WINDOW" default:"1m"`
+		ConfigExtensions      []string      `envconfig:"PLUGIN_CONFIG_EXTENSIONS" default:".yml,.yaml,.star,.jsonnet"`
+		ForkConfigs           string        `envconfig:"PLUGIN_FORK_CONFIGS"`
+		TrustedForks          []string      `envconfig:"PLUGIN_TRUSTED_FORKS"`
+		EmptyCommitFullScan   bool          `envconfig:"PLUGIN_EMPTY_COMMIT_FULLSCAN"`
+		IncomingRequestID     string        `envconfig:"PLUGIN_INCOMING_REQUEST_ID_HEADER"`
+		IncludeRepos          []string      `envconfig:"PLUGIN_INCLUDE_REPOS"`
+		TreeCacheSize         int           `envconfig:"PLUGIN_TREE_CACHE_SIZE"`
+		SubmoduleRepos        []string      `envconfig:"PLUGIN_SUBMODULE_REPOS"`
 	}
 )
 
 func main() {
+	showVersion := flag.Bool("version", false, "print the version and exit")
+	flag.Parse()
+	if *showVersion {
+		fmt.Println(versionString())
+		return
+	}
+
 	spec := new(spec)
 	if err := envconfig.Process("", spec); err != nil {
 		logrus.Fatal(err)
@@ -32,30 +125,249 @@ func main() {
 	if spec.Debug {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
-	if spec.Secret == "" {
-		logrus.Fatalln("missing secret key")
+	switch spec.LogFormat {
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	case "text", "":
+	default:
+		logrus.Fatalf("unsupported log format '%s'", spec.LogFormat)
+	}
+	switch spec.Order {
+	case "discovery", "path":
+	default:
+		logrus.Fatalf("unsupported order '%s'", spec.Order)
+	}
+	switch spec.ForkConfigs {
+	case "", "head", "base":
+	default:
+		logrus.Fatalf("unsupported fork configs '%s'", spec.ForkConfigs)
 	}
-	if spec.Token == "" {
+	switch spec.TokenScheme {
+	case "bearer", "token", "private-token":
+	default:
+		logrus.Fatalf("unsupported token scheme '%s'", spec.TokenScheme)
+	}
+	namespaceTokens := map[string]string{}
+	for _, entry := range spec.NamespaceTokens {
+		parts := strings.SplitN(entry, "=", 2)
+		namespace, token := strings.TrimSpace(parts[0]), ""
+		if len(parts) == 2 {
+			token = strings.TrimSpace(parts[1])
+		}
+		if namespace == "" || token == "" {
+			logrus.Fatalf("invalid namespace token, expected namespace=token")
+		}
+		namespaceTokens[namespace] = token
+	}
+	if spec.Token == "" && len(spec.Tokens) == 0 && len(namespaceTokens) == 0 && spec.GithubAppID == 0 {
+		if spec.FailClosed {
+			logrus.Fatalln("missing scm token, refusing to start with PLUGIN_FAIL_CLOSED")
+		}
 		logrus.Warnln("missing scm token")
 	}
 	if spec.Address == "" {
 		spec.Address = ":3000"
 	}
 
+	var githubAppKey *rsa.PrivateKey
+	if spec.GithubAppID != 0 {
+		data, err := ioutil.ReadFile(spec.GithubAppKeyFile)
+		if err != nil {
+			logrus.Fatalf("unable to read github app private key: %v", err)
+		}
+		githubAppKey, err = plugin.ParseGithubAppKey(data)
+		if err != nil {
+			logrus.Fatalf("unable to parse github app private key: %v", err)
+		}
+	}
+
+	var caCerts *x509.CertPool
+	if spec.ScmCACert != "" {
+		// the certificate is either PEM encoded or a path to a PEM file
+		data := []byte(spec.ScmCACert)
+		if !strings.HasPrefix(strings.TrimSpace(spec.ScmCACert), "-----BEGIN") {
+			file, err := ioutil.ReadFile(spec.ScmCACert)
+			if err != nil {
+				logrus.Fatalf("unable to read scm ca certificate: %v", err)
+			}
+			data = file
+		}
+		pool, err := plugin.ParseCACerts(data)
+		if err != nil {
+			logrus.Fatalf("unable to parse scm ca certificate: %v", err)
+		}
+		caCerts = pool
+	}
+	globalPrepend := globalConfig("PLUGIN_GLOBAL_PREPEND", spec.GlobalPrepend)
+	globalAppend := globalConfig("PLUGIN_GLOBAL_APPEND", spec.GlobalAppend)
+	if spec.ForceBefore != "" || spec.ForceAfter != "" {
+		logrus.Warnln("changed files are taken from a forced commit range, do not use this in production")
+	}
+	if spec.ScmInsecureSkipVerify {
+		logrus.Warnln("tls verification of the scm server is DISABLED, connections are open to man-in-the-middle attacks")
+	}
+
+	p := plugin.New(
+		plugin.WithServer(spec.Server),
+		plugin.WithToken(spec.Token),
+		plugin.WithTokens(spec.Tokens),
+		plugin.WithProvider(spec.Provider),
+		plugin.WithConcat(spec.Concat),
+		plugin.WithFallback(spec.Fallback),
+		plugin.WithMaxDepth(spec.MaxDepth),
+		plugin.WithCacheTTL(spec.CacheTTL),
+		plugin.WithConcurrency(spec.Concurrency),
+		plugin.WithRetry(spec.RetryCount, spec.RetryBackoff),
+		plugin.WithRateLimitWait(spec.RateLimitWait, spec.RateLimitMaxWait),
+		plugin.WithConfigNames(spec.ConfigNames),
+		plugin.WithInclude(spec.Include),
+		plugin.WithExclude(spec.Exclude),
+		plugin.WithStarlark(spec.Starlark),
+		plugin.WithJsonnet(spec.Jsonnet),
+		plugin.WithAllowRepos(spec.AllowRepos),
+		plugin.WithDenyRepos(spec.DenyRepos),
+		plugin.WithGithubApp(spec.GithubAppID, spec.GithubAppInstallation, githubAppKey),
+		plugin.WithTemplate(spec.Template),
+		plugin.WithSkipNotFound(spec.SkipNotFound),
+		plugin.WithFallbackConfig(spec.FallbackConfig),
+		plugin.WithUpMaxDepth(spec.UpMaxDepth),
+		plugin.WithSourcesComment(spec.SourcesComment),
+		plugin.WithFallbackBranches(spec.FallbackBranches),
+		plugin.WithScmTimeout(spec.ScmTimeout),
+		plugin.WithDisableCleanup(spec.DisableCleanup),
+		plugin.WithConfigRef(spec.ConfigRef),
+		plugin.WithUsername(spec.Username),
+		plugin.WithCronPaths(spec.CronPaths),
+		plugin.WithOrder(spec.Order),
+		plugin.WithConfigDir(spec.ConfigDir),
+		plugin.WithMaxFileSize(spec.MaxFileSize),
+		plugin.WithMaxConfigSize(spec.MaxConfigSize),
+		plugin.WithAlwaysRoot(spec.AlwaysRoot),
+		plugin.WithDeepestOnly(spec.DeepestOnly),
+		plugin.WithCACerts(caCerts),
+		plugin.WithInsecureSkipVerify(spec.ScmInsecureSkipVerify),
+		plugin.WithTokenScheme(spec.TokenScheme),
+		plugin.WithStrictAnchors(spec.StrictAnchors),
+		plugin.WithRequestIDHeader(spec.RequestIDHeader),
+		plugin.WithSingleConfig(spec.SingleConfig),
+		plugin.WithSubmodules(spec.Submodules),
+		plugin.WithForceRange(spec.ForceBefore, spec.ForceAfter),
+		plugin.WithPullRequestCacheTTL(spec.PullRequestCacheTTL),
+		plugin.WithFlatRepos(spec.FlatRepos),
+		plugin.WithAzureOrganization(spec.AzureOrganization),
+		plugin.WithSkipInvalid(spec.SkipInvalid),
+		plugin.WithIncludes(spec.Includes),
+		plugin.WithMaxInflight(spec.MaxInflight, spec.InflightTimeout),
+		plugin.WithArchive(spec.Archive),
+		plugin.WithFullScanTriggers(spec.FullScanTriggers),
+		plugin.WithGlobalConfigs(globalPrepend, globalAppend),
+		plugin.WithNamespaceTokens(namespaceTokens),
+		plugin.WithEmitDigest(spec.EmitDigest),
+		plugin.WithFailClosed(spec.FailClosed),
+		plugin.WithPrefixDuplicates(spec.PrefixDuplicates),
+		plugin.WithPathPrefix(spec.PathPrefix),
+		plugin.WithEventConfigs(spec.EventConfigs),
+		plugin.WithPropagationRetry(spec.PropagationDelay, spec.PropagationWindow),
+		plugin.WithConfigExtensions(spec.ConfigExtensions),
+		plugin.WithForkConfigs(spec.ForkConfigs, spec.TrustedForks),
+		plugin.WithEmptyCommitFullScan(spec.EmptyCommitFullScan),
+		plugin.WithIncludeRepos(spec.IncludeRepos),
+		plugin.WithTreeCache(spec.TreeCacheSize),
+		plugin.WithSubmoduleRepos(spec.SubmoduleRepos),
+	)
+
+	// resolve a config offline instead of serving drone
+	if args := flag.Args(); len(args) > 0 && args[0] == "validate" {
+		os.Exit(validate(p.(plugin.Validator), args[1:], os.Stdout, os.Stderr))
+	}
+
+	if spec.Secret == "" {
+		logrus.Fatalln("missing secret key")
+	}
 	handler := config.Handler(
-		plugin.New(
-			spec.Server,
-			spec.Token,
-			spec.Concat,
-			spec.Fallback,
-			spec.MaxDepth,
-		),
+		p,
 		spec.Secret,
 		logrus.StandardLogger(),
 	)
 
-	logrus.Infof("server listening on address %s", spec.Address)
+	if spec.Pprof {
+		if spec.PprofAddress == spec.Address {
+			logrus.Fatalln("the pprof address has to differ from the plugin address")
+		}
+		servePprof(spec.PprofAddress)
+	}
+
+	logrus.Infof("%s listening on address %s", versionString(), spec.Address)
+
+	mux := http.NewServeMux()
+	mux.Handle("/", logSignatureFailures(incomingRequestID(handler, spec.IncomingRequestID), spec.Secret))
+	mux.HandleFunc("/healthz", healthz)
+	mux.HandleFunc("/version", versionHandler)
+	mux.HandleFunc("/config", settingsHandler(spec))
+	if prefetcher, ok := p.(plugin.Prefetcher); ok && spec.CacheTTL > 0 {
+		mux.HandleFunc("/prefetch", prefetchHandler(prefetcher, spec.Secret))
+	}
+	if checker, ok := p.(plugin.Checker); ok {
+		mux.HandleFunc("/readyz", readyz(checker))
+	}
+	if spec.Metrics {
+		mux.Handle("/metrics", promhttp.Handler())
+	}
+	server := &http.Server{Addr: spec.Address, Handler: mux}
+	if err := serve(server, spec.ShutdownGrace); err != nil {
+		logrus.Fatal(err)
+	}
+}
+
+// healthz reports that the server is up
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	_, _ = io.WriteString(w, "ok\n")
+}
+
+// incomingRequestID passes the id of the drone request in header to the
+// plugin, which uses it as request uuid
+func incomingRequestID(next http.Handler, header string) http.Handler {
+	if header == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := r.Header.Get(header); id != "" {
+			r = r.WithContext(plugin.ContextWithRequestID(r.Context(), id))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readyz reports if the scm is reachable with the configured token
+func readyz(checker plugin.Checker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checker.Check(r.Context()); err != nil {
+			logrus.Warnf("readiness check failed: %v", err)
+			http.Error(w, "scm unreachable", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = io.WriteString(w, "ok\n")
+	}
+}
 
-	http.Handle("/", handler)
-	logrus.Fatal(http.ListenAndServe(spec.Address, nil))
+// globalConfig returns the yaml of a global config setting, the value is
+// either the yaml itself or the path to a yaml file. The config is validated
+// at startup, a broken config would fail every build.
+func globalConfig(name, value string) string {
+	if value == "" {
+		return ""
+	}
+	if !strings.Contains(value, "\n") {
+		data, err := ioutil.ReadFile(value)
+		if err != nil {
+			logrus.Fatalf("unable to read %s: %v", name, err)
+		}
+		value = string(data)
+	}
+	if err := plugin.ValidateConfig(value); err != nil {
+		logrus.Fatalf("invalid %s: %v", name, err)
+	}
+	return value
 }
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/sirupsen/logrus"
+)
+
+// servePprof serves the pprof handlers on their own address in the
+// background, profiles expose internals and must not be reachable by drone
+func servePprof(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	go func() {
+		logrus.Infof("pprof listening on address %s", address)
+		if err := http.ListenAndServe(address, mux); err != nil {
+			logrus.Errorf("pprof server failed: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/bitsbeats/drone-tree-config/plugin"
+	"github.com/sirupsen/logrus"
+)
+
+// prefetchRequest names the commit to warm the cache for
+type prefetchRequest struct {
+	Repo   string `json:"repo"`
+	Sha    string `json:"sha"`
+	Config string `json:"config"`
+}
+
+// prefetchHandler resolves the configs of a commit ahead of its builds,
+// requests have to send the plugin secret as bearer token
+func prefetchHandler(prefetcher plugin.Prefetcher, secret string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, secret) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		in := prefetchRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := prefetcher.Prefetch(r.Context(), in.Repo, in.Sha, in.Config); err != nil {
+			logrus.Warnf("prefetch of %s at %s failed: %v", in.Repo, in.Sha, err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = io.WriteString(w, "ok\n")
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+)
+
+// settings returns the resolved value of every setting by its environment
+// variable, values of fields tagged with redact are hidden
+func settings(s *spec) map[string]string {
+	values := map[string]string{}
+	v := reflect.ValueOf(s).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name := field.Tag.Get("envconfig")
+		if name == "" {
+			continue
+		}
+		value := fmt.Sprint(v.Field(i).Interface())
+		zero := reflect.DeepEqual(v.Field(i).Interface(), reflect.Zero(field.Type).Interface())
+		if field.Tag.Get("redact") == "true" && !zero {
+			value = "redacted"
+		}
+		values[name] = value
+	}
+	return values
+}
+
+// settingsHandler reports the effective settings as json, requests have to
+// send the plugin secret as bearer token
+func settingsHandler(s *spec) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, s.Secret) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(settings(s))
+	}
+}
+
+// authorized checks that the request sends the plugin secret as bearer token
+func authorized(r *http.Request, secret string) bool {
+	token := []byte("Bearer " + secret)
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), token) == 1
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the status code
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// logSignatureFailures logs details about requests the drone handler rejects,
+// usually because the signature does not match the shared secret. The secret
+// itself is never logged.
+func logSignatureFailures(next http.Handler, secret string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !logrus.IsLevelEnabled(logrus.DebugLevel) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		if rec.status != http.StatusBadRequest {
+			return
+		}
+		logrus.WithFields(logrus.Fields{
+			"path":             r.URL.Path,
+			"remote":           r.RemoteAddr,
+			"signature_header": r.Header.Get("Signature") != "",
+			"signature_auth":   strings.HasPrefix(r.Header.Get("Authorization"), "Signature "),
+			"secret_empty":     secret == "",
+		}).Debug("request rejected, check that DRONE_YAML_SECRET on the drone server matches PLUGIN_SECRET")
+	})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/bitsbeats/drone-tree-config/plugin"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/config"
+)
+
+// validate resolves the config for a commit and a list of changed files and
+// prints it, the exit code is non zero if no valid config was found
+func validate(p plugin.Validator, args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	repo := flags.String("repo", "", "repository slug, e.g. namespace/name")
+	commit := flags.String("commit", "", "commit sha to resolve the config at")
+	configName := flags.String("config", ".drone.yml", "config file name")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "usage: drone-tree-config validate -repo namespace/name -commit sha [-config .drone.yml] changed-file...")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	parts := strings.SplitN(*repo, "/", 2)
+	if len(parts) != 2 || *commit == "" || flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	req := &config.Request{
+		Build: drone.Build{
+			After: *commit,
+		},
+		Repo: drone.Repo{
+			Namespace: parts[0],
+			Name:      parts[1],
+			Slug:      *repo,
+			Config:    *configName,
+		},
+	}
+	res, err := p.Validate(context.Background(), req, flags.Args())
+	if err != nil {
+		fmt.Fprintf(stderr, "validation failed: %v\n", err)
+		return 1
+	}
+	fmt.Fprint(stdout, res.Data)
+	return 0
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// build information, set via ldflags, e.g.
+// -ldflags "-X main.version=1.0.0 -X main.commit=abc123 -X main.date=2020-01-01"
+var (
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
+)
+
+// buildInfo is the response of the version endpoint
+type buildInfo struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit"`
+	Date    string `json:"date"`
+}
+
+// versionString returns the build information in a human readable form
+func versionString() string {
+	return fmt.Sprintf("drone-tree-config %s (commit %s, built %s)", version, commit, date)
+}
+
+// versionHandler reports the build information as json
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(buildInfo{
+		Version: version,
+		Commit:  commit,
+		Date:    date,
+	})
+}
@@ -4,15 +4,13 @@ go 1.12
 
 require (
 	github.com/drone/drone-go v1.0.4
-	github.com/drone/go-scm v1.5.0
-	github.com/google/go-querystring v1.0.0 // indirect
+	github.com/drone/go-scm v1.29.1
+	github.com/google/go-jsonnet v0.17.0
 	github.com/google/uuid v1.1.1
 	github.com/kelseyhightower/envconfig v1.3.0
-	github.com/nbio/st v0.0.0-20140626010706-e9e8d9816f32 // indirect
-	github.com/sirupsen/logrus v1.4.1
-	golang.org/x/net v0.0.0-20190404232315-eb5bcb51f2a3 // indirect
-	golang.org/x/oauth2 v0.0.0-20190402181905-9f3314589c9a
-	golang.org/x/sync v0.0.0-20190423024810-112230192c58 // indirect
-	golang.org/x/sys v0.0.0-20190412213103-97732733099d // indirect
-	gopkg.in/yaml.v2 v2.2.2
+	github.com/prometheus/client_golang v1.12.0
+	github.com/sirupsen/logrus v1.6.0
+	go.starlark.net v0.0.0-20230302034142-4b1e35fe2254
+	gopkg.in/yaml.v2 v2.4.0
+	gopkg.in/yaml.v3 v3.0.1
 )
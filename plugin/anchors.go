@@ -0,0 +1,67 @@
+package plugin
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	// anchorPattern matches an anchor at the start of a block node, e.g.
+	// "key: &name" or "- &name", anchors in flow collections are not found
+	anchorPattern = regexp.MustCompile(`^\s*(?:[-?]\s+)*(?:[^\s#'"{\[][^#]*?:\s+)?&([^\s\[\]{},]+)`)
+
+	// blockScalarPattern matches a line starting a literal or folded block
+	// scalar, its content may look like anchors
+	blockScalarPattern = regexp.MustCompile(`(?:^|[\s:-])[|>][-+0-9]*\s*(?:#.*)?$`)
+)
+
+// documentAnchors returns the anchors defined in a yaml document
+func documentAnchors(document string) []string {
+	anchors := []string{}
+	scalarIndent := -1
+	for _, line := range strings.Split(document, "\n") {
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		if scalarIndent >= 0 {
+			if strings.TrimSpace(line) == "" || indent > scalarIndent {
+				continue
+			}
+			scalarIndent = -1
+		}
+		if m := anchorPattern.FindStringSubmatch(line); m != nil {
+			anchors = append(anchors, m[1])
+		}
+		if blockScalarPattern.MatchString(line) {
+			scalarIndent = indent
+		}
+	}
+	return anchors
+}
+
+// checkAnchors reports anchors defined in more than one of the concatenated
+// files. Anchors are scoped to their document so drone accepts them, other
+// yaml tools may not. Conflicts are errors if strict anchors are enabled.
+func (p *plugin) checkAnchors(req *request) error {
+	defined := map[string]string{}
+	for _, c := range req.configs {
+		for _, document := range splitDocuments(c.content) {
+			for _, anchor := range documentAnchors(document) {
+				first, ok := defined[anchor]
+				if !ok {
+					defined[anchor] = c.source
+					continue
+				}
+				if first == c.source {
+					continue
+				}
+				err := fmt.Errorf("anchor &%s of %s is already defined in %s", anchor, c.source, first)
+				if p.strictAnchors {
+					req.Log.Error(err)
+					return err
+				}
+				req.Log.Warn(err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package plugin
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/config"
+)
+
+func TestDocumentAnchors(t *testing.T) {
+	document := "kind: pipeline\nname: a\nx-defaults: &defaults\n  image: golang\n" +
+		"steps:\n- <<: *defaults\n  name: build\n  commands:\n  - make && make test\n" +
+		"- &deploy\n  name: deploy\n  commands:\n  - |\n    echo key: &quoted\n  - echo done\n" +
+		"trigger: &trigger # push only\n  event: [push]\n"
+	if want, got := []string{"defaults", "deploy", "trigger"}, documentAnchors(document); !reflect.DeepEqual(want, got) {
+		t.Errorf("Want %v got %v", want, got)
+	}
+}
+
+func TestStrictAnchors(t *testing.T) {
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var name string
+		switch r.URL.Path {
+		case "/repos/foosinn/dronetest/contents/a/b/.drone.yml":
+			name = "b"
+		case "/repos/foosinn/dronetest/contents/.drone.yml":
+			name = "root"
+		default:
+			mux.ServeHTTP(w, r)
+			return
+		}
+		content := "kind: pipeline\nname: " + name + "\nx-defaults: &defaults\n  image: golang\n" +
+			"steps:\n- <<: *defaults\n  name: test\n"
+		fmt.Fprintf(w, `{"content": "%s"}`, base64.StdEncoding.EncodeToString([]byte(content)))
+	}))
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	for _, strict := range []bool{false, true} {
+		plugin := New(
+			WithServer(ts.URL),
+			WithToken(mockToken),
+			WithConcat(true),
+			WithStrictAnchors(strict),
+		)
+		droneConfig, err := plugin.Find(noContext, req)
+		if !strict {
+			if err != nil || droneConfig == nil {
+				t.Errorf("Want a config got %v %v", droneConfig, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), "anchor &defaults of /.drone.yml is already defined in /a/b/.drone.yml") {
+			t.Errorf("Want an anchor conflict got %v", err)
+		}
+	}
+}
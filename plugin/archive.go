@@ -0,0 +1,206 @@
+package plugin
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/drone/go-scm/scm"
+)
+
+// maxArchiveSize is the maximum size of the files extracted from an archive,
+// larger archives fall back to requesting each file
+const maxArchiveSize = 64 << 20
+
+var errArchiveTooLarge = errors.New("archive exceeds the maximum archive size")
+
+// archiveContentService reads the config files of the request repository at
+// the request ref from the extracted archive, other files, repositories and
+// refs, e.g. includes or submodules, are read from the scm
+type archiveContentService struct {
+	scm.ContentService
+	local     *mockContentService
+	slug      string
+	ref       string
+	candidate func(file string) bool
+}
+
+func (s *archiveContentService) Find(ctx context.Context, repo, file, ref string) (*scm.Content, *scm.Response, error) {
+	if repo != s.slug || ref != s.ref || !s.candidate(file) {
+		return s.ContentService.Find(ctx, repo, file, ref)
+	}
+	return s.local.Find(ctx, repo, file, ref)
+}
+
+func (s *archiveContentService) List(ctx context.Context, repo, dir, ref string, opts scm.ListOptions) ([]*scm.ContentInfo, *scm.Response, error) {
+	if repo != s.slug || ref != s.ref {
+		return s.ContentService.List(ctx, repo, dir, ref, opts)
+	}
+	return s.local.List(ctx, repo, dir, ref, opts)
+}
+
+// archivePath returns the path of the tar.gz archive endpoint relative to
+// the api of the provider, an empty path if the provider has none
+func (p *plugin) archivePath(slug, ref string) string {
+	switch p.provider {
+	case providerGithub:
+		return fmt.Sprintf("repos/%s/tarball/%s", slug, ref)
+	case providerGitlab:
+		return fmt.Sprintf("api/v4/projects/%s/repository/archive.tar.gz?sha=%s", strings.Replace(slug, "/", "%2F", -1), ref)
+	default:
+		return ""
+	}
+}
+
+// archiveCandidate reports if file may be read as a config of the request,
+// only these files are extracted from the archive
+func (p *plugin) archiveCandidate(req *request, file string) bool {
+	file = path.Clean("/" + file)
+	name := path.Base(file)
+	if file == "/.droneignore" || file == "/.gitmodules" {
+		return true
+	}
+	for _, configName := range p.configNamesFor(req) {
+		if name == path.Base(configName) {
+			return true
+		}
+	}
+	return p.configDir != "" && strings.HasSuffix(path.Dir(file), "/"+p.configDir) && p.configExtension(name)
+}
+
+// useArchive downloads the archive of the repository at the config ref and
+// reads the config files from it instead of requesting each file. The
+// returned directory has to be removed once the request is done, it is empty
+// if the archive is not used. Failures fall back to requesting each file.
+func (p *plugin) useArchive(ctx context.Context, req *request) string {
+	slug, ref := p.configRepoFor(req), p.configRefFor(req)
+	archivePath := p.archivePath(slug, ref)
+	if archivePath == "" {
+		req.Log.Warnf("archives are not supported for the %s provider", p.provider)
+		return ""
+	}
+
+	dir, err := ioutil.TempDir("", "drone-tree-config")
+	if err != nil {
+		req.Log.Warnf("unable to create archive directory: %v", err)
+		return ""
+	}
+
+	// extract like the mock provider expects it, below dir/owner/repo
+	local := &mockScm{root: dir}
+	repoDir := local.file(slug, "/")
+	candidate := func(file string) bool {
+		return p.archiveCandidate(req, file)
+	}
+	err = p.retry(ctx, req, "download archive", func() (*scm.Response, error) {
+		res, err := req.Client.Do(ctx, &scm.Request{Method: http.MethodGet, Path: archivePath})
+		if err != nil {
+			return res, err
+		}
+		defer res.Body.Close()
+		if res.Status != http.StatusOK {
+			return res, fmt.Errorf("unexpected status %d", res.Status)
+		}
+		if err := os.RemoveAll(repoDir); err != nil {
+			return res, err
+		}
+		return res, extractArchive(res.Body, repoDir, candidate)
+	})
+	if err != nil {
+		req.Log.Warnf("unable to download archive, requesting files instead: %v", err)
+		_ = os.RemoveAll(dir)
+		return ""
+	}
+
+	req.Log.Debugf("reading configs from the archive at %s", ref)
+	req.Client.Contents = &archiveContentService{
+		ContentService: req.Client.Contents,
+		local:          &mockContentService{mock: local},
+		slug:           slug,
+		ref:            ref,
+		candidate:      candidate,
+	}
+	return dir
+}
+
+// rootChanges reports if all changed files are in the root directory, a nil
+// list means no changes are known and all configs are searched
+func rootChanges(changedFiles []string) bool {
+	if changedFiles == nil {
+		return false
+	}
+	for _, file := range changedFiles {
+		if path.Dir(path.Clean("/"+file)) != "/" {
+			return false
+		}
+	}
+	return true
+}
+
+// extractArchive extracts the directories and the candidate files of a tar.gz
+// archive to dir, the top level directory of the archive is stripped. Links
+// and paths leaving dir are skipped. At most maxArchiveSize bytes are
+// extracted.
+func extractArchive(r io.Reader, dir string, candidate func(file string) bool) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	size := int64(0)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// strip the top level directory, e.g. owner-repo-sha
+		name := path.Clean("/" + header.Name)
+		if i := strings.Index(name[1:], "/"); i >= 0 {
+			name = name[i+1:]
+		} else {
+			continue
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if !candidate(name) {
+				continue
+			}
+			if size += header.Size; size > maxArchiveSize {
+				return errArchiveTooLarge
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package plugin
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/config"
+)
+
+// writeTestArchive packs the files like the github tarball endpoint, below a
+// top level directory
+func writeTestArchive(w io.Writer, files map[string]string) {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		_ = tw.WriteHeader(&tar.Header{
+			Name:     "foosinn-dronetest-8ecad91/" + name,
+			Mode:     0600,
+			Size:     int64(len(content)),
+			Typeflag: tar.TypeReg,
+		})
+		_, _ = tw.Write([]byte(content))
+	}
+	_ = tw.Close()
+	_ = gz.Close()
+}
+
+// fixtureContent returns the decoded content of a contents api fixture
+func fixtureContent(t *testing.T, fixture string) string {
+	data, err := ioutil.ReadFile(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := struct {
+		Content []byte `json:"content"`
+	}{}
+	if err := json.Unmarshal(data, &content); err != nil {
+		t.Fatal(err)
+	}
+	return string(content.Content)
+}
+
+func TestExtractArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drone-tree-config-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	candidate := func(file string) bool {
+		return strings.HasSuffix(file, ".yml")
+	}
+	buf := bytes.Buffer{}
+	writeTestArchive(&buf, map[string]string{
+		"a/b/.drone.yml":   "kind: pipeline\n",
+		"a/b/main.go":      "package main\n",
+		"../../escape.yml": "kind: pipeline\n",
+	})
+	if err := extractArchive(&buf, filepath.Join(dir, "repo"), candidate); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "repo/a/b/.drone.yml")); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "repo/a/b/main.go")); err == nil {
+		t.Error("Want files that are no config candidates to be skipped")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escape.yml")); err == nil {
+		t.Error("Want paths leaving the repository to be skipped")
+	}
+
+	// the size of skipped files does not count
+	buf.Reset()
+	writeTestArchive(&buf, map[string]string{
+		"large.bin":  strings.Repeat("x", maxArchiveSize+1),
+		".drone.yml": "kind: pipeline\n",
+	})
+	if err := extractArchive(&buf, filepath.Join(dir, "large"), candidate); err != nil {
+		t.Error(err)
+	}
+	buf.Reset()
+	writeTestArchive(&buf, map[string]string{
+		"large.yml": strings.Repeat("x", maxArchiveSize+1),
+	})
+	if want, got := errArchiveTooLarge, extractArchive(&buf, filepath.Join(dir, "large"), candidate); want != got {
+		t.Errorf("Want %v got %v", want, got)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	files := map[string]string{
+		".drone.yml":     fixtureContent(t, "testdata/.drone.yml.json"),
+		"a/b/.drone.yml": fixtureContent(t, "testdata/a_b_.drone.yml.json"),
+		"a/b/c/d/file":   "changed\n",
+	}
+	var contents int32
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/repos/foosinn/dronetest/tarball/8ecad91991d5da985a2a8dd97cc19029dc1c2899":
+			writeTestArchive(w, files)
+			return
+		case strings.HasPrefix(r.URL.Path, "/repos/foosinn/dronetest/contents/"):
+			atomic.AddInt32(&contents, 1)
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithConcat(true),
+		WithArchive(true),
+	)
+	droneConfig, err := plugin.Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if want, got := "---\nkind: pipeline\nname: default\n\nsteps:\n- name: build\n  image: golang\n  commands:\n  - go build\n  - go test -short\n\n- name: integration\n  image: golang\n  commands:\n  - go test -v\n---\nkind: pipeline\nname: default\n\nsteps:\n- name: frontend\n  image: node\n  commands:\n  - npm install\n  - npm test\n\n- name: backend\n  image: golang\n  commands:\n  - go build\n  - go test\n", droneConfig.Data; want != got {
+		t.Errorf("Want %q got %q", want, got)
+	}
+	if got := atomic.LoadInt32(&contents); got != 0 {
+		t.Errorf("Want no content requests got %d", got)
+	}
+}
+
+func TestArchiveRootConfig(t *testing.T) {
+	var tarballs int32
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/repos/foosinn/dronetest/tarball/") {
+			atomic.AddInt32(&tarballs, 1)
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name    string
+		options []Option
+	}{
+		{"single config", []Option{WithSingleConfig(true)}},
+		{"flat repository", []Option{WithFlatRepos([]string{"foosinn/*"})}},
+	}
+	for _, test := range tests {
+		req := &config.Request{
+			Build: drone.Build{
+				Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+				After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+			},
+			Repo: drone.Repo{
+				Namespace: "foosinn",
+				Name:      "dronetest",
+				Slug:      "foosinn/dronetest",
+				Config:    ".drone.yml",
+			},
+		}
+		plugin := New(append([]Option{
+			WithServer(ts.URL),
+			WithToken(mockToken),
+			WithArchive(true),
+		}, test.options...)...)
+		if _, err := plugin.Find(noContext, req); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+	if got := atomic.LoadInt32(&tarballs); got != 0 {
+		t.Errorf("Want no archive downloads got %d", got)
+	}
+}
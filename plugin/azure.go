@@ -0,0 +1,119 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/drone/go-scm/scm"
+	"github.com/drone/go-scm/scm/driver/azure"
+)
+
+// Azure DevOps support is limited to what the go-scm driver implements:
+//
+//   - Repositories are addressed by organization, project and name. The
+//     client is bound to the organization and project, the services only get
+//     the repository name.
+//   - Changed files of push builds are taken from the diff of the before and
+//     after commit. Builds without a before commit, e.g. the first push of a
+//     branch, fail if the driver does not support listing the changes of a
+//     single commit.
+//   - Pull request changes depend on the driver version, unsupported
+//     requests fail with scm.ErrNotSupported.
+//   - Personal access tokens require basic auth, set a username with
+//     WithUsername, Azure DevOps ignores its value.
+
+// newAzureClient creates a client for the organization and project of the
+// repository
+func (p *plugin) newAzureClient(slug string) (*scm.Client, error) {
+	organization, project, err := p.azureProject(slug)
+	if err != nil {
+		return nil, err
+	}
+	var client *scm.Client
+	if p.server == "" {
+		client = azure.NewDefault(organization, project)
+	} else {
+		client, err = azure.New(p.server, organization, project)
+		if err != nil {
+			return nil, err
+		}
+	}
+	client.Contents = &azureContents{client.Contents}
+	client.Git = &azureGit{client.Git}
+	client.PullRequests = &azurePullRequests{client.PullRequests}
+	return client, nil
+}
+
+// azureProject returns the organization and project of the slug, slugs are
+// either organization/project/repository or project/repository within the
+// configured organization. An empty slug, e.g. for health checks, returns
+// the configured organization without a project.
+func (p *plugin) azureProject(slug string) (organization, project string, err error) {
+	parts := strings.Split(slug, "/")
+	switch {
+	case slug == "":
+		organization = p.azureOrganization
+	case len(parts) == 3:
+		organization, project = parts[0], parts[1]
+	case len(parts) == 2:
+		organization, project = p.azureOrganization, parts[0]
+	default:
+		return "", "", fmt.Errorf("invalid azure devops repository '%s': expected [organization/]project/repository", slug)
+	}
+	if organization == "" {
+		return "", "", errors.New("the azure provider requires an organization")
+	}
+	return organization, project, nil
+}
+
+// azureRepo returns the repository name of the slug, the organization and
+// project are part of the client
+func azureRepo(slug string) string {
+	return path.Base(slug)
+}
+
+// azureContents passes the repository name to the content service
+type azureContents struct {
+	scm.ContentService
+}
+
+func (s *azureContents) Find(ctx context.Context, repo, path, ref string) (*scm.Content, *scm.Response, error) {
+	return s.ContentService.Find(ctx, azureRepo(repo), path, ref)
+}
+
+func (s *azureContents) List(ctx context.Context, repo, path, ref string, opts scm.ListOptions) ([]*scm.ContentInfo, *scm.Response, error) {
+	return s.ContentService.List(ctx, azureRepo(repo), path, ref, opts)
+}
+
+// azureGit passes the repository name to the git service
+type azureGit struct {
+	scm.GitService
+}
+
+func (s *azureGit) FindCommit(ctx context.Context, repo, ref string) (*scm.Commit, *scm.Response, error) {
+	return s.GitService.FindCommit(ctx, azureRepo(repo), ref)
+}
+
+func (s *azureGit) ListChanges(ctx context.Context, repo, ref string, opts scm.ListOptions) ([]*scm.Change, *scm.Response, error) {
+	return s.GitService.ListChanges(ctx, azureRepo(repo), ref, opts)
+}
+
+func (s *azureGit) CompareChanges(ctx context.Context, repo, source, target string, opts scm.ListOptions) ([]*scm.Change, *scm.Response, error) {
+	return s.GitService.CompareChanges(ctx, azureRepo(repo), source, target, opts)
+}
+
+// azurePullRequests passes the repository name to the pull request service
+type azurePullRequests struct {
+	scm.PullRequestService
+}
+
+func (s *azurePullRequests) Find(ctx context.Context, repo string, number int) (*scm.PullRequest, *scm.Response, error) {
+	return s.PullRequestService.Find(ctx, azureRepo(repo), number)
+}
+
+func (s *azurePullRequests) ListChanges(ctx context.Context, repo string, number int, opts scm.ListOptions) ([]*scm.Change, *scm.Response, error) {
+	return s.PullRequestService.ListChanges(ctx, azureRepo(repo), number, opts)
+}
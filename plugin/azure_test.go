@@ -0,0 +1,66 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+
+	"github.com/drone/go-scm/scm"
+)
+
+func TestAzureProject(t *testing.T) {
+	p := New(WithProvider(providerAzure), WithAzureOrganization("octocat")).(*plugin)
+	tests := []struct {
+		slug         string
+		organization string
+		project      string
+	}{
+		{"", "octocat", ""},
+		{"infra/dronetest", "octocat", "infra"},
+		{"foosinn/infra/dronetest", "foosinn", "infra"},
+	}
+	for _, test := range tests {
+		organization, project, err := p.azureProject(test.slug)
+		if err != nil {
+			t.Errorf("%s: %v", test.slug, err)
+			continue
+		}
+		if organization != test.organization || project != test.project {
+			t.Errorf("%s: want %s/%s got %s/%s", test.slug, test.organization, test.project, organization, project)
+		}
+	}
+
+	if _, _, err := p.azureProject("dronetest"); err == nil {
+		t.Error("Want an error for a slug without project")
+	}
+	p = New(WithProvider(providerAzure)).(*plugin)
+	if _, _, err := p.azureProject("infra/dronetest"); err == nil {
+		t.Error("Want an error without organization")
+	}
+}
+
+type recordingContents struct {
+	scm.ContentService
+	repo string
+}
+
+func (s *recordingContents) Find(ctx context.Context, repo, path, ref string) (*scm.Content, *scm.Response, error) {
+	s.repo = repo
+	return &scm.Content{}, nil, nil
+}
+
+func TestAzureRepo(t *testing.T) {
+	p := New(WithProvider(providerAzure), WithServer("https://dev.azure.com")).(*plugin)
+	client, err := p.newClient(mockToken, "foosinn/infra/dronetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := &recordingContents{}
+	client.Contents.(*azureContents).ContentService = recorder
+	if _, _, err := client.Contents.Find(noContext, "foosinn/infra/dronetest", ".drone.yml", "master"); err != nil {
+		t.Error(err)
+	}
+	if want, got := "dronetest", recorder.repo; want != got {
+		t.Errorf("Want %s got %s", want, got)
+	}
+}
@@ -0,0 +1,220 @@
+package plugin
+
+import (
+	"sync"
+	"time"
+
+	"github.com/drone/go-scm/scm"
+)
+
+type (
+	// configCache holds validated config files across requests
+	configCache struct {
+		mu        sync.Mutex
+		ttl       time.Duration
+		entries   map[configCacheKey]configCacheEntry
+		nextSweep time.Time
+	}
+
+	configCacheKey struct {
+		slug string
+		sha  string
+		path string
+	}
+
+	configCacheEntry struct {
+		content string
+		expires time.Time
+	}
+)
+
+// newConfigCache creates a cache that keeps entries for ttl
+func newConfigCache(ttl time.Duration) *configCache {
+	return &configCache{
+		ttl:     ttl,
+		entries: map[configCacheKey]configCacheEntry{},
+	}
+}
+
+// get returns the cached content for key if present and not expired
+func (c *configCache) get(key configCacheKey) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return "", false
+	}
+	return entry.content, true
+}
+
+// set stores content for key, expired entries are removed once per ttl
+func (c *configCache) set(key configCacheKey, content string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.After(c.nextSweep) {
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.nextSweep = now.Add(c.ttl)
+	}
+	c.entries[key] = configCacheEntry{
+		content: content,
+		expires: now.Add(c.ttl),
+	}
+}
+
+type (
+	// treeCache holds directory listings keyed by repository, ref and
+	// directory. It is safe to use on a nil pointer which disables it.
+	treeCache struct {
+		mu      sync.Mutex
+		ttl     time.Duration
+		size    int
+		entries map[configCacheKey]treeCacheEntry
+	}
+
+	treeCacheEntry struct {
+		ls      []*scm.ContentInfo
+		expires time.Time
+	}
+)
+
+// newTreeCache creates a cache that keeps up to size listings for ttl, a ttl
+// or size of 0 keeps listings forever or is unbounded, e.g. for the listings
+// of a single request
+func newTreeCache(ttl time.Duration, size int) *treeCache {
+	return &treeCache{
+		ttl:     ttl,
+		size:    size,
+		entries: map[configCacheKey]treeCacheEntry{},
+	}
+}
+
+// get returns the cached listing for key if present and not expired
+func (c *treeCache) get(key configCacheKey) ([]*scm.ContentInfo, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if c.ttl > 0 && time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.ls, true
+}
+
+// set stores the listing for key, a full cache drops the expired listings
+// and, if it is still full, the listing that expires first
+func (c *treeCache) set(key configCacheKey, ls []*scm.ContentInfo) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if _, ok := c.entries[key]; !ok && c.size > 0 && len(c.entries) >= c.size {
+		oldest := configCacheKey{}
+		for k, entry := range c.entries {
+			if c.ttl > 0 && now.After(entry.expires) {
+				delete(c.entries, k)
+			} else if oldest == (configCacheKey{}) || entry.expires.Before(c.entries[oldest].expires) {
+				oldest = k
+			}
+		}
+		if len(c.entries) >= c.size {
+			delete(c.entries, oldest)
+		}
+	}
+	c.entries[key] = treeCacheEntry{
+		ls:      ls,
+		expires: now.Add(c.ttl),
+	}
+}
+
+// missingFiles is a per request cache of files known not to exist, it is safe
+// to use on a nil pointer which disables it
+type missingFiles struct {
+	mu     sync.Mutex
+	files  map[string]bool
+	hits   int
+	misses int
+
+	// directories are config paths known to be directories
+	directories map[string]bool
+}
+
+// newMissingFiles creates an empty negative cache
+func newMissingFiles() *missingFiles {
+	return &missingFiles{files: map[string]bool{}, directories: map[string]bool{}}
+}
+
+// isDirectory reports if file is known to be a directory
+func (m *missingFiles) isDirectory(file string) bool {
+	if m == nil {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.directories[file]
+}
+
+// addDirectory marks file as a directory
+func (m *missingFiles) addDirectory(file string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.directories[file] = true
+}
+
+// has reports if file is known not to exist
+func (m *missingFiles) has(file string) bool {
+	if m == nil {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.files[file] {
+		m.hits++
+		return true
+	}
+	m.misses++
+	return false
+}
+
+// add marks file as not existing
+func (m *missingFiles) add(file string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[file] = true
+}
+
+// stats returns the number of cache hits and misses
+func (m *missingFiles) stats() (hits, misses int) {
+	if m == nil {
+		return 0, 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.hits, m.misses
+}
@@ -0,0 +1,92 @@
+package plugin
+
+import (
+	"strings"
+)
+
+// yamlDocument is a single document of a yaml stream
+type yamlDocument struct {
+	// directives are the %YAML and %TAG lines preceding the document
+	directives []string
+	// body is the source of the document without markers
+	body string
+}
+
+// parseDocuments splits a yaml stream into its documents. Only lines starting
+// in the first column are considered, markers in block scalars are indented
+// and quoted markers are never a line on their own.
+func parseDocuments(content string) []yamlDocument {
+	documents := []yamlDocument{}
+	current := yamlDocument{}
+	directives := []string{}
+	flush := func() {
+		if strings.TrimSpace(current.body) != "" || len(current.directives) > 0 {
+			documents = append(documents, current)
+		}
+		current = yamlDocument{}
+	}
+	for _, line := range strings.SplitAfter(content, "\n") {
+		if line == "" {
+			continue
+		}
+		trimmed := strings.TrimRight(line, " \t\r\n")
+		switch {
+		case trimmed == "---":
+			flush()
+			current.directives, directives = directives, []string{}
+		case trimmed == "...":
+			flush()
+		case strings.HasPrefix(trimmed, "%"):
+			directives = append(directives, trimmed)
+		default:
+			current.body += line
+		}
+	}
+	flush()
+	return documents
+}
+
+// cleanupConfig re-emits the documents of the merged config, dropping empty
+// documents, duplicate separators and document end markers. The documents are
+// not re-serialized, unmarshalling would lose comments and change scalars like
+// 1.10 or yes. Directives are kept, the preceding document is then ended
+// explicitly as required by the yaml spec.
+func cleanupConfig(configData string) string {
+	cleaned := ""
+	for _, document := range parseDocuments(configData) {
+		if len(document.directives) > 0 && cleaned != "" {
+			cleaned += "...\n"
+		}
+		for _, directive := range document.directives {
+			cleaned += directive + "\n"
+		}
+		cleaned += "---\n" + strings.TrimLeft(document.body, "\n")
+		if !strings.HasSuffix(cleaned, "\n") {
+			cleaned += "\n"
+		}
+	}
+	return cleaned
+}
+
+// splitDocuments splits a config file at its document separators, the
+// separator lines are not part of the documents and empty documents are
+// dropped
+func splitDocuments(content string) []string {
+	documents := []string{}
+	for _, document := range parseDocuments(content) {
+		if strings.TrimSpace(document.body) != "" {
+			documents = append(documents, document.body)
+		}
+	}
+	return documents
+}
+
+// utf8BOM is the byte order mark some editors prepend to utf-8 files
+const utf8BOM = "\xef\xbb\xbf"
+
+// normalizeContent strips a leading byte order mark and converts windows
+// line endings, the yaml parser and the document markers expect neither
+func normalizeContent(data []byte) string {
+	content := strings.TrimPrefix(string(data), utf8BOM)
+	return strings.Replace(content, "\r\n", "\n", -1)
+}
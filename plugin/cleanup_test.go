@@ -0,0 +1,125 @@
+package plugin
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/config"
+)
+
+func TestCleanupConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "document end markers",
+			in:   "---\nkind: pipeline\nname: a\n...\n---\nkind: pipeline\nname: b\n...\n",
+			want: "---\nkind: pipeline\nname: a\n---\nkind: pipeline\nname: b\n",
+		},
+		{
+			name: "duplicate separators",
+			in:   "---\n---\n\n---  \nkind: pipeline\nname: a\n",
+			want: "---\nkind: pipeline\nname: a\n",
+		},
+		{
+			name: "quoted markers",
+			in: "---\nkind: pipeline\nname: a\nsteps:\n- name: test\n  commands:\n" +
+				"  - echo \"loading...\"\n  - echo '---'\n  - echo ---\n",
+			want: "---\nkind: pipeline\nname: a\nsteps:\n- name: test\n  commands:\n" +
+				"  - echo \"loading...\"\n  - echo '---'\n  - echo ---\n",
+		},
+		{
+			name: "block scalar",
+			in: "---\nkind: pipeline\nname: a\nsteps:\n- name: test\n  commands:\n  - |\n" +
+				"    cat <<EOF\n    ---\n    ...\n    EOF\n",
+			want: "---\nkind: pipeline\nname: a\nsteps:\n- name: test\n  commands:\n  - |\n" +
+				"    cat <<EOF\n    ---\n    ...\n    EOF\n",
+		},
+		{
+			name: "directives",
+			in:   "---\nkind: pipeline\nname: a\n...\n%YAML 1.1\n---\nkind: pipeline\nname: b\n",
+			want: "---\nkind: pipeline\nname: a\n...\n%YAML 1.1\n---\nkind: pipeline\nname: b\n",
+		},
+		{
+			name: "leading directives",
+			in:   "%YAML 1.1\n---\nkind: pipeline\nname: a\n---\nkind: pipeline\nname: b\n",
+			want: "%YAML 1.1\n---\nkind: pipeline\nname: a\n---\nkind: pipeline\nname: b\n",
+		},
+		{
+			name: "comments",
+			in:   "---\n# build ... and test\nkind: pipeline # ---\nname: a\n",
+			want: "---\n# build ... and test\nkind: pipeline # ---\nname: a\n",
+		},
+	}
+	for _, test := range tests {
+		if got := cleanupConfig(test.in); got != test.want {
+			t.Errorf("%s: want\n%q\ngot\n%q", test.name, test.want, got)
+		}
+	}
+}
+
+func TestDisableCleanup(t *testing.T) {
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/repos/foosinn/dronetest/contents/a/b/.drone.yml" {
+			content := base64.StdEncoding.EncodeToString([]byte("---\nkind: pipeline\nname: default\n...\n"))
+			fmt.Fprintf(w, `{"path": "a/b/.drone.yml", "content": "%s"}`, content)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithDisableCleanup(true),
+	)
+	droneConfig, err := plugin.Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if want, got := "---\nkind: pipeline\nname: default\n...\n", droneConfig.Data; want != got {
+		t.Errorf("Want %q got %q", want, got)
+	}
+}
+
+func TestSplitDocuments(t *testing.T) {
+	documents := splitDocuments("kind: pipeline\nname: a\n---\n---\nkind: pipeline\nname: b\n---  \n")
+	if want, got := 2, len(documents); want != got {
+		t.Fatalf("Want %d documents got %d: %q", want, got, documents)
+	}
+	if want, got := "kind: pipeline\nname: b\n", documents[1]; want != got {
+		t.Errorf("Want %q got %q", want, got)
+	}
+}
+
+func TestDroneConfigAppendDirectives(t *testing.T) {
+	p := &plugin{}
+	got := p.droneConfigAppend("", "kind: pipeline\nname: a\n", "%YAML 1.1\n---\nkind: pipeline\nname: b\n")
+	if want := "---\nkind: pipeline\nname: a\n...\n%YAML 1.1\n---\nkind: pipeline\nname: b\n"; want != got {
+		t.Errorf("Want %q got %q", want, got)
+	}
+	if want, got := got, cleanupConfig(got); want != got {
+		t.Errorf("Want %q got %q", want, got)
+	}
+}
@@ -0,0 +1,306 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"github.com/drone/go-scm/scm"
+	"github.com/drone/go-scm/scm/driver/bitbucket"
+	"github.com/drone/go-scm/scm/driver/gitea"
+	"github.com/drone/go-scm/scm/driver/github"
+	"github.com/drone/go-scm/scm/driver/gitlab"
+	"github.com/drone/go-scm/scm/driver/stash"
+	"github.com/drone/go-scm/scm/transport"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// supported scm providers
+const (
+	providerGithub    = "github"
+	providerGitlab    = "gitlab"
+	providerGitea     = "gitea"
+	providerStash     = "stash"
+	providerBitbucket = "bitbucket"
+	providerAzure     = "azure"
+	providerMock      = "mock"
+)
+
+// supported token schemes
+const (
+	// tokenSchemeBearer sends an Authorization: Bearer header
+	tokenSchemeBearer = "bearer"
+	// tokenSchemeToken sends an Authorization: token header
+	tokenSchemeToken = "token"
+	// tokenSchemePrivateToken sends a Private-Token header, e.g. for gitlab
+	tokenSchemePrivateToken = "private-token"
+)
+
+// ClientFactory creates the scm client of a repository, it is called once per
+// config request. The services of the client are the scm operations of the
+// plugin: Contents to get files and list directories, Git and PullRequests to
+// list the changed files. Tests use it to run against in-memory repositories.
+type ClientFactory func(token, slug string) (*scm.Client, error)
+
+// scmClient creates the scm client of a repository using the configured
+// client factory, by default a client of the configured provider
+func (p *plugin) scmClient(token, slug string) (*scm.Client, error) {
+	if p.clientFactory != nil {
+		return p.clientFactory(token, slug)
+	}
+	return p.newClient(token, slug)
+}
+
+// newClient creates a scm client for the configured provider, the slug of the
+// repository is only required by providers that bind clients to it
+func (p *plugin) newClient(token, slug string) (client *scm.Client, err error) {
+	switch p.provider {
+	case providerGithub:
+		if p.server == "" {
+			client = github.NewDefault()
+		} else {
+			server, err := githubServer(p.server)
+			if err != nil {
+				return nil, err
+			}
+			client, err = github.New(server)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case providerGitlab:
+		if p.server == "" {
+			client = gitlab.NewDefault()
+		} else {
+			client, err = gitlab.New(p.server)
+		}
+	case providerGitea:
+		if p.server == "" {
+			return nil, errors.New("the gitea provider requires a scm server")
+		}
+		client, err = gitea.New(p.server)
+		if err == nil {
+			client.Git = &giteaGit{GitService: client.Git, client: client}
+			client.PullRequests = &giteaPullRequests{PullRequestService: client.PullRequests, client: client}
+		}
+	case providerStash:
+		if p.server == "" {
+			return nil, errors.New("the stash provider requires a scm server")
+		}
+		client, err = stash.New(p.server)
+	case providerBitbucket:
+		if p.server == "" {
+			client = bitbucket.NewDefault()
+		} else {
+			client, err = bitbucket.New(p.server)
+		}
+	case providerAzure:
+		client, err = p.newAzureClient(slug)
+	case providerMock:
+		if p.server == "" {
+			return nil, errors.New("the mock provider requires a fixtures directory as scm server")
+		}
+		return newMockClient(p.server), nil
+	default:
+		return nil, fmt.Errorf("unsupported scm provider '%s'", p.provider)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	client.Client = &http.Client{
+		Transport: p.authTransport(token),
+		Timeout:   p.scmTimeout,
+	}
+	return client, nil
+}
+
+// authTransport authenticates requests with the token using the configured
+// scheme or, if a username is configured, e.g. for bitbucket app passwords,
+// via basic auth
+func (p *plugin) authTransport(token string) http.RoundTripper {
+	if p.username != "" {
+		return &transport.BasicAuth{
+			Username: p.username,
+			Password: token,
+			Base:     p.transport(),
+		}
+	}
+	switch p.tokenScheme {
+	case tokenSchemeToken:
+		return &transport.Authorization{
+			Scheme:      "token",
+			Credentials: token,
+			Base:        p.transport(),
+		}
+	case tokenSchemePrivateToken:
+		return &transport.PrivateToken{
+			Token: token,
+			Base:  p.transport(),
+		}
+	default:
+		return &transport.BearerToken{
+			Token: token,
+			Base:  p.transport(),
+		}
+	}
+}
+
+// requestIDTransport sets a header with the id of the drone request on every
+// scm request
+type requestIDTransport struct {
+	header string
+	id     string
+	base   http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper, the request is not modified
+func (t *requestIDTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Header = make(http.Header, len(r.Header)+1)
+	for k, v := range r.Header {
+		r2.Header[k] = append([]string(nil), v...)
+	}
+	r2.Header.Set(t.header, t.id)
+	return t.base.RoundTrip(r2)
+}
+
+// countingTransport counts the requests sent through it
+type countingTransport struct {
+	count *int32
+	base  http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	atomic.AddInt32(t.count, 1)
+	return t.base.RoundTrip(r)
+}
+
+// contentLimitKey is the context key of the maximum response size of content
+// requests
+type contentLimitKey struct{}
+
+// limitContent limits the response body of the scm requests made with the
+// returned context to what a file of the maximum file size may take. Content
+// is base64 encoded in json responses, twice the file size leaves room for the
+// encoding and the metadata.
+func (p *plugin) limitContent(ctx context.Context) context.Context {
+	if p.maxFileSize <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, contentLimitKey{}, 2*int64(p.maxFileSize)+64<<10)
+}
+
+// contentLimitTransport fails reading response bodies that exceed the limit
+// set with limitContent with errFileTooLarge
+type contentLimitTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *contentLimitTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	res, err := t.base.RoundTrip(r)
+	limit, ok := r.Context().Value(contentLimitKey{}).(int64)
+	if err != nil || !ok {
+		return res, err
+	}
+	res.Body = &limitedBody{
+		Reader: io.LimitReader(res.Body, limit+1),
+		Closer: res.Body,
+		left:   limit,
+	}
+	return res, nil
+}
+
+// limitedBody is a response body that fails once more than left bytes are read
+type limitedBody struct {
+	io.Reader
+	io.Closer
+	left int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	b.left -= int64(n)
+	if b.left < 0 {
+		return n, errFileTooLarge
+	}
+	return n, err
+}
+
+// githubServer normalizes the github server to its api url, web urls like
+// https://ghe.example.com are rewritten to the github enterprise api path
+func githubServer(server string) (string, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return "", fmt.Errorf("invalid scm server url '%s': %v", server, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid scm server url '%s': expected http(s)://host", server)
+	}
+	switch {
+	case u.Host == "github.com" || u.Host == "www.github.com":
+		return "https://api.github.com", nil
+	case u.Host == "api.github.com":
+	case strings.Trim(u.Path, "/") == "":
+		u.Path = "/api/v3"
+	}
+	return strings.TrimSuffix(u.String(), "/"), nil
+}
+
+// transport returns the round tripper used for all scm requests
+func (p *plugin) transport() http.RoundTripper {
+	return promhttp.InstrumentRoundTripperDuration(scmRequestDuration, p.baseTransport)
+}
+
+// scmHost returns the host name of the scm server repositories are cloned
+// from, it is empty if it is unknown, e.g. for the mock provider
+func (p *plugin) scmHost() string {
+	if p.server != "" {
+		u, err := url.Parse(p.server)
+		if err != nil || u.Hostname() == "" {
+			return ""
+		}
+		if host := strings.ToLower(u.Hostname()); host != "api.github.com" {
+			return host
+		}
+		return "github.com"
+	}
+	switch p.provider {
+	case providerGithub:
+		return "github.com"
+	case providerGitlab:
+		return "gitlab.com"
+	case providerBitbucket:
+		return "bitbucket.org"
+	default:
+		return ""
+	}
+}
+
+// pullRequestRefPrefix returns the ref prefix the provider uses for pull
+// requests, the pull request number is the path segment after the prefix
+func (p *plugin) pullRequestRefPrefix() string {
+	switch p.provider {
+	case providerGitlab:
+		return "refs/merge-requests/"
+	case providerStash, providerBitbucket:
+		return "refs/pull-requests/"
+	default:
+		return "refs/pull/"
+	}
+}
+
+// scmPath converts a repository path to the form expected by the content
+// endpoints: relative to the repository root without a leading slash, some
+// providers like gitea reject the resulting double slash in the url
+func scmPath(file string) string {
+	return strings.TrimPrefix(file, "/")
+}
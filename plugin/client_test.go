@@ -0,0 +1,286 @@
+package plugin
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/config"
+)
+
+func TestGithubServer(t *testing.T) {
+	tests := []struct {
+		server string
+		want   string
+	}{
+		{"https://ghe.example.com", "https://ghe.example.com/api/v3"},
+		{"https://ghe.example.com/", "https://ghe.example.com/api/v3"},
+		{"https://ghe.example.com/api/v3", "https://ghe.example.com/api/v3"},
+		{"https://ghe.example.com/api/v3/", "https://ghe.example.com/api/v3"},
+		{"https://github.com", "https://api.github.com"},
+		{"https://api.github.com/", "https://api.github.com"},
+	}
+	for _, test := range tests {
+		got, err := githubServer(test.server)
+		if err != nil {
+			t.Errorf("Want no error for %s got %v", test.server, err)
+		}
+		if got != test.want {
+			t.Errorf("Want %s for %s got %s", test.want, test.server, got)
+		}
+	}
+
+	for _, server := range []string{"ghe.example.com", "ftp://ghe.example.com", "https://", "http://[::1"} {
+		if _, err := githubServer(server); err == nil {
+			t.Errorf("Want an error for %s", server)
+		}
+	}
+}
+
+func TestBitbucket(t *testing.T) {
+	p := New(WithProvider(providerBitbucket)).(*plugin)
+	if _, err := p.newClient(mockToken, ""); err != nil {
+		t.Error(err)
+	}
+	if want, got := "refs/pull-requests/", p.pullRequestRefPrefix(); want != got {
+		t.Errorf("Want %s got %s", want, got)
+	}
+}
+
+func TestBitbucketFind(t *testing.T) {
+	const (
+		before = "2897b31ec3a1b59279a08a8ad54dc360686327f7"
+		after  = "8ecad91991d5da985a2a8dd97cc19029dc1c2899"
+		api    = "/2.0/repositories/foosinn/dronetest/"
+	)
+	dirs := map[string]string{
+		"":      `[{"path": ".drone.yml", "type": "commit_file"}, {"path": "a", "type": "commit_directory"}, {"path": "d", "type": "commit_directory"}]`,
+		"a":     `[{"path": "a/b", "type": "commit_directory"}]`,
+		"a/b":   `[{"path": "a/b/.drone.yml", "type": "commit_file"}, {"path": "a/b/c", "type": "commit_directory"}]`,
+		"a/b/c": `[{"path": "a/b/c/file", "type": "commit_file"}]`,
+		"d":     `[{"path": "d/.drone.yml", "type": "commit_file"}, {"path": "d/file", "type": "commit_file"}]`,
+	}
+	files := map[string]string{
+		".drone.yml":     "kind: pipeline\nname: root\n",
+		"a/b/.drone.yml": "kind: pipeline\nname: a-b\n",
+		"d/.drone.yml":   "kind: pipeline\nname: d\n",
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		src := strings.TrimPrefix(r.URL.Path, api+"src/"+after+"/")
+		switch {
+		case r.URL.Path == api+"diffstat/"+after+".."+before:
+			// the diffstat of a push is paged
+			if r.URL.Query().Get("page") == "2" {
+				_, _ = io.WriteString(w, `{"values": [{"status": "added", "new": {"path": "d/file"}}]}`)
+				return
+			}
+			fmt.Fprintf(w, `{"values": [{"status": "modified", "old": {"path": "a/b/c/file"}, "new": {"path": "a/b/c/file"}}], "next": "http://%s%s?page=2&pagelen=100"}`, r.Host, r.URL.Path)
+		case r.URL.Path == api+"pullrequests/9/diffstat":
+			_, _ = io.WriteString(w, `{"values": [{"status": "modified", "old": {"path": "a/b/c/file"}, "new": {"path": "a/b/c/file"}}]}`)
+		case src == r.URL.Path:
+			w.WriteHeader(http.StatusNotFound)
+		case dirs[src] != "":
+			fmt.Fprintf(w, `{"values": %s}`, dirs[src])
+		case files[src] != "" && r.URL.Query().Get("format") == "meta":
+			fmt.Fprintf(w, `{"path": %q, "commit": {"hash": %q}}`, src, after)
+		case files[src] != "":
+			_, _ = io.WriteString(w, files[src])
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name string
+		ref  string
+		want string
+	}{
+		{"push", "refs/heads/master", "---\nkind: pipeline\nname: a-b\n---\nkind: pipeline\nname: root\n---\nkind: pipeline\nname: d\n"},
+		{"pull request", "refs/pull-requests/9/from", "---\nkind: pipeline\nname: a-b\n---\nkind: pipeline\nname: root\n"},
+	}
+	for _, test := range tests {
+		req := &config.Request{
+			Build: drone.Build{
+				Before: before,
+				After:  after,
+				Ref:    test.ref,
+			},
+			Repo: drone.Repo{
+				Namespace: "foosinn",
+				Name:      "dronetest",
+				Slug:      "foosinn/dronetest",
+				Config:    ".drone.yml",
+			},
+		}
+		plugin := New(
+			WithProvider(providerBitbucket),
+			WithServer(ts.URL),
+			WithToken(mockToken),
+			WithConcat(true),
+		)
+		droneConfig, err := plugin.Find(noContext, req)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if droneConfig == nil {
+			t.Errorf("%s: want a config got none", test.name)
+			continue
+		}
+		if want, got := test.want, droneConfig.Data; want != got {
+			t.Errorf("%s: want %q got %q", test.name, want, got)
+		}
+	}
+}
+
+func TestStash(t *testing.T) {
+	const (
+		before = "2897b31ec3a1b59279a08a8ad54dc360686327f7"
+		after  = "8ecad91991d5da985a2a8dd97cc19029dc1c2899"
+		api    = "/rest/api/1.0/projects/foosinn/repos/dronetest/"
+	)
+	// the files endpoint lists all files below a directory relative to it
+	files := map[string]string{
+		"":      `[".drone.yml", "a/b/.drone.yml", "a/b/c/file", "d/file"]`,
+		"a":     `["b/.drone.yml", "b/c/file"]`,
+		"a/b":   `[".drone.yml", "c/file"]`,
+		"a/b/c": `["file"]`,
+		"d":     `["file"]`,
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		switch {
+		case r.URL.Path == api+"compare/changes" && query.Get("from") == before && query.Get("to") == after:
+			_, _ = io.WriteString(w, `{"values": [{"path": {"toString": "a/b/c/file"}, "type": "MODIFY"}], "isLastPage": true}`)
+		case r.URL.Path == api+"pull-requests/5/changes":
+			_, _ = io.WriteString(w, `{"values": [{"path": {"toString": "d/file"}, "type": "ADD"}], "isLastPage": true}`)
+		case strings.HasPrefix(r.URL.Path, api+"files/") && query.Get("at") == after:
+			if ls, ok := files[strings.TrimPrefix(r.URL.Path, api+"files/")]; ok {
+				fmt.Fprintf(w, `{"values": %s, "isLastPage": true}`, ls)
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+		case r.URL.Path == api+"raw/.drone.yml" && query.Get("at") == after:
+			_, _ = io.WriteString(w, "kind: pipeline\nname: root\n")
+		case r.URL.Path == api+"raw/a/b/.drone.yml" && query.Get("at") == after:
+			_, _ = io.WriteString(w, "kind: pipeline\nname: a-b\n")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = io.WriteString(w, `{"errors": [{"message": "not found"}]}`)
+		}
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name string
+		ref  string
+		want string
+	}{
+		{"push", "refs/heads/master", "---\nkind: pipeline\nname: a-b\n"},
+		{"pull request", "refs/pull-requests/5/from", "---\nkind: pipeline\nname: root\n"},
+	}
+	for _, test := range tests {
+		req := &config.Request{
+			Build: drone.Build{
+				Before: before,
+				After:  after,
+				Ref:    test.ref,
+			},
+			Repo: drone.Repo{
+				Namespace: "foosinn",
+				Name:      "dronetest",
+				Slug:      "foosinn/dronetest",
+				Config:    ".drone.yml",
+			},
+		}
+		plugin := New(
+			WithProvider(providerStash),
+			WithServer(ts.URL),
+			WithToken(mockToken),
+		)
+		droneConfig, err := plugin.Find(noContext, req)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if droneConfig == nil {
+			t.Errorf("%s: want a config got none", test.name)
+			continue
+		}
+		if want, got := test.want, droneConfig.Data; want != got {
+			t.Errorf("%s: want %q got %q", test.name, want, got)
+		}
+	}
+}
+
+func TestCACerts(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/api/v3/", http.StripPrefix("/api/v3", testMux()))
+	ts := httptest.NewTLSServer(mux)
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			After:   "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+			Trigger: "@cron",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+
+	// the test server certificate is self signed
+	if _, err := New(WithServer(ts.URL), WithToken(mockToken)).Find(noContext, req); err == nil {
+		t.Error("Want a tls error without the ca certificate")
+	}
+
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	pool, err := ParseCACerts(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, option := range []Option{WithCACerts(pool), WithInsecureSkipVerify(true)} {
+		droneConfig, err := New(WithServer(ts.URL), WithToken(mockToken), option).Find(noContext, req)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if droneConfig == nil {
+			t.Error("Want a config")
+		}
+	}
+
+	if _, err := ParseCACerts([]byte("no certificate")); err == nil {
+		t.Error("Want an error for invalid certificates")
+	}
+}
+
+func TestProxyFromEnvironment(t *testing.T) {
+	proxy := reflect.ValueOf(http.ProxyFromEnvironment).Pointer()
+	for name, options := range map[string][]Option{
+		"default":  nil,
+		"ca certs": {WithCACerts(x509.NewCertPool())},
+		"insecure": {WithInsecureSkipVerify(true)},
+	} {
+		p := New(options...).(*plugin)
+		transport, ok := p.baseTransport.(*http.Transport)
+		if !ok {
+			t.Errorf("%s: want an *http.Transport got %T", name, p.baseTransport)
+			continue
+		}
+		if transport.Proxy == nil || reflect.ValueOf(transport.Proxy).Pointer() != proxy {
+			t.Errorf("%s: want the proxy from the environment", name)
+		}
+	}
+}
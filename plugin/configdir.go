@@ -0,0 +1,82 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/drone/go-scm/scm"
+)
+
+// getConfigDirData concats all config files in the config directory below
+// dir, e.g. .drone/build.yml and .drone/deploy.yml, sorted by name
+func (p *plugin) getConfigDirData(ctx context.Context, req *request, dir string) (configData string, err error) {
+	// the missing files cache is keyed like the listing of dir
+	configDir := path.Join("/", dir, p.configDir)
+	if req.missing.has(path.Join(dir, p.configDir)) {
+		req.Log.Debugf("missing files cache hit: %s", configDir)
+		return "", nil
+	}
+
+	var ls []*scm.ContentInfo
+	notFound := false
+	err = p.retry(ctx, req, "list "+configDir, func() (res *scm.Response, err error) {
+		ls, res, err = req.Client.Contents.List(ctx, p.configRepoFor(req), scmPath(configDir), p.configRefFor(req), scm.ListOptions{})
+		if res != nil && res.Status == http.StatusNotFound {
+			req.missing.add(path.Join(dir, p.configDir))
+			notFound = true
+		}
+		return res, err
+	})
+	if notFound {
+		return "", nil
+	}
+	if err != nil {
+		req.Log.Errorf("unable to list config directory %s: '%v'", configDir, err)
+		return "", err
+	}
+
+	files := []string{}
+	for _, f := range ls {
+		name := path.Base(f.Path)
+		if f.Kind == scm.ContentKindFile && p.configExtension(name) {
+			files = append(files, path.Join(configDir, name))
+		}
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		fileContent, critical, err := p.getScmDroneConfig(ctx, req, file)
+		if err != nil {
+			if critical {
+				return "", err
+			}
+			continue
+		}
+		configData = p.appendConfig(req, configData, fileContent, file)
+	}
+	return configData, nil
+}
+
+// configExtension reports if the extension of a file in the config directory
+// is one of the config extensions, e.g. to skip backups like build.yml.bak.
+// Starlark and jsonnet files also require their renderer to be enabled.
+func (p *plugin) configExtension(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	for _, allowed := range p.configExtensions {
+		if ext != allowed {
+			continue
+		}
+		switch {
+		case isStarlark(name):
+			return p.starlark
+		case isJsonnet(name):
+			return p.jsonnet
+		default:
+			return true
+		}
+	}
+	return false
+}
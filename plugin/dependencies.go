@@ -0,0 +1,48 @@
+package plugin
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v2"
+)
+
+// pipelineDependencies are the fields of a pipeline needed to resolve its
+// dependencies
+type pipelineDependencies struct {
+	Kind      string   `yaml:"kind"`
+	Name      string   `yaml:"name"`
+	DependsOn []string `yaml:"depends_on"`
+}
+
+// checkDependencies verifies that every depends_on of the concatenated
+// pipelines names a pipeline of the config, drone fails the build otherwise
+func (p *plugin) checkDependencies(req *request) error {
+	type dependency struct {
+		pipeline string
+		target   string
+		source   string
+	}
+	names := map[string]bool{}
+	dependencies := []dependency{}
+	for _, c := range req.configs {
+		for _, document := range splitDocuments(c.content) {
+			pd := pipelineDependencies{}
+			if err := yaml.Unmarshal([]byte(document), &pd); err != nil || pd.Kind != "pipeline" {
+				continue
+			}
+			names[pd.Name] = true
+			for _, target := range pd.DependsOn {
+				dependencies = append(dependencies, dependency{pd.Name, target, c.source})
+			}
+		}
+	}
+
+	for _, d := range dependencies {
+		if !names[d.target] {
+			err := fmt.Errorf("pipeline '%s' of %s depends on unknown pipeline '%s'", d.pipeline, d.source, d.target)
+			req.Log.Error(err)
+			return err
+		}
+	}
+	return nil
+}
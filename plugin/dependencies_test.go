@@ -0,0 +1,60 @@
+package plugin
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/config"
+)
+
+func TestCheckDependencies(t *testing.T) {
+	tests := []struct {
+		config string
+		err    string
+	}{
+		{"kind: pipeline\nname: integration\ndepends_on:\n- default\n", ""},
+		{"kind: pipeline\nname: integration\ndepends_on:\n- default\n---\nkind: pipeline\nname: deploy\ndepends_on:\n- integration\n", ""},
+		{"kind: pipeline\nname: integration\ndepends_on:\n- deploy\n", "pipeline 'integration' of /a/b/.drone.yml depends on unknown pipeline 'deploy'"},
+	}
+	for _, test := range tests {
+		mux := testMux()
+		ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/repos/foosinn/dronetest/contents/a/b/.drone.yml" {
+				content := base64.StdEncoding.EncodeToString([]byte(test.config))
+				_, _ = fmt.Fprintf(w, `{"type": "file", "path": "a/b/.drone.yml", "content": %q}`, content)
+				return
+			}
+			mux.ServeHTTP(w, r)
+		}))
+
+		req := &config.Request{
+			Build: drone.Build{
+				Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+				After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+			},
+			Repo: drone.Repo{
+				Namespace: "foosinn",
+				Name:      "dronetest",
+				Slug:      "foosinn/dronetest",
+				Config:    ".drone.yml",
+			},
+		}
+		plugin := New(
+			WithServer(ts.URL),
+			WithToken(mockToken),
+			WithConcat(true),
+		)
+		_, err := plugin.Find(noContext, req)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("Want no error for %q got %v", test.config, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("Want error %q for %q got %v", test.err, test.config, err)
+		}
+		ts.Close()
+	}
+}
@@ -0,0 +1,113 @@
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"path"
+	"strings"
+)
+
+// ignorePattern is a single pattern of a .droneignore file
+type ignorePattern struct {
+	segments []string
+	negate   bool
+	anchored bool
+}
+
+// droneignore is a parsed .droneignore file, it uses the gitignore syntax
+type droneignore []ignorePattern
+
+// ignore returns the patterns of the .droneignore file in the repository
+// root, they are read once per request. Errors are only returned in fail
+// closed mode.
+func (p *plugin) ignore(ctx context.Context, req *request) (droneignore, error) {
+	if req.droneignore != nil {
+		return req.droneignore, nil
+	}
+	content, err := p.getScmFile(ctx, req, "/.droneignore")
+	if err != nil {
+		if p.failsClosed(req, "/.droneignore", err) {
+			req.Log.Errorf("unable to load .droneignore, failing closed: %v", err)
+			return nil, err
+		}
+		req.Log.Debugf("no .droneignore: %v", err)
+		req.droneignore = droneignore{}
+		return req.droneignore, nil
+	}
+	req.droneignore = parseDroneignore(content)
+	return req.droneignore, nil
+}
+
+// parseDroneignore parses the patterns of a .droneignore file, blank lines
+// and comments are skipped
+func parseDroneignore(content string) droneignore {
+	patterns := droneignore{}
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pattern := ignorePattern{}
+		if strings.HasPrefix(line, "!") {
+			pattern.negate = true
+			line = line[1:]
+		}
+		line = strings.TrimSuffix(line, "/")
+		if strings.Contains(line, "/") {
+			pattern.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		pattern.segments = strings.Split(line, "/")
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
+// match reports if the directory is ignored, the last matching pattern wins
+func (d droneignore) match(dir string) bool {
+	dir = strings.Trim(path.Clean("/"+dir), "/")
+	if dir == "" {
+		return false
+	}
+	segments := strings.Split(dir, "/")
+	ignored := false
+	for _, pattern := range d {
+		var matched bool
+		if pattern.anchored {
+			matched = matchSegments(pattern.segments, segments)
+		} else {
+			matched = matchSegments(pattern.segments, segments[len(segments)-1:])
+		}
+		if matched {
+			ignored = !pattern.negate
+		}
+	}
+	return ignored
+}
+
+// matchSegments matches the path segments against the pattern segments, **
+// matches any number of segments
+func matchSegments(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], segments[1:])
+}
@@ -0,0 +1,89 @@
+package plugin
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/config"
+)
+
+func TestDroneignoreMatch(t *testing.T) {
+	ignore := parseDroneignore(`# dependencies
+vendor/
+node_modules
+/build
+docs/*/generated
+**/testdata
+!/lib/vendor
+`)
+	tests := []struct {
+		dir  string
+		want bool
+	}{
+		{"/vendor", true},
+		{"/lib/vendor", false},
+		{"/app/vendor", true},
+		{"/web/node_modules", true},
+		{"/build", true},
+		{"/app/build", false},
+		{"/docs/api/generated", true},
+		{"/docs/generated", false},
+		{"/testdata", true},
+		{"/a/b/testdata", true},
+		{"/src", false},
+		{"/", false},
+	}
+	for _, test := range tests {
+		if got := ignore.match(test.dir); test.want != got {
+			t.Errorf("%s: want %v got %v", test.dir, test.want, got)
+		}
+	}
+}
+
+func TestDroneignore(t *testing.T) {
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/repos/foosinn/dronetest/contents/.droneignore" {
+			content := base64.StdEncoding.EncodeToString([]byte("afolder/\n"))
+			_, _ = fmt.Fprintf(w, `{"type": "file", "path": ".droneignore", "content": %q}`, content)
+			return
+		}
+		if r.URL.Path == "/repos/foosinn/dronetest/contents/afolder" {
+			t.Errorf("ignored directory was listed")
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			After:   "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+			Trigger: "@cron",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithConcat(true),
+		WithFallback(true),
+		WithMaxDepth(2),
+	)
+	droneConfig, err := plugin.Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if want, got := "---\nkind: pipeline\nname: default\n\nsteps:\n- name: frontend\n  image: node\n  commands:\n  - npm install\n  - npm test\n\n- name: backend\n  image: golang\n  commands:\n  - go build\n  - go test\n", droneConfig.Data; want != got {
+		t.Errorf("Want %q got %q", want, got)
+	}
+}
@@ -0,0 +1,74 @@
+package plugin
+
+import (
+	"bytes"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// duplicateRenames returns the new names of the pipelines of a config file
+// that collide with a differing, already appended pipeline. The new name is
+// prefixed with the directory of the source, e.g. a/b/default.
+func (p *plugin) duplicateRenames(req *request, documents []string, source string) map[string]string {
+	renames := map[string]string{}
+	prefix := strings.Trim(path.Dir(source), "/")
+	if prefix == "" {
+		prefix = strings.Trim(source, "/")
+	}
+	for _, document := range documents {
+		dc := droneConfig{}
+		if err := yaml.Unmarshal([]byte(document), &dc); err != nil || dc.Kind != "pipeline" || dc.Name == "" {
+			continue
+		}
+		first, ok := req.names[dc.Kind+"/"+dc.Name]
+		if !ok || first.content == strings.TrimSpace(document) {
+			continue
+		}
+		renames[dc.Name] = prefix + "/" + dc.Name
+		req.Log.Warnf("pipeline '%s' of %s is already defined in %s, renaming it to '%s'", dc.Name, source, first.source, renames[dc.Name])
+	}
+	return renames
+}
+
+// renamePipelines replaces the names and the depends_on entries of a
+// document, documents that are not a pipeline or fail to parse are returned
+// unchanged
+func renamePipelines(document string, renames map[string]string) string {
+	var node yamlv3.Node
+	if err := yamlv3.Unmarshal([]byte(document), &node); err != nil || len(node.Content) == 0 {
+		return document
+	}
+	pipeline := node.Content[0]
+	if kind := mappingValue(pipeline, "kind"); kind == nil || kind.Value != "pipeline" {
+		return document
+	}
+
+	changed := false
+	if name := mappingValue(pipeline, "name"); name != nil && renames[name.Value] != "" {
+		name.Value = renames[name.Value]
+		changed = true
+	}
+	if dependsOn := mappingValue(pipeline, "depends_on"); dependsOn != nil && dependsOn.Kind == yamlv3.SequenceNode {
+		for _, target := range dependsOn.Content {
+			if renames[target.Value] != "" {
+				target.Value = renames[target.Value]
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return document
+	}
+
+	var buf bytes.Buffer
+	enc := yamlv3.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&node); err != nil {
+		return document
+	}
+	_ = enc.Close()
+	return buf.String()
+}
@@ -0,0 +1,87 @@
+package plugin
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/config"
+	"gopkg.in/yaml.v2"
+)
+
+func TestRenamePipelines(t *testing.T) {
+	renames := map[string]string{"default": "a/default"}
+	tests := []struct {
+		document string
+		want     string
+	}{
+		{"kind: pipeline\nname: default\n", "kind: pipeline\nname: a/default\n"},
+		{"kind: pipeline\nname: deploy\ndepends_on:\n- default\n- other\n", "kind: pipeline\nname: deploy\ndepends_on:\n  - a/default\n  - other\n"},
+		{"kind: pipeline\nname: other\n", "kind: pipeline\nname: other\n"},
+		{"kind: secret\nname: default\n", "kind: secret\nname: default\n"},
+		{"kind: [pipeline\n", "kind: [pipeline\n"},
+	}
+	for _, test := range tests {
+		if got := renamePipelines(test.document, renames); got != test.want {
+			t.Errorf("Want %q got %q", test.want, got)
+		}
+	}
+}
+
+func TestPrefixDuplicates(t *testing.T) {
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/repos/foosinn/dronetest/contents/afolder/.drone.yml" {
+			content := "kind: pipeline\nname: default\nsteps:\n- name: test\n  image: golang\n---\nkind: pipeline\nname: deploy\ndepends_on:\n- default\n"
+			fmt.Fprintf(w, `{"type": "file", "path": "afolder/.drone.yml", "content": %q}`, base64.StdEncoding.EncodeToString([]byte(content)))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			After:   "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+			Trigger: "@cron",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithConcat(true),
+		WithPrefixDuplicates(true),
+	)
+	droneConfig, err := plugin.Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	names := []string{}
+	dependsOn := map[string][]string{}
+	for _, document := range splitDocuments(droneConfig.Data) {
+		pd := pipelineDependencies{}
+		if err := yaml.Unmarshal([]byte(document), &pd); err != nil {
+			t.Error(err)
+			continue
+		}
+		names = append(names, pd.Name)
+		dependsOn[pd.Name] = pd.DependsOn
+	}
+	if want, got := []string{"default", "afolder/default", "deploy"}, names; !reflect.DeepEqual(want, got) {
+		t.Errorf("Want pipelines %v got %v", want, got)
+	}
+	if want, got := []string{"afolder/default"}, dependsOn["deploy"]; !reflect.DeepEqual(want, got) {
+		t.Errorf("Want deploy to depend on %v got %v", want, got)
+	}
+}
@@ -0,0 +1,49 @@
+package plugin
+
+import (
+	"strings"
+)
+
+// sources of the configs of pull requests from forks
+const (
+	// forkConfigsHead reads the configs from the fork at the head commit
+	forkConfigsHead = "head"
+	// forkConfigsBase reads the configs from the base repository at the
+	// target branch, changes of the fork to its configs are ignored
+	forkConfigsBase = "base"
+)
+
+// isForkPullRequest reports if the build is a pull request from another
+// repository, drone reports the source repository as fork
+func (p *plugin) isForkPullRequest(req *request) bool {
+	return strings.HasPrefix(req.Build.Ref, p.pullRequestRefPrefix()) &&
+		req.Build.Fork != "" &&
+		!strings.EqualFold(req.Build.Fork, req.Repo.Slug)
+}
+
+// useForkConfigs points the request at the repository and ref the configs of
+// a pull request from a fork are read from. By default they are read from the
+// base repository at the head commit, which github and gitlab serve for pull
+// requests. Trusted forks always use their own configs.
+func (p *plugin) useForkConfigs(req *request) {
+	if p.forkConfigs == "" || !p.isForkPullRequest(req) {
+		return
+	}
+	mode := p.forkConfigs
+	if p.trustedForks.match(req.Build.Fork) {
+		mode = forkConfigsHead
+	}
+
+	switch mode {
+	case forkConfigsHead:
+		req.Log.Infof("pull request from the fork %s, reading configs from the fork", req.Build.Fork)
+		req.repo = req.Build.Fork
+	case forkConfigsBase:
+		target := req.Build.Target
+		if target == "" {
+			target = req.Repo.Branch
+		}
+		req.Log.Infof("pull request from the untrusted fork %s, reading configs from %s", req.Build.Fork, target)
+		req.ref = target
+	}
+}
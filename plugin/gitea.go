@@ -0,0 +1,121 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/drone/go-scm/scm"
+)
+
+// The go-scm gitea driver does not list changed files, they are read from the
+// gitea api instead:
+//
+//   - Pushes compare the before and after commit, the changes of all commits
+//     in between are listed. Requires gitea 1.22 or newer.
+//   - Builds without a before commit list the changes of the after commit.
+//   - Pull requests list the changed files of the pull request, renamed files
+//     are reported with their old path as deleted like for gitlab.
+
+// giteaCommit is a commit of the gitea api with the files it changed
+type giteaCommit struct {
+	Files []struct {
+		Filename string `json:"filename"`
+		Status   string `json:"status"`
+	} `json:"files"`
+}
+
+// giteaGit lists changed files with the commit and compare endpoints
+type giteaGit struct {
+	scm.GitService
+	client *scm.Client
+}
+
+func (s *giteaGit) ListChanges(ctx context.Context, repo, ref string, opts scm.ListOptions) ([]*scm.Change, *scm.Response, error) {
+	commit := giteaCommit{}
+	res, err := giteaDo(ctx, s.client, fmt.Sprintf("api/v1/repos/%s/git/commits/%s", repo, url.PathEscape(ref)), &commit)
+	if err != nil {
+		return nil, res, err
+	}
+	return convertGiteaCommits([]giteaCommit{commit}), res, nil
+}
+
+func (s *giteaGit) CompareChanges(ctx context.Context, repo, source, target string, opts scm.ListOptions) ([]*scm.Change, *scm.Response, error) {
+	compare := struct {
+		Commits []giteaCommit `json:"commits"`
+	}{}
+	res, err := giteaDo(ctx, s.client, fmt.Sprintf("api/v1/repos/%s/compare/%s...%s", repo, url.PathEscape(source), url.PathEscape(target)), &compare)
+	if err != nil {
+		return nil, res, err
+	}
+	return convertGiteaCommits(compare.Commits), res, nil
+}
+
+// convertGiteaCommits returns the files changed by the commits, each file is
+// listed once with its last status
+func convertGiteaCommits(commits []giteaCommit) []*scm.Change {
+	changes := []*scm.Change{}
+	index := map[string]*scm.Change{}
+	for _, commit := range commits {
+		for _, f := range commit.Files {
+			change, ok := index[f.Filename]
+			if !ok {
+				change = &scm.Change{Path: f.Filename}
+				index[f.Filename] = change
+				changes = append(changes, change)
+			}
+			change.Added = f.Status == "added"
+			change.Deleted = f.Status == "removed" || f.Status == "deleted"
+		}
+	}
+	return changes
+}
+
+// giteaPullRequests lists the changed files of pull requests
+type giteaPullRequests struct {
+	scm.PullRequestService
+	client *scm.Client
+}
+
+func (s *giteaPullRequests) ListChanges(ctx context.Context, repo string, number int, opts scm.ListOptions) ([]*scm.Change, *scm.Response, error) {
+	files := []struct {
+		Filename         string `json:"filename"`
+		PreviousFilename string `json:"previous_filename"`
+		Status           string `json:"status"`
+	}{}
+	endpoint := fmt.Sprintf("api/v1/repos/%s/pulls/%d/files?page=%d&limit=%d", repo, number, opts.Page, opts.Size)
+	res, err := giteaDo(ctx, s.client, endpoint, &files)
+	if err != nil {
+		return nil, res, err
+	}
+
+	changes := []*scm.Change{}
+	for _, f := range files {
+		changes = append(changes, &scm.Change{
+			Path:    f.Filename,
+			Added:   f.Status == "added",
+			Renamed: f.Status == "renamed",
+			Deleted: f.Status == "deleted",
+		})
+		if f.Status == "renamed" && f.PreviousFilename != "" && f.PreviousFilename != f.Filename {
+			changes = append(changes, &scm.Change{Path: f.PreviousFilename, Deleted: true})
+		}
+	}
+	return changes, res, nil
+}
+
+// giteaDo requests a json endpoint of the gitea api, the next page is taken
+// from the link header of the response
+func giteaDo(ctx context.Context, client *scm.Client, endpoint string, out interface{}) (*scm.Response, error) {
+	res, err := client.Do(ctx, &scm.Request{Method: http.MethodGet, Path: endpoint})
+	if err != nil {
+		return res, err
+	}
+	defer res.Body.Close()
+	if res.Status != http.StatusOK {
+		return res, fmt.Errorf("unexpected status %d", res.Status)
+	}
+	return res, json.NewDecoder(res.Body).Decode(out)
+}
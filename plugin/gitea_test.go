@@ -0,0 +1,99 @@
+package plugin
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/config"
+)
+
+func TestGitea(t *testing.T) {
+	const (
+		before = "2897b31ec3a1b59279a08a8ad54dc360686327f7"
+		after  = "8ecad91991d5da985a2a8dd97cc19029dc1c2899"
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case "/api/v1/repos/foosinn/dronetest/compare/" + before + "..." + after:
+			_, _ = io.WriteString(w, `{"total_commits": 2, "commits": [
+				{"files": [{"filename": "a b/c/file", "status": "added"}]},
+				{"files": [{"filename": "a b/c/file", "status": "modified"}, {"filename": "d/file", "status": "removed"}]}
+			]}`)
+		case "/api/v1/repos/foosinn/dronetest/git/commits/" + after:
+			_, _ = io.WriteString(w, `{"files": [{"filename": "d/file", "status": "modified"}]}`)
+		case "/api/v1/repos/foosinn/dronetest/pulls/7/files":
+			if r.URL.Query().Get("page") == "2" {
+				_, _ = io.WriteString(w, `[{"filename": "e/file", "previous_filename": "a b/file", "status": "renamed"}]`)
+				return
+			}
+			w.Header().Set("Link", fmt.Sprintf(`<%s/api/v1/repos/foosinn/dronetest/pulls/7/files?page=2&limit=100>; rel="next"`, "http://"+r.Host))
+			_, _ = io.WriteString(w, `[{"filename": "d/file", "status": "changed"}]`)
+		case "/api/v1/repos/foosinn/dronetest/contents/":
+			_, _ = io.WriteString(w, `[{"path": "a b", "type": "dir"}, {"path": "d", "type": "dir"}, {"path": "e", "type": "dir"}]`)
+		case "/api/v1/repos/foosinn/dronetest/contents/a%20b":
+			_, _ = io.WriteString(w, `[{"path": "a b/.drone.yml", "type": "file"}, {"path": "a b/c", "type": "dir"}]`)
+		case "/api/v1/repos/foosinn/dronetest/contents/a%20b/c":
+			_, _ = io.WriteString(w, `[{"path": "a b/c/file", "type": "file"}]`)
+		case "/api/v1/repos/foosinn/dronetest/contents/d":
+			_, _ = io.WriteString(w, `[{"path": "d/.drone.yml", "type": "file"}]`)
+		case "/api/v1/repos/foosinn/dronetest/contents/e":
+			_, _ = io.WriteString(w, `[{"path": "e/file", "type": "file"}]`)
+		case "/api/v1/repos/foosinn/dronetest/raw/" + after + "/a%20b/.drone.yml":
+			// the leading slash of the path is trimmed, spaces are escaped
+			_, _ = io.WriteString(w, "kind: pipeline\nname: a-b\n")
+		case "/api/v1/repos/foosinn/dronetest/raw/" + after + "/d/.drone.yml":
+			_, _ = io.WriteString(w, "kind: pipeline\nname: d\n")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name   string
+		before string
+		ref    string
+		want   string
+	}{
+		{"push", before, "refs/heads/master", "---\nkind: pipeline\nname: a-b\n---\nkind: pipeline\nname: d\n"},
+		{"new branch", "", "refs/heads/feature", "---\nkind: pipeline\nname: d\n"},
+		{"pull request", before, "refs/pull/7/head", "---\nkind: pipeline\nname: d\n---\nkind: pipeline\nname: a-b\n"},
+	}
+	for _, test := range tests {
+		req := &config.Request{
+			Build: drone.Build{
+				Before: test.before,
+				After:  after,
+				Ref:    test.ref,
+			},
+			Repo: drone.Repo{
+				Namespace: "foosinn",
+				Name:      "dronetest",
+				Slug:      "foosinn/dronetest",
+				Config:    ".drone.yml",
+			},
+		}
+		plugin := New(
+			WithProvider(providerGitea),
+			WithServer(ts.URL),
+			WithToken(mockToken),
+			WithConcat(true),
+		)
+		droneConfig, err := plugin.Find(noContext, req)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if droneConfig == nil {
+			t.Errorf("%s: want a config got none", test.name)
+			continue
+		}
+		if want, got := test.want, droneConfig.Data; want != got {
+			t.Errorf("%s: want %q got %q", test.name, want, got)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package plugin
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// githubAPI is the api url used if no scm server is configured
+	githubAPI = "https://api.github.com"
+
+	// githubAppTokenRefresh is the remaining lifetime at which installation
+	// tokens are renewed
+	githubAppTokenRefresh = 5 * time.Minute
+)
+
+type (
+	// githubApp mints and caches installation tokens for a github app
+	githubApp struct {
+		id           int64
+		installation int64
+		key          *rsa.PrivateKey
+
+		// mu guards the maps, minting serializes the token requests of an
+		// installation so concurrent requests share a token
+		mu            sync.Mutex
+		installations map[string]int64
+		tokens        map[int64]installationToken
+		minting       map[int64]*sync.Mutex
+	}
+
+	installationToken struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+)
+
+// ParseGithubAppKey parses the PEM encoded private key of a github app
+func ParseGithubAppKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("github app private key is not PEM encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("github app private key is not a RSA key")
+	}
+	return rsaKey, nil
+}
+
+// scmToken returns the token used for requests to the repository, this is
+// an installation token if a github app is configured. A token configured for
+// the namespace of the repository takes precedence, multiple static tokens are
+// used round robin to spread the rate limit.
+func (p *plugin) scmToken(ctx context.Context, slug string) (string, error) {
+	if token, ok := p.namespaceTokens[strings.ToLower(path.Dir(slug))]; ok {
+		return token, nil
+	}
+	if p.githubApp != nil {
+		return p.githubApp.token(ctx, p, slug)
+	}
+	if len(p.tokens) > 0 {
+		next := atomic.AddUint32(&p.nextToken, 1) - 1
+		return p.tokens[next%uint32(len(p.tokens))], nil
+	}
+	return p.token, nil
+}
+
+// githubAPI returns the github api url without trailing slash
+func (p *plugin) githubAPI() (string, error) {
+	if p.server == "" {
+		return githubAPI, nil
+	}
+	return githubServer(p.server)
+}
+
+// token returns a cached installation token for the repository or mints a
+// new one if it is about to expire
+func (a *githubApp) token(ctx context.Context, p *plugin, slug string) (string, error) {
+	installation, err := a.installationID(ctx, p, slug)
+	if err != nil {
+		return "", err
+	}
+
+	// requests waiting for a token minted meanwhile find it in the cache
+	lock := a.mintingLock(installation)
+	lock.Lock()
+	defer lock.Unlock()
+	if token, ok := a.cachedToken(installation); ok {
+		return token, nil
+	}
+
+	api, err := p.githubAPI()
+	if err != nil {
+		return "", err
+	}
+	var token installationToken
+	url := fmt.Sprintf("%s/app/installations/%d/access_tokens", api, installation)
+	if err := a.do(ctx, p, http.MethodPost, url, &token); err != nil {
+		return "", err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.tokens[installation] = token
+	return token.Token, nil
+}
+
+// cachedToken returns the token of the installation unless it is about to
+// expire
+func (a *githubApp) cachedToken(installation int64) (string, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	token, ok := a.tokens[installation]
+	if !ok || time.Until(token.ExpiresAt) <= githubAppTokenRefresh {
+		return "", false
+	}
+	return token.Token, true
+}
+
+// mintingLock returns the lock serializing the token requests of an
+// installation
+func (a *githubApp) mintingLock(installation int64) *sync.Mutex {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	lock, ok := a.minting[installation]
+	if !ok {
+		lock = &sync.Mutex{}
+		a.minting[installation] = lock
+	}
+	return lock
+}
+
+// installationID returns the configured installation or looks up the
+// installation of the repository
+func (a *githubApp) installationID(ctx context.Context, p *plugin, slug string) (int64, error) {
+	if a.installation != 0 {
+		return a.installation, nil
+	}
+	a.mu.Lock()
+	installation, ok := a.installations[slug]
+	a.mu.Unlock()
+	if ok {
+		return installation, nil
+	}
+
+	var res struct {
+		ID int64 `json:"id"`
+	}
+	api, err := p.githubAPI()
+	if err != nil {
+		return 0, err
+	}
+	url := fmt.Sprintf("%s/repos/%s/installation", api, slug)
+	if err := a.do(ctx, p, http.MethodGet, url, &res); err != nil {
+		return 0, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.installations[slug] = res.ID
+	return res.ID, nil
+}
+
+// check verifies that the app is able to authenticate
+func (a *githubApp) check(ctx context.Context, p *plugin) error {
+	api, err := p.githubAPI()
+	if err != nil {
+		return err
+	}
+	return a.do(ctx, p, http.MethodGet, api+"/app", nil)
+}
+
+// do sends a request authenticated as the app and decodes the response
+func (a *githubApp) do(ctx context.Context, p *plugin, method, url string, out interface{}) error {
+	jwt, err := a.jwt(time.Now())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+
+	client := &http.Client{Transport: p.transport(), Timeout: p.scmTimeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("github app request %s %s failed with status %d", method, url, res.StatusCode)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// jwt creates the token used to authenticate as the app
+func (a *githubApp) jwt(now time.Time) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		// allow for some clock drift
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": strconv.FormatInt(a.id, 10),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	hash := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
@@ -0,0 +1,187 @@
+package plugin
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/config"
+)
+
+func TestGithubApp(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if key, err = ParseGithubAppKey(keyPEM); err != nil {
+		t.Fatal(err)
+	}
+
+	const installationToken = "v1.1f699f1069f60xxx"
+	var minted int32
+	repo := testMux()
+	app := http.NewServeMux()
+	app.HandleFunc("/repos/foosinn/dronetest/installation", func(w http.ResponseWriter, r *http.Request) {
+		if strings.Count(r.Header.Get("Authorization"), ".") != 2 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = io.WriteString(w, `{"id": 1}`)
+	})
+	app.HandleFunc("/app/installations/1/access_tokens", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || strings.Count(r.Header.Get("Authorization"), ".") != 2 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		atomic.AddInt32(&minted, 1)
+		expires := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+		_, _ = io.WriteString(w, `{"token": "`+installationToken+`", "expires_at": "`+expires+`"}`)
+	})
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/installation") || strings.HasPrefix(r.URL.Path, "/app/") {
+			app.ServeHTTP(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer "+installationToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = io.WriteString(w, `{"message": "Bad credentials"}`)
+			return
+		}
+		repo.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithGithubApp(42, 0, key),
+	)
+	for i := 0; i < 2; i++ {
+		droneConfig, err := plugin.Find(noContext, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, got := "---\nkind: pipeline\nname: default\n\nsteps:\n- name: build\n  image: golang\n  commands:\n  - go build\n  - go test -short\n\n- name: integration\n  image: golang\n  commands:\n  - go test -v\n", droneConfig.Data; want != got {
+			t.Errorf("Want %q got %q", want, got)
+		}
+	}
+
+	if want, got := int32(1), atomic.LoadInt32(&minted); want != got {
+		t.Errorf("Want %d minted installation tokens got %d", want, got)
+	}
+}
+
+func TestGithubAppTokenRefresh(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var minted int32
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/app/installations/1/access_tokens" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		n := atomic.AddInt32(&minted, 1)
+		// slow enough for the concurrent requests to pile up
+		time.Sleep(20 * time.Millisecond)
+		expires := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+		fmt.Fprintf(w, `{"token": "token-%d", "expires_at": "%s"}`, n, expires)
+	}))
+	defer ts.Close()
+
+	p := New(
+		WithServer(ts.URL),
+		WithGithubApp(42, 1, key),
+	).(*plugin)
+
+	tokens := func() map[string]int {
+		results := make(chan string, 20)
+		wg := sync.WaitGroup{}
+		for i := 0; i < cap(results); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				token, err := p.scmToken(noContext, "foosinn/dronetest")
+				if err != nil {
+					t.Error(err)
+				}
+				results <- token
+			}()
+		}
+		wg.Wait()
+		close(results)
+		seen := map[string]int{}
+		for token := range results {
+			seen[token]++
+		}
+		return seen
+	}
+
+	if want, got := map[string]int{"token-1": 20}, tokens(); !reflect.DeepEqual(want, got) {
+		t.Errorf("Want %v got %v", want, got)
+	}
+
+	// let the token expire, a single new token is minted
+	p.githubApp.mu.Lock()
+	token := p.githubApp.tokens[1]
+	token.ExpiresAt = time.Now().Add(githubAppTokenRefresh / 2)
+	p.githubApp.tokens[1] = token
+	p.githubApp.mu.Unlock()
+
+	if want, got := map[string]int{"token-2": 20}, tokens(); !reflect.DeepEqual(want, got) {
+		t.Errorf("Want %v got %v", want, got)
+	}
+	if want, got := int32(2), atomic.LoadInt32(&minted); want != got {
+		t.Errorf("Want %d minted installation tokens got %d", want, got)
+	}
+}
+
+func TestNamespaceTokens(t *testing.T) {
+	p := New(
+		WithToken("default"),
+		WithNamespaceTokens(map[string]string{"orgA": "token-a", "group/sub": "token-sub"}),
+	).(*plugin)
+
+	for slug, want := range map[string]string{
+		"orgA/repo":         "token-a",
+		"orga/repo":         "token-a",
+		"orgB/repo":         "default",
+		"group/sub/repo":    "token-sub",
+		"group/repo":        "default",
+		"foosinn/dronetest": "default",
+	} {
+		got, err := p.scmToken(noContext, slug)
+		if err != nil {
+			t.Errorf("%s: %v", slug, err)
+			continue
+		}
+		if want != got {
+			t.Errorf("%s: want token %q got %q", slug, want, got)
+		}
+	}
+}
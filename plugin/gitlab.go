@@ -0,0 +1,65 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/drone/go-scm/scm"
+)
+
+// gitlabMergeRequestChanges is the response of the merge request changes
+// endpoint, overflow is set if gitlab truncated the list
+type gitlabMergeRequestChanges struct {
+	Changes []struct {
+		OldPath     string `json:"old_path"`
+		NewPath     string `json:"new_path"`
+		NewFile     bool   `json:"new_file"`
+		RenamedFile bool   `json:"renamed_file"`
+		DeletedFile bool   `json:"deleted_file"`
+	} `json:"changes"`
+	Overflow bool `json:"overflow"`
+}
+
+// getGitlabMergeRequestChanges lists the changed files of a merge request
+// using the merge request changes endpoint. It returns all changes in a
+// single response. Renamed files are reported with their new path and, as
+// deleted, with their old path, so the directories of both are searched.
+func (p *plugin) getGitlabMergeRequestChanges(ctx context.Context, req *request, iid int) ([]*scm.Change, error) {
+	endpoint := fmt.Sprintf("api/v4/projects/%s/merge_requests/%d/changes", strings.Replace(req.Repo.Slug, "/", "%2F", -1), iid)
+	result := gitlabMergeRequestChanges{}
+	err := p.retry(ctx, req, "list merge request changes", func() (*scm.Response, error) {
+		res, err := req.Client.Do(ctx, &scm.Request{Method: http.MethodGet, Path: endpoint})
+		if err != nil {
+			return res, err
+		}
+		defer res.Body.Close()
+		if res.Status != http.StatusOK {
+			return res, fmt.Errorf("unexpected status %d", res.Status)
+		}
+		result = gitlabMergeRequestChanges{}
+		return res, json.NewDecoder(res.Body).Decode(&result)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result.Overflow {
+		req.Log.Warnf("merge request !%d has more changes than gitlab lists, configs of the missing files are not found", iid)
+	}
+
+	changes := []*scm.Change{}
+	for _, c := range result.Changes {
+		changes = append(changes, &scm.Change{
+			Path:    c.NewPath,
+			Added:   c.NewFile,
+			Renamed: c.RenamedFile,
+			Deleted: c.DeletedFile,
+		})
+		if c.RenamedFile && c.OldPath != "" && c.OldPath != c.NewPath {
+			changes = append(changes, &scm.Change{Path: c.OldPath, Deleted: true})
+		}
+	}
+	return changes, nil
+}
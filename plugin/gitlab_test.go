@@ -0,0 +1,136 @@
+package plugin
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/config"
+	"github.com/drone/go-scm/scm"
+	"github.com/sirupsen/logrus"
+)
+
+func TestGitlabMergeRequestChanges(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.EscapedPath() != "/api/v4/projects/foosinn%2Fdronetest/merge_requests/3/changes" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, `{"changes": [
+			{"old_path": "a/file", "new_path": "a/file"},
+			{"old_path": "", "new_path": "b/file", "new_file": true},
+			{"old_path": "c/file", "new_path": "d/file", "renamed_file": true},
+			{"old_path": "e/file", "new_path": "e/file", "deleted_file": true}
+		]}`)
+	}))
+	defer ts.Close()
+
+	p := New(WithProvider(providerGitlab), WithServer(ts.URL), WithToken(mockToken)).(*plugin)
+	client, err := p.newClient(p.token, "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	req := &request{
+		Log: logrus.NewEntry(logrus.StandardLogger()),
+		Request: &config.Request{
+			Build: drone.Build{Ref: "refs/merge-requests/3/head"},
+			Repo:  drone.Repo{Slug: "foosinn/dronetest"},
+		},
+		Client: client,
+	}
+
+	changes, err := p.getGitlabMergeRequestChanges(noContext, req, 3)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	want := []*scm.Change{
+		{Path: "a/file"},
+		{Path: "b/file", Added: true},
+		{Path: "d/file", Renamed: true},
+		{Path: "c/file", Deleted: true},
+		{Path: "e/file", Deleted: true},
+	}
+	if !reflect.DeepEqual(want, changes) {
+		t.Errorf("Want %v got %v", want, changes)
+	}
+
+	if _, err := p.getGitlabMergeRequestChanges(noContext, req, 4); err == nil {
+		t.Error("Want an error for a missing merge request")
+	}
+}
+
+func TestGitlabMergeRequestFind(t *testing.T) {
+	const after = "8ecad91991d5da985a2a8dd97cc19029dc1c2899"
+	trees := map[string]string{
+		"":    `[{"path": ".drone.yml", "mode": "100644"}, {"path": "a", "mode": "040000"}, {"path": "c", "mode": "040000"}]`,
+		"a":   `[{"path": "a/b", "mode": "040000"}]`,
+		"a/b": `[{"path": "a/b/.drone.yml", "mode": "100644"}, {"path": "a/b/file", "mode": "100644"}]`,
+		"c":   `[{"path": "c/.drone.yml", "mode": "100644"}]`,
+	}
+	files := map[string]string{
+		"%2Edrone%2Eyml":         "kind: pipeline\nname: root\n",
+		"a%2Fb%2F%2Edrone%2Eyml": "kind: pipeline\nname: a-b\n",
+		"c%2F%2Edrone%2Eyml":     "kind: pipeline\nname: c\n",
+	}
+	const project = "/api/v4/projects/foosinn%2Fdronetest/"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file := strings.TrimPrefix(r.URL.EscapedPath(), project+"repository/files/")
+		switch {
+		case r.URL.EscapedPath() == project+"merge_requests/3/changes":
+			// the old directory of the renamed file is searched as well
+			fmt.Fprint(w, `{"changes": [
+				{"old_path": "a/b/file", "new_path": "a/b/file"},
+				{"old_path": "c/file", "new_path": "d/file", "renamed_file": true}
+			]}`)
+		case r.URL.EscapedPath() == project+"repository/tree" && r.URL.Query().Get("ref") == after:
+			if tree, ok := trees[r.URL.Query().Get("path")]; ok {
+				fmt.Fprint(w, tree)
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+		case files[file] != "" && r.URL.Query().Get("ref") == after:
+			fmt.Fprintf(w, `{"file_path": %q, "content": %q}`, file, base64.StdEncoding.EncodeToString([]byte(files[file])))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  after,
+			Ref:    "refs/merge-requests/3/head",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithProvider(providerGitlab),
+		WithServer(ts.URL),
+		WithToken(mockToken),
+	)
+	droneConfig, err := plugin.Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if droneConfig == nil {
+		t.Error("Want a config got none")
+		return
+	}
+	if want, got := "---\nkind: pipeline\nname: a-b\n---\nkind: pipeline\nname: root\n---\nkind: pipeline\nname: c\n", droneConfig.Data; want != got {
+		t.Errorf("Want %q got %q", want, got)
+	}
+}
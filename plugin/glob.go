@@ -0,0 +1,57 @@
+package plugin
+
+import (
+	"regexp"
+	"strings"
+)
+
+// globs is a list of compiled glob patterns
+type globs []*regexp.Regexp
+
+// compileGlobs compiles glob patterns, `*` and `?` match within a single path
+// segment while `**` matches across segments
+func compileGlobs(patterns []string) globs {
+	compiled := globs{}
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		compiled = append(compiled, compileGlob(pattern))
+	}
+	return compiled
+}
+
+// compileGlob converts a glob pattern to an anchored regular expression
+func compileGlob(pattern string) *regexp.Regexp {
+	expr := strings.Builder{}
+	expr.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			expr.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.MustCompile(expr.String())
+}
+
+// match reports if any of the patterns matches s
+func (g globs) match(s string) bool {
+	for _, re := range g {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
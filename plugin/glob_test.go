@@ -0,0 +1,26 @@
+package plugin
+
+import "testing"
+
+func TestGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		match   bool
+	}{
+		{"*.md", "README.md", true},
+		{"*.md", "docs/README.md", false},
+		{"**/*.md", "README.md", true},
+		{"**/*.md", "docs/api/README.md", true},
+		{"docs/**", "docs/api/README.md", true},
+		{"docs/**", "src/main.go", false},
+		{"a/?/c", "a/b/c", true},
+		{"a/?/c", "a/bb/c", false},
+		{"a.b", "axb", false},
+	}
+	for _, test := range tests {
+		if got := compileGlobs([]string{test.pattern}).match(test.path); got != test.match {
+			t.Errorf("%s on %s: want %v got %v", test.pattern, test.path, test.match, got)
+		}
+	}
+}
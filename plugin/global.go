@@ -0,0 +1,24 @@
+package plugin
+
+// sources of the operator provided configs
+const (
+	sourceGlobalPrepend = "PLUGIN_GLOBAL_PREPEND"
+	sourceGlobalAppend  = "PLUGIN_GLOBAL_APPEND"
+)
+
+// addGlobalConfigs concats the global configs around the repository configs,
+// they are recorded as sources to be covered by the anchor and dependency
+// checks
+func (p *plugin) addGlobalConfigs(req *request, configData string) string {
+	if p.globalPrepend != "" {
+		configData = p.droneConfigAppend(p.globalPrepend, configData)
+		req.sources = append([]string{sourceGlobalPrepend}, req.sources...)
+		req.configs = append([]appendedDocument{{sourceGlobalPrepend, p.globalPrepend}}, req.configs...)
+	}
+	if p.globalAppend != "" {
+		configData = p.droneConfigAppend(configData, p.globalAppend)
+		req.sources = append(req.sources, sourceGlobalAppend)
+		req.configs = append(req.configs, appendedDocument{sourceGlobalAppend, p.globalAppend})
+	}
+	return configData
+}
@@ -0,0 +1,44 @@
+package plugin
+
+import (
+	"context"
+	"sort"
+)
+
+// Checker is implemented by plugins that can verify their scm connection
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// Check verifies that the scm is reachable and accepts the configured token
+func (p *plugin) Check(ctx context.Context) error {
+	if p.githubApp != nil {
+		return p.githubApp.check(ctx, p)
+	}
+	client, err := p.scmClient(p.probeToken(), "")
+	if err != nil {
+		return err
+	}
+	_, _, err = client.Users.Find(ctx)
+	return err
+}
+
+// probeToken returns the token used for the check, the single token, the
+// first of multiple tokens or a namespace token, whichever is configured
+func (p *plugin) probeToken() string {
+	if p.token != "" {
+		return p.token
+	}
+	if len(p.tokens) > 0 {
+		return p.tokens[0]
+	}
+	namespaces := make([]string, 0, len(p.namespaceTokens))
+	for namespace := range p.namespaceTokens {
+		namespaces = append(namespaces, namespace)
+	}
+	if len(namespaces) == 0 {
+		return ""
+	}
+	sort.Strings(namespaces)
+	return p.namespaceTokens[namespaces[0]]
+}
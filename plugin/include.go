@@ -0,0 +1,132 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/drone/go-scm/scm"
+)
+
+// maxIncludeDepth limits nested includes, it stops include cycles as well
+const maxIncludeDepth = 5
+
+// includePattern matches a line including another file, e.g.
+// "# include: ci/steps.yml"
+var includePattern = regexp.MustCompile(`^(\s*)#\s*include:\s*(\S+)\s*$`)
+
+// includeRepoPattern matches a line including a file of another repository,
+// e.g. "# include-repo: org/drone-shared ci/steps.yml @main", the ref is
+// optional
+var includeRepoPattern = regexp.MustCompile(`^(\s*)#\s*include-repo:\s*(\S+)\s+(\S+)(?:\s+@(\S+))?\s*$`)
+
+var (
+	errIncludeDepth = errors.New("includes are nested too deep")
+	errIncludeRepo  = errors.New("repository is not allowed for includes")
+)
+
+// includeSource is the repository and ref included files are read from, the
+// zero value reads them from the configs of the request
+type includeSource struct {
+	repo string
+	ref  string
+}
+
+// name returns file prefixed with the repository and suffixed with the ref
+// of the source, e.g. org/drone-shared/ci/steps.yml@main
+func (s includeSource) name(file string) string {
+	if s.repo == "" {
+		return file
+	}
+	if s.ref == "" {
+		return s.repo + file
+	}
+	return s.repo + file + "@" + s.ref
+}
+
+// resolveIncludes replaces every include directive with the content of the
+// included file from the same ref, paths are relative to the repository root.
+// The included lines get the indentation of the directive. Files of other
+// repositories are included from the allowed repositories only, includes in
+// them are read from the same repository.
+func (p *plugin) resolveIncludes(ctx context.Context, req *request, source includeSource, file, content string, depth int) (string, error) {
+	resolved := strings.Builder{}
+	for _, line := range strings.SplitAfter(content, "\n") {
+		trimmed := strings.TrimRight(line, "\r\n")
+		indent, included, includedSource := "", "", source
+		if match := includePattern.FindStringSubmatch(trimmed); match != nil {
+			indent, included = match[1], path.Join("/", match[2])
+		} else if match := includeRepoPattern.FindStringSubmatch(trimmed); match != nil {
+			indent, included = match[1], path.Join("/", match[3])
+			includedSource = includeSource{repo: match[2], ref: match[4]}
+		} else {
+			resolved.WriteString(line)
+			continue
+		}
+		if depth >= maxIncludeDepth {
+			req.Log.Errorf("unable to include %s in %s: more than %d nested includes", includedSource.name(included), source.name(file), maxIncludeDepth)
+			return "", errIncludeDepth
+		}
+
+		data, err := p.getIncludedFile(ctx, req, includedSource, included)
+		if err != nil {
+			req.Log.Errorf("unable to include %s in %s: %v", includedSource.name(included), source.name(file), err)
+			return "", err
+		}
+		data, err = p.resolveIncludes(ctx, req, includedSource, included, data, depth+1)
+		if err != nil {
+			return "", err
+		}
+		req.Log.Debugf("included %s in %s", includedSource.name(included), source.name(file))
+
+		for _, includedLine := range strings.SplitAfter(data, "\n") {
+			if strings.TrimSpace(includedLine) != "" {
+				resolved.WriteString(indent)
+			}
+			resolved.WriteString(includedLine)
+		}
+		if data != "" && !strings.HasSuffix(data, "\n") {
+			resolved.WriteString("\n")
+		}
+	}
+	return resolved.String(), nil
+}
+
+// getIncludedFile downloads an included file, files of other repositories
+// are requested with the token of the request repository
+func (p *plugin) getIncludedFile(ctx context.Context, req *request, source includeSource, file string) (string, error) {
+	if source.repo == "" {
+		return p.getScmFile(ctx, req, file)
+	}
+	if !p.includeRepos.match(source.repo) {
+		return "", errIncludeRepo
+	}
+
+	var data *scm.Content
+	contentCtx := p.limitContent(ctx)
+	err := p.retry(ctx, req, "get "+source.name(file), func() (res *scm.Response, err error) {
+		data, res, err = req.Client.Contents.Find(contentCtx, source.repo, scmPath(file), source.ref)
+		return res, err
+	})
+	if se, ok := err.(*statusError); ok {
+		switch se.status {
+		case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+			// github answers not found for private repositories as well
+			return "", fmt.Errorf("%s is missing or the token has no access to %s: %v", file, source.repo, err)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	if data == nil {
+		return "", fmt.Errorf("failed to get %s: is not a file", source.name(file))
+	}
+	if p.maxFileSize > 0 && len(data.Data) > p.maxFileSize {
+		return "", errFileTooLarge
+	}
+	return normalizeContent(data.Data), nil
+}
@@ -0,0 +1,158 @@
+package plugin
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/config"
+)
+
+func TestIncludes(t *testing.T) {
+	files := map[string]string{
+		"a/b/.drone.yml":    "kind: pipeline\nname: default\n\nsteps:\n  # include: ci/steps.yml\n",
+		"ci/steps.yml":      "- name: build\n  image: golang\n  # include: /ci/commands.yml\n\n- name: lint\n  image: golang\n",
+		"ci/commands.yml":   "commands:\n- go build",
+		"loop/.drone.yml":   "kind: pipeline\nname: loop\n# include: loop/.drone.yml\n",
+		"broken/.drone.yml": "kind: pipeline\nname: broken\n# include: ci/missing.yml\n",
+	}
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for file, content := range files {
+			if r.URL.Path == "/repos/foosinn/dronetest/contents/"+file {
+				_, _ = fmt.Fprintf(w, `{"type": "file", "path": %q, "content": %q}`, file, base64.StdEncoding.EncodeToString([]byte(content)))
+				return
+			}
+		}
+		if r.URL.Path == "/repos/foosinn/dronetest/contents/ci/missing.yml" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		changed string
+		want    string
+		err     bool
+	}{
+		{
+			changed: "a/b/file",
+			want:    "---\nkind: pipeline\nname: default\n\nsteps:\n  - name: build\n    image: golang\n    commands:\n    - go build\n\n  - name: lint\n    image: golang\n",
+		},
+		{changed: "loop/file", err: true},
+		{changed: "broken/file", err: true},
+	}
+	for _, test := range tests {
+		req := &config.Request{
+			Build: drone.Build{
+				After: "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+			},
+			Repo: drone.Repo{
+				Namespace: "foosinn",
+				Name:      "dronetest",
+				Slug:      "foosinn/dronetest",
+				Config:    ".drone.yml",
+			},
+		}
+		plugin := New(
+			WithServer(ts.URL),
+			WithToken(mockToken),
+			WithUpMaxDepth(1),
+			WithIncludes(true),
+		)
+		droneConfig, err := plugin.(Validator).Validate(noContext, req, []string{test.changed})
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: want an error", test.changed)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.changed, err)
+			continue
+		}
+		if want, got := test.want, droneConfig.Data; want != got {
+			t.Errorf("%s: want %q got %q", test.changed, want, got)
+		}
+	}
+}
+
+func TestIncludeRepos(t *testing.T) {
+	files := map[string]string{
+		"foosinn/dronetest/a/.drone.yml":        "kind: pipeline\nname: default\n\nsteps:\n  # include-repo: org/drone-shared ci/steps.yml @main\n",
+		"foosinn/dronetest/b/.drone.yml":        "kind: pipeline\nname: default\n# include-repo: other/repo ci/steps.yml\n",
+		"foosinn/dronetest/c/.drone.yml":        "kind: pipeline\nname: default\n# include-repo: org/private ci/steps.yml\n",
+		"org/drone-shared/ci/steps.yml@main":    "- name: build\n  image: golang\n  # include: ci/commands.yml\n",
+		"org/drone-shared/ci/commands.yml@main": "commands:\n- go build",
+		"other/repo/ci/steps.yml@":              "- name: other\n",
+	}
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.Replace(strings.TrimPrefix(r.URL.Path, "/repos/"), "/contents/", "/", 1)
+		if !strings.HasPrefix(key, "foosinn/dronetest/") {
+			key += "@" + r.URL.Query().Get("ref")
+		}
+		if content, ok := files[key]; ok {
+			_, _ = fmt.Fprintf(w, `{"type": "file", "path": %q, "content": %q}`, key, base64.StdEncoding.EncodeToString([]byte(content)))
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/repos/org/private/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		changed string
+		want    string
+		err     string
+	}{
+		{
+			changed: "a/file",
+			want:    "---\nkind: pipeline\nname: default\n\nsteps:\n  - name: build\n    image: golang\n    commands:\n    - go build\n",
+		},
+		{changed: "b/file", err: errIncludeRepo.Error()},
+		{changed: "c/file", err: "/ci/steps.yml is missing or the token has no access to org/private: "},
+	}
+	for _, test := range tests {
+		req := &config.Request{
+			Build: drone.Build{
+				After: "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+			},
+			Repo: drone.Repo{
+				Namespace: "foosinn",
+				Name:      "dronetest",
+				Slug:      "foosinn/dronetest",
+				Config:    ".drone.yml",
+			},
+		}
+		plugin := New(
+			WithServer(ts.URL),
+			WithToken(mockToken),
+			WithUpMaxDepth(1),
+			WithIncludes(true),
+			WithIncludeRepos([]string{"org/*"}),
+		)
+		droneConfig, err := plugin.(Validator).Validate(noContext, req, []string{test.changed})
+		if test.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				t.Errorf("%s: want an error starting with %q got %v", test.changed, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.changed, err)
+			continue
+		}
+		if want, got := test.want, droneConfig.Data; want != got {
+			t.Errorf("%s: want %q got %q", test.changed, want, got)
+		}
+	}
+}
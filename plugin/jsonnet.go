@@ -0,0 +1,118 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-jsonnet"
+)
+
+// isJsonnet reports if file is a jsonnet config
+func isJsonnet(file string) bool {
+	switch path.Ext(file) {
+	case ".jsonnet", ".libsonnet":
+		return true
+	default:
+		return false
+	}
+}
+
+// renderJsonnet evaluates a jsonnet config and returns the emitted pipelines
+// as yaml documents, like drone does for .drone.jsonnet. Imports are resolved
+// relative to the importing file from the same repository and commit.
+func (p *plugin) renderJsonnet(ctx context.Context, req *request, file string, source string) (string, error) {
+	vm := jsonnet.MakeVM()
+	vm.Importer(&scmImporter{ctx: ctx, plugin: p, req: req})
+	for key, value := range jsonnetExtVars(req) {
+		vm.ExtVar(key, value)
+	}
+
+	result, err := vm.EvaluateSnippet(file, source)
+	if err != nil {
+		return "", err
+	}
+
+	// json is valid yaml, an array is split into one document per element
+	docs := []json.RawMessage{}
+	if !strings.HasPrefix(strings.TrimSpace(result), "[") {
+		docs = append(docs, json.RawMessage(result))
+	} else if err := json.Unmarshal([]byte(result), &docs); err != nil {
+		return "", err
+	}
+
+	buf := new(bytes.Buffer)
+	for _, doc := range docs {
+		compact := new(bytes.Buffer)
+		if err := json.Compact(compact, doc); err != nil {
+			return "", err
+		}
+		buf.WriteString("---\n")
+		if err := json.Indent(buf, compact.Bytes(), "", "   "); err != nil {
+			return "", err
+		}
+		buf.WriteString("\n")
+	}
+	return buf.String(), nil
+}
+
+// jsonnetExtVars returns the external variables drone provides to jsonnet
+func jsonnetExtVars(req *request) map[string]string {
+	build := req.Build
+	repo := req.Repo
+	return map[string]string{
+		"build.event":        build.Event,
+		"build.action":       build.Action,
+		"build.trigger":      build.Trigger,
+		"build.link":         build.Link,
+		"build.branch":       build.Target,
+		"build.source":       build.Source,
+		"build.target":       build.Target,
+		"build.before":       build.Before,
+		"build.after":        build.After,
+		"build.ref":          build.Ref,
+		"build.commit":       build.After,
+		"build.title":        build.Title,
+		"build.message":      build.Message,
+		"build.source_repo":  build.Fork,
+		"build.author_login": build.Author,
+		"build.sender":       build.Sender,
+		"repo.uid":           repo.UID,
+		"repo.name":          repo.Name,
+		"repo.namespace":     repo.Namespace,
+		"repo.slug":          repo.Slug,
+		"repo.git_http_url":  repo.HTTPURL,
+		"repo.git_ssh_url":   repo.SSHURL,
+		"repo.link":          repo.Link,
+		"repo.branch":        repo.Branch,
+		"repo.config":        repo.Config,
+		"repo.private":       strconv.FormatBool(repo.Private),
+		"repo.visibility":    repo.Visibility,
+		"repo.active":        strconv.FormatBool(repo.Active),
+		"repo.trusted":       strconv.FormatBool(repo.Trusted),
+		"repo.protected":     strconv.FormatBool(repo.Protected),
+	}
+}
+
+// scmImporter resolves jsonnet imports from the repository
+type scmImporter struct {
+	ctx    context.Context
+	plugin *plugin
+	req    *request
+}
+
+// Import downloads importedPath relative to the importing file
+func (i *scmImporter) Import(importedFrom, importedPath string) (jsonnet.Contents, string, error) {
+	file := importedPath
+	if !strings.HasPrefix(file, "/") {
+		file = path.Join("/", path.Dir(importedFrom), importedPath)
+	}
+	content, err := i.plugin.getScmFile(i.ctx, i.req, file)
+	if err != nil {
+		return jsonnet.Contents{}, "", err
+	}
+	return jsonnet.MakeContents(content), file, nil
+}
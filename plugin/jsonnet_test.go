@@ -0,0 +1,58 @@
+package plugin
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/config"
+	"github.com/sirupsen/logrus"
+)
+
+func TestRenderJsonnet(t *testing.T) {
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/foosinn/dronetest/contents/ci/lib.libsonnet" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		content := base64.StdEncoding.EncodeToString([]byte(`[{"name": "lib", "kind": "pipeline"}]`))
+		fmt.Fprintf(w, `{"path": "ci/lib.libsonnet", "content": "%s"}`, content)
+	}))
+	defer ts.Close()
+
+	p := New(WithServer(ts.URL), WithToken(mockToken)).(*plugin)
+	client, err := p.newClient(p.token, "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	req := &request{
+		Log: logrus.NewEntry(logrus.StandardLogger()),
+		Request: &config.Request{
+			Build: drone.Build{
+				After: "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+			},
+			Repo: drone.Repo{
+				Namespace: "foosinn",
+				Name:      "dronetest",
+				Slug:      "foosinn/dronetest",
+			},
+		},
+		Client: client,
+	}
+
+	configData, err := p.renderJsonnet(noContext, req, "/ci/.drone.jsonnet", `import "lib.libsonnet"`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if want := "---\n{\n   \"kind\": \"pipeline\",\n   \"name\": \"lib\"\n}\n"; configData != want {
+		t.Errorf("Want %q got %q", want, configData)
+	}
+
+	if _, err := p.renderJsonnet(noContext, req, "/ci/.drone.jsonnet", `import "missing.libsonnet"`); err == nil {
+		t.Error("Want an error for a missing import")
+	}
+}
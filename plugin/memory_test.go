@@ -0,0 +1,330 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/config"
+	"github.com/drone/go-scm/scm"
+	"gopkg.in/yaml.v2"
+)
+
+// memoryRepo is a repository held in memory, files are keyed by their path
+// without leading slash. Every push and pull request changes the same files.
+type memoryRepo struct {
+	files   map[string]string
+	changes []string
+}
+
+// client returns a client factory serving the repository
+func (m *memoryRepo) client() ClientFactory {
+	return func(token, slug string) (*scm.Client, error) {
+		return &scm.Client{
+			Contents:     &memoryContentService{repo: m},
+			Git:          &memoryGitService{repo: m},
+			PullRequests: &memoryPullRequestService{repo: m},
+		}, nil
+	}
+}
+
+func (m *memoryRepo) listChanges() ([]*scm.Change, *scm.Response, error) {
+	changes := make([]*scm.Change, 0, len(m.changes))
+	for _, file := range m.changes {
+		changes = append(changes, &scm.Change{Path: file})
+	}
+	return changes, &scm.Response{Status: http.StatusOK}, nil
+}
+
+type (
+	memoryContentService struct {
+		scm.ContentService
+		repo *memoryRepo
+	}
+	memoryGitService struct {
+		scm.GitService
+		repo *memoryRepo
+	}
+	memoryPullRequestService struct {
+		scm.PullRequestService
+		repo *memoryRepo
+	}
+)
+
+func memoryPath(file string) string {
+	return strings.Trim(path.Clean("/"+file), "/")
+}
+
+func (s *memoryContentService) Find(ctx context.Context, repo, file, ref string) (*scm.Content, *scm.Response, error) {
+	content, ok := s.repo.files[memoryPath(file)]
+	if !ok {
+		return nil, &scm.Response{Status: http.StatusNotFound}, scm.ErrNotFound
+	}
+	return &scm.Content{Path: file, Data: []byte(content)}, &scm.Response{Status: http.StatusOK}, nil
+}
+
+func (s *memoryContentService) List(ctx context.Context, repo, dir, ref string, opts scm.ListOptions) ([]*scm.ContentInfo, *scm.Response, error) {
+	dir = memoryPath(dir)
+	prefix := dir + "/"
+	if dir == "" {
+		prefix = ""
+	}
+	kinds := map[string]scm.ContentKind{}
+	for file := range s.repo.files {
+		if !strings.HasPrefix(file, prefix) {
+			continue
+		}
+		name := strings.TrimPrefix(file, prefix)
+		if i := strings.Index(name, "/"); i >= 0 {
+			kinds[prefix+name[:i]] = scm.ContentKindDirectory
+		} else {
+			kinds[prefix+name] = scm.ContentKindFile
+		}
+	}
+	if len(kinds) == 0 && dir != "" {
+		return nil, &scm.Response{Status: http.StatusNotFound}, scm.ErrNotFound
+	}
+	ls := make([]*scm.ContentInfo, 0, len(kinds))
+	for file, kind := range kinds {
+		ls = append(ls, &scm.ContentInfo{Path: file, Kind: kind})
+	}
+	sort.Slice(ls, func(i, j int) bool { return ls[i].Path < ls[j].Path })
+	return ls, &scm.Response{Status: http.StatusOK}, nil
+}
+
+func (s *memoryGitService) ListChanges(ctx context.Context, repo, ref string, opts scm.ListOptions) ([]*scm.Change, *scm.Response, error) {
+	return s.repo.listChanges()
+}
+
+func (s *memoryGitService) CompareChanges(ctx context.Context, repo, source, target string, opts scm.ListOptions) ([]*scm.Change, *scm.Response, error) {
+	return s.repo.listChanges()
+}
+
+func (s *memoryPullRequestService) ListChanges(ctx context.Context, repo string, number int, opts scm.ListOptions) ([]*scm.Change, *scm.Response, error) {
+	return s.repo.listChanges()
+}
+
+// pipelineNames returns the names of the documents of a config in order
+func pipelineNames(t *testing.T, configData string) []string {
+	names := []string{}
+	for _, document := range splitDocuments(configData) {
+		dc := droneConfig{}
+		if err := yaml.Unmarshal([]byte(document), &dc); err != nil {
+			t.Error(err)
+			continue
+		}
+		names = append(names, dc.Name)
+	}
+	return names
+}
+
+func TestMemoryWalk(t *testing.T) {
+	files := map[string]string{
+		".drone.yml":     "kind: pipeline\nname: root\n",
+		"a/.drone.yml":   "kind: pipeline\nname: a\n",
+		"a/b/.drone.yml": "kind: pipeline\nname: b\n",
+		"a/b/c/file":     "",
+		"d/.drone.yml":   "kind: pipeline\nname: d\n",
+		"e/file":         "",
+	}
+	tests := []struct {
+		name    string
+		changes []string
+		trigger string
+		options []Option
+		want    []string
+	}{
+		{
+			name:    "nearest config",
+			changes: []string{"a/b/c/file"},
+			want:    []string{"b"},
+		},
+		{
+			name:    "concat up to the root",
+			changes: []string{"a/b/c/file"},
+			options: []Option{WithConcat(true)},
+			want:    []string{"b", "a", "root"},
+		},
+		{
+			name:    "up max depth",
+			changes: []string{"a/b/c/file"},
+			options: []Option{WithConcat(true), WithUpMaxDepth(2)},
+			want:    []string{"b"},
+		},
+		{
+			name:    "deepest only with files of the same service",
+			changes: []string{"a/b/c/file", "a/b/file"},
+			options: []Option{WithConcat(true), WithDeepestOnly(true)},
+			want:    []string{"b"},
+		},
+		{
+			name:    "own directory only",
+			changes: []string{"a/b/file", "a/b/c/file", "e/file"},
+			options: []Option{WithConcat(true), WithUpMaxDepth(1)},
+			want:    []string{"b"},
+		},
+		{
+			name:    "own directory and root",
+			changes: []string{"a/b/file", "a/b/c/file", "e/file"},
+			options: []Option{WithConcat(true), WithUpMaxDepth(1), WithAlwaysRoot(true)},
+			want:    []string{"b", "root"},
+		},
+		{
+			name:    "several changed directories",
+			changes: []string{"a/b/c/file", "d/file"},
+			options: []Option{WithConcat(true)},
+			want:    []string{"b", "a", "root", "d"},
+		},
+		{
+			name:    "root config",
+			changes: []string{"e/file"},
+			want:    []string{"root"},
+		},
+		{
+			name:    "full scan",
+			trigger: "@cron",
+			options: []Option{WithConcat(true)},
+			want:    []string{"root", "a", "b", "d"},
+		},
+	}
+	for _, test := range tests {
+		repo := &memoryRepo{files: files, changes: test.changes}
+		req := &config.Request{
+			Build: drone.Build{
+				Before:  "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+				After:   "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+				Trigger: test.trigger,
+			},
+			Repo: drone.Repo{
+				Namespace: "foosinn",
+				Name:      "dronetest",
+				Slug:      "foosinn/dronetest",
+				Config:    ".drone.yml",
+			},
+		}
+		options := append([]Option{WithClientFactory(repo.client())}, test.options...)
+		droneConfig, err := New(options...).Find(noContext, req)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if droneConfig == nil {
+			t.Errorf("%s: want a config", test.name)
+			continue
+		}
+		if got := pipelineNames(t, droneConfig.Data); !reflect.DeepEqual(test.want, got) {
+			t.Errorf("%s: want pipelines %v got %v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestMemoryNotFound(t *testing.T) {
+	repo := &memoryRepo{
+		files:   map[string]string{"a/file": ""},
+		changes: []string{"a/file"},
+	}
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	droneConfig, err := New(WithClientFactory(repo.client())).Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+	}
+	if droneConfig != nil {
+		t.Errorf("Want no config got %q", droneConfig.Data)
+	}
+}
+
+// countingContentService counts the directory listings
+type countingContentService struct {
+	scm.ContentService
+	lists *int32
+}
+
+func (s *countingContentService) List(ctx context.Context, repo, dir, ref string, opts scm.ListOptions) ([]*scm.ContentInfo, *scm.Response, error) {
+	atomic.AddInt32(s.lists, 1)
+	return s.ContentService.List(ctx, repo, dir, ref, opts)
+}
+
+func TestMemoryTreeCache(t *testing.T) {
+	repo := &memoryRepo{files: map[string]string{
+		".drone.yml":   "kind: pipeline\nname: root\n",
+		"a/.drone.yml": "kind: pipeline\nname: a\n",
+		"b/file":       "",
+	}}
+	var lists int32
+	factory := func(token, slug string) (*scm.Client, error) {
+		client, err := repo.client()(token, slug)
+		if err != nil {
+			return nil, err
+		}
+		client.Contents = &countingContentService{ContentService: client.Contents, lists: &lists}
+		return client, nil
+	}
+
+	tests := []struct {
+		name    string
+		options []Option
+		want    int32
+	}{
+		{name: "disabled", want: 6},
+		{name: "per request only", options: []Option{WithTreeCache(100)}, want: 6},
+		{name: "across requests", options: []Option{WithTreeCache(100), WithCacheTTL(time.Minute)}, want: 3},
+	}
+	for _, test := range tests {
+		atomic.StoreInt32(&lists, 0)
+		plugin := New(append([]Option{WithClientFactory(factory), WithConcat(true)}, test.options...)...)
+		for i := 0; i < 2; i++ {
+			req := &config.Request{
+				Build: drone.Build{
+					After:   "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+					Trigger: "@cron",
+				},
+				Repo: drone.Repo{
+					Namespace: "foosinn",
+					Name:      "dronetest",
+					Slug:      "foosinn/dronetest",
+					Config:    ".drone.yml",
+				},
+			}
+			droneConfig, err := plugin.Find(noContext, req)
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+				continue
+			}
+			if want, got := []string{"root", "a"}, pipelineNames(t, droneConfig.Data); !reflect.DeepEqual(want, got) {
+				t.Errorf("%s: want pipelines %v got %v", test.name, want, got)
+			}
+		}
+		if got := atomic.LoadInt32(&lists); got != test.want {
+			t.Errorf("%s: want %d listings got %d", test.name, test.want, got)
+		}
+	}
+
+	cache := newTreeCache(time.Minute, 2)
+	for _, dir := range []string{"/a", "/b", "/c"} {
+		cache.set(configCacheKey{"foosinn/dronetest", "master", dir}, nil)
+	}
+	if _, ok := cache.get(configCacheKey{"foosinn/dronetest", "master", "/a"}); ok {
+		t.Error("Want the first listing evicted from a full cache")
+	}
+	if _, ok := cache.get(configCacheKey{"foosinn/dronetest", "master", "/c"}); !ok {
+		t.Error("Want the last listing cached")
+	}
+}
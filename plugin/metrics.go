@@ -0,0 +1,48 @@
+package plugin
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	findTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "drone_tree_config_find_total",
+		Help: "Number of config requests by repository namespace and result.",
+	}, []string{"namespace", "result"})
+
+	findDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "drone_tree_config_find_duration_seconds",
+		Help:    "Duration of config requests by repository namespace.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"namespace"})
+
+	scmRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "drone_tree_config_scm_request_duration_seconds",
+		Help:    "Duration of requests to the scm by http method and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "code"})
+
+	findScmRequests = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "drone_tree_config_find_scm_requests",
+		Help:    "Number of scm requests per config request by repository namespace.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+	}, []string{"namespace"})
+
+	cacheTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "drone_tree_config_cache_total",
+		Help: "Number of config cache lookups by result.",
+	}, []string{"result"})
+)
+
+// findResult returns the result label for a finished config request
+func findResult(err error) string {
+	switch {
+	case err == errConfigNotFound:
+		return "not_found"
+	case err != nil:
+		return "failure"
+	default:
+		return "success"
+	}
+}
@@ -0,0 +1,143 @@
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/drone/go-scm/scm"
+)
+
+// newMockClient creates a scm client that reads repositories from a local
+// directory instead of a scm server, e.g. to test deployments in ci. The
+// files of the repository foo/bar are read from <root>/foo/bar, the ref is
+// ignored. The changed files of every push and pull request are listed in
+// <root>/foo/bar.changes, one path per line.
+func newMockClient(root string) *scm.Client {
+	mock := &mockScm{root: root}
+	return &scm.Client{
+		Contents:     &mockContentService{mock: mock},
+		Git:          &mockGitService{mock: mock},
+		PullRequests: &mockPullRequestService{mock: mock},
+		Users:        &mockUserService{},
+	}
+}
+
+type (
+	// mockScm reads repositories below root
+	mockScm struct {
+		root string
+	}
+
+	// the mock services embed the interfaces, methods the plugin does not
+	// use are not implemented
+	mockContentService struct {
+		scm.ContentService
+		mock *mockScm
+	}
+	mockGitService struct {
+		scm.GitService
+		mock *mockScm
+	}
+	mockPullRequestService struct {
+		scm.PullRequestService
+		mock *mockScm
+	}
+	mockUserService struct {
+		scm.UserService
+	}
+)
+
+// file returns the local path of a file in the repository, paths can not
+// leave the repository
+func (m *mockScm) file(repo, file string) string {
+	return filepath.Join(m.root, filepath.FromSlash(path.Join("/", repo)), filepath.FromSlash(path.Join("/", file)))
+}
+
+// changes reads the changed files of the repository
+func (m *mockScm) changes(repo string) ([]*scm.Change, *scm.Response, error) {
+	f, err := os.Open(filepath.Join(m.root, filepath.FromSlash(path.Join("/", repo))) + ".changes")
+	if os.IsNotExist(err) {
+		return []*scm.Change{}, &scm.Response{Status: http.StatusOK}, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	changes := []*scm.Change{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		changes = append(changes, &scm.Change{Path: strings.TrimPrefix(line, "/")})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return changes, &scm.Response{Status: http.StatusOK}, nil
+}
+
+// mockResponse converts errors of the local filesystem to scm responses
+func mockResponse(err error) (*scm.Response, error) {
+	switch {
+	case err == nil:
+		return &scm.Response{Status: http.StatusOK}, nil
+	case os.IsNotExist(err):
+		return &scm.Response{Status: http.StatusNotFound}, scm.ErrNotFound
+	default:
+		return &scm.Response{Status: http.StatusInternalServerError}, err
+	}
+}
+
+func (s *mockContentService) Find(ctx context.Context, repo, file, ref string) (*scm.Content, *scm.Response, error) {
+	data, err := ioutil.ReadFile(s.mock.file(repo, file))
+	res, err := mockResponse(err)
+	if err != nil {
+		return nil, res, err
+	}
+	return &scm.Content{Path: file, Data: data}, res, nil
+}
+
+func (s *mockContentService) List(ctx context.Context, repo, dir, ref string, opts scm.ListOptions) ([]*scm.ContentInfo, *scm.Response, error) {
+	infos, err := ioutil.ReadDir(s.mock.file(repo, dir))
+	res, err := mockResponse(err)
+	if err != nil {
+		return nil, res, err
+	}
+	ls := make([]*scm.ContentInfo, 0, len(infos))
+	for _, info := range infos {
+		kind := scm.ContentKindFile
+		if info.IsDir() {
+			kind = scm.ContentKindDirectory
+		}
+		ls = append(ls, &scm.ContentInfo{
+			Path: strings.TrimPrefix(path.Join(dir, info.Name()), "/"),
+			Kind: kind,
+		})
+	}
+	return ls, res, nil
+}
+
+func (s *mockGitService) ListChanges(ctx context.Context, repo, ref string, opts scm.ListOptions) ([]*scm.Change, *scm.Response, error) {
+	return s.mock.changes(repo)
+}
+
+func (s *mockGitService) CompareChanges(ctx context.Context, repo, source, target string, opts scm.ListOptions) ([]*scm.Change, *scm.Response, error) {
+	return s.mock.changes(repo)
+}
+
+func (s *mockPullRequestService) ListChanges(ctx context.Context, repo string, number int, opts scm.ListOptions) ([]*scm.Change, *scm.Response, error) {
+	return s.mock.changes(repo)
+}
+
+func (s *mockUserService) Find(ctx context.Context) (*scm.User, *scm.Response, error) {
+	return &scm.User{Login: "mock"}, &scm.Response{Status: http.StatusOK}, nil
+}
@@ -0,0 +1,60 @@
+package plugin
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/config"
+)
+
+func TestMock(t *testing.T) {
+	plugin := New(
+		WithProvider(providerMock),
+		WithServer("testdata/mock"),
+		WithConcat(true),
+		WithSourcesComment(true),
+	)
+	if err := plugin.(Checker).Check(noContext); err != nil {
+		t.Error(err)
+	}
+
+	tests := []struct {
+		build drone.Build
+		want  string
+	}{
+		{
+			build: drone.Build{
+				Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+				After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+			},
+			want: "# drone-tree-config sources:\n# - /a/b/.drone.yml\n# - /.drone.yml\n---\n",
+		},
+		{
+			build: drone.Build{
+				After:   "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+				Trigger: "@cron",
+			},
+			want: "# drone-tree-config sources:\n# - /.drone.yml\n# - /a/b/.drone.yml\n---\n",
+		},
+	}
+	for _, test := range tests {
+		req := &config.Request{
+			Build: test.build,
+			Repo: drone.Repo{
+				Namespace: "foosinn",
+				Name:      "dronetest",
+				Slug:      "foosinn/dronetest",
+				Config:    ".drone.yml",
+			},
+		}
+		droneConfig, err := plugin.Find(noContext, req)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if got := droneConfig.Data; !strings.HasPrefix(got, test.want) {
+			t.Errorf("Want prefix %q got %q", test.want, got)
+		}
+	}
+}
@@ -0,0 +1,608 @@
+package plugin
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Option configures the plugin
+type Option func(*plugin)
+
+// WithServer configures the SCM server url, leave empty for the providers default
+func WithServer(server string) Option {
+	return func(p *plugin) {
+		p.server = server
+	}
+}
+
+// WithToken configures the SCM access token
+func WithToken(token string) Option {
+	return func(p *plugin) {
+		p.token = token
+	}
+}
+
+// WithTokens configures multiple SCM access tokens that are used round robin
+// instead of the single token
+func WithTokens(tokens []string) Option {
+	return func(p *plugin) {
+		p.tokens = nil
+		for _, token := range tokens {
+			if token = strings.TrimSpace(token); token != "" {
+				p.tokens = append(p.tokens, token)
+			}
+		}
+	}
+}
+
+// WithProvider configures the SCM provider, e.g. github or gitlab
+func WithProvider(provider string) Option {
+	return func(p *plugin) {
+		p.provider = provider
+	}
+}
+
+// WithConcat enables concatenation of all found configs
+func WithConcat(concat bool) Option {
+	return func(p *plugin) {
+		p.concat = concat
+	}
+}
+
+// WithFallback enables a full rebuild if no changed files were found
+func WithFallback(fallback bool) Option {
+	return func(p *plugin) {
+		p.fallback = fallback
+	}
+}
+
+// WithMaxDepth configures the max depth of the full scan
+func WithMaxDepth(maxDepth int) Option {
+	return func(p *plugin) {
+		p.maxDepth = maxDepth
+	}
+}
+
+// WithCacheTTL enables caching of config files across requests, a ttl of 0
+// disables the cache
+func WithCacheTTL(ttl time.Duration) Option {
+	return func(p *plugin) {
+		if ttl > 0 {
+			p.cache = newConfigCache(ttl)
+		} else {
+			p.cache = nil
+		}
+	}
+}
+
+// WithPullRequestCacheTTL enables caching of the resolved config of pull
+// requests by their head commit, a ttl of 0 disables the cache
+func WithPullRequestCacheTTL(ttl time.Duration) Option {
+	return func(p *plugin) {
+		if ttl > 0 {
+			p.prCache = newConfigCache(ttl)
+		} else {
+			p.prCache = nil
+		}
+	}
+}
+
+// WithConcurrency configures how many config files are downloaded in parallel
+func WithConcurrency(concurrency int) Option {
+	return func(p *plugin) {
+		if concurrency < 1 {
+			concurrency = 1
+		}
+		p.concurrency = concurrency
+	}
+}
+
+// WithMaxInflight limits the requests resolved at once across all requests,
+// excess requests wait up to timeout for a slot. A max of 0 disables the
+// limit, a timeout of 0 waits until drone gives up.
+func WithMaxInflight(max int, timeout time.Duration) Option {
+	return func(p *plugin) {
+		if max > 0 {
+			p.inflight = make(chan struct{}, max)
+		} else {
+			p.inflight = nil
+		}
+		p.inflightTimeout = timeout
+	}
+}
+
+// WithRetry retries failed scm requests up to count times, the backoff
+// doubles after every attempt
+func WithRetry(count int, backoff time.Duration) Option {
+	return func(p *plugin) {
+		p.retryCount = count
+		p.retryBackoff = backoff
+	}
+}
+
+// WithRateLimitWait waits up to maxWait for the rate limit to reset once it
+// is exhausted
+func WithRateLimitWait(wait bool, maxWait time.Duration) Option {
+	return func(p *plugin) {
+		p.rateLimitWait = wait
+		p.rateLimitMaxWait = maxWait
+	}
+}
+
+// WithConfigNames configures the config file names to look for in each
+// directory, the first one that validates is used. Defaults to the config
+// configured in drone.
+func WithConfigNames(names []string) Option {
+	return func(p *plugin) {
+		p.configNames = names
+	}
+}
+
+// WithInclude only considers changed files matching one of the glob patterns
+func WithInclude(patterns []string) Option {
+	return func(p *plugin) {
+		p.include = compileGlobs(patterns)
+	}
+}
+
+// WithExclude ignores changed files matching one of the glob patterns
+func WithExclude(patterns []string) Option {
+	return func(p *plugin) {
+		p.exclude = compileGlobs(patterns)
+	}
+}
+
+// WithStarlark enables rendering of .star and .starlark config files
+func WithStarlark(starlark bool) Option {
+	return func(p *plugin) {
+		p.starlark = starlark
+	}
+}
+
+// WithJsonnet enables rendering of .jsonnet and .libsonnet config files
+func WithJsonnet(jsonnet bool) Option {
+	return func(p *plugin) {
+		p.jsonnet = jsonnet
+	}
+}
+
+// WithAllowRepos restricts the plugin to repositories matching one of the
+// glob patterns, e.g. namespace/*
+func WithAllowRepos(patterns []string) Option {
+	return func(p *plugin) {
+		p.allowRepos = compileGlobs(patterns)
+	}
+}
+
+// WithDenyRepos disables the plugin for repositories matching one of the glob
+// patterns
+func WithDenyRepos(patterns []string) Option {
+	return func(p *plugin) {
+		p.denyRepos = compileGlobs(patterns)
+	}
+}
+
+// WithGithubApp authenticates as a github app using installation tokens
+// instead of the static token. If installation is 0 it is looked up per
+// repository.
+func WithGithubApp(id, installation int64, key *rsa.PrivateKey) Option {
+	return func(p *plugin) {
+		if id == 0 || key == nil {
+			p.githubApp = nil
+			return
+		}
+		p.githubApp = &githubApp{
+			id:            id,
+			installation:  installation,
+			key:           key,
+			installations: map[string]int64{},
+			tokens:        map[int64]installationToken{},
+			minting:       map[int64]*sync.Mutex{},
+		}
+	}
+}
+
+// WithTemplate configures a config template that is rendered once for every
+// changed top level directory
+func WithTemplate(template string) Option {
+	return func(p *plugin) {
+		p.template = template
+	}
+}
+
+// WithSkipNotFound returns a config that skips the build instead of letting
+// drone fall back to its own config lookup if no config was found
+func WithSkipNotFound(skip bool) Option {
+	return func(p *plugin) {
+		p.skipNotFound = skip
+	}
+}
+
+// WithFallbackConfig configures a config file that is used if no other config
+// was found, e.g. /.drone/default.yml
+func WithFallbackConfig(file string) Option {
+	return func(p *plugin) {
+		p.fallbackConfig = file
+	}
+}
+
+// WithUpMaxDepth limits the number of directories checked upwards from a
+// changed file, starting with its own directory. 0 checks up to the root.
+func WithUpMaxDepth(depth int) Option {
+	return func(p *plugin) {
+		p.upMaxDepth = depth
+	}
+}
+
+// WithSourcesComment prepends a comment listing the source files of the
+// config
+func WithSourcesComment(comment bool) Option {
+	return func(p *plugin) {
+		p.sourcesComment = comment
+	}
+}
+
+// WithEmitDigest appends a comment with the sha256 of the config and of its
+// source files
+func WithEmitDigest(digest bool) Option {
+	return func(p *plugin) {
+		p.emitDigest = digest
+	}
+}
+
+// WithFallbackBranches limits the fallback full scan to branches matching one
+// of the glob patterns
+func WithFallbackBranches(patterns []string) Option {
+	return func(p *plugin) {
+		p.fallbackBranches = compileGlobs(patterns)
+	}
+}
+
+// WithScmTimeout limits the duration of a single scm request, 0 disables the
+// timeout. The deadline of the drone request applies as well.
+func WithScmTimeout(timeout time.Duration) Option {
+	return func(p *plugin) {
+		p.scmTimeout = timeout
+	}
+}
+
+// WithDisableCleanup returns the concatenated configs verbatim without
+// removing document markers
+func WithDisableCleanup(disable bool) Option {
+	return func(p *plugin) {
+		p.disableCleanup = disable
+	}
+}
+
+// WithConfigRef reads config files from a fixed ref, e.g. master, instead of
+// the build commit
+func WithConfigRef(ref string) Option {
+	return func(p *plugin) {
+		p.configRef = ref
+	}
+}
+
+// WithAzureOrganization configures the azure devops organization of
+// repositories whose slug is project/repository
+func WithAzureOrganization(organization string) Option {
+	return func(p *plugin) {
+		p.azureOrganization = organization
+	}
+}
+
+// WithUsername authenticates with basic auth using the token as password,
+// e.g. for bitbucket app passwords
+func WithUsername(username string) Option {
+	return func(p *plugin) {
+		p.username = username
+	}
+}
+
+// WithCronPaths limits the scan of cron builds to the given directories
+func WithCronPaths(paths []string) Option {
+	return func(p *plugin) {
+		p.cronPaths = paths
+	}
+}
+
+// WithFullScanTriggers configures the build triggers and events that scan the
+// whole repository instead of the changed files, e.g. @cron or promote
+func WithFullScanTriggers(triggers []string) Option {
+	return func(p *plugin) {
+		p.fullScanTriggers = triggers
+	}
+}
+
+// WithOrder configures the order of concatenated configs, either discovery
+// order or sorted by the path of the source file
+func WithOrder(order string) Option {
+	return func(p *plugin) {
+		p.order = order
+	}
+}
+
+// WithConfigDir reads all yaml files in the given directory, e.g. .drone, if
+// a directory contains none of the config names
+func WithConfigDir(dir string) Option {
+	return func(p *plugin) {
+		p.configDir = strings.Trim(dir, "/")
+	}
+}
+
+// WithMaxFileSize rejects config files larger than size bytes, 0 disables the
+// limit
+func WithMaxFileSize(size int) Option {
+	return func(p *plugin) {
+		p.maxFileSize = size
+	}
+}
+
+// WithMaxConfigSize rejects concatenated configs larger than size bytes, 0
+// disables the limit
+func WithMaxConfigSize(size int) Option {
+	return func(p *plugin) {
+		p.maxConfigSize = size
+	}
+}
+
+// WithAlwaysRoot includes the root config for every build with changed files,
+// even if the upwards walk did not reach it
+func WithAlwaysRoot(always bool) Option {
+	return func(p *plugin) {
+		p.alwaysRoot = always
+	}
+}
+
+// WithDeepestOnly includes only the deepest config above each changed file,
+// configs of parent directories are skipped
+func WithDeepestOnly(deepest bool) Option {
+	return func(p *plugin) {
+		p.deepestOnly = deepest
+	}
+}
+
+// WithCACerts verifies the tls certificate of the scm server against the
+// given roots, e.g. from ParseCACerts
+func WithCACerts(pool *x509.CertPool) Option {
+	return func(p *plugin) {
+		p.caCerts = pool
+	}
+}
+
+// WithInsecureSkipVerify disables the verification of the tls certificate of
+// the scm server
+func WithInsecureSkipVerify(skip bool) Option {
+	return func(p *plugin) {
+		p.insecureSkipVerify = skip
+	}
+}
+
+// WithTokenScheme configures how the token is sent, either bearer, token or
+// private-token
+func WithTokenScheme(scheme string) Option {
+	return func(p *plugin) {
+		p.tokenScheme = scheme
+	}
+}
+
+// WithSkipInvalid skips config files that fail to parse or validate with a
+// warning instead of failing the request
+func WithSkipInvalid(skip bool) Option {
+	return func(p *plugin) {
+		p.skipInvalid = skip
+	}
+}
+
+// WithIncludes inlines files referenced by "# include: path" lines in config
+// files, paths are relative to the repository root
+func WithIncludes(includes bool) Option {
+	return func(p *plugin) {
+		p.includes = includes
+	}
+}
+
+// WithArchive downloads the archive of the repository once per request and
+// reads the config files from it instead of requesting each file, only
+// supported for github and gitlab
+func WithArchive(archive bool) Option {
+	return func(p *plugin) {
+		p.archive = archive
+	}
+}
+
+// WithStrictAnchors fails requests if a yaml anchor is defined in more than
+// one of the concatenated files instead of only logging a warning
+func WithStrictAnchors(strict bool) Option {
+	return func(p *plugin) {
+		p.strictAnchors = strict
+	}
+}
+
+// WithRequestIDHeader sends the uuid of the drone request in the given header
+// on every scm request, e.g. X-Request-Id
+func WithRequestIDHeader(header string) Option {
+	return func(p *plugin) {
+		p.requestIDHeader = header
+	}
+}
+
+// WithSingleConfig only loads the config in the repository root, changed
+// files are not requested
+func WithSingleConfig(single bool) Option {
+	return func(p *plugin) {
+		p.singleConfig = single
+	}
+}
+
+// WithFlatRepos only loads the root config for repositories matching one of
+// the glob patterns, like WithSingleConfig for selected repositories
+func WithFlatRepos(patterns []string) Option {
+	return func(p *plugin) {
+		p.flatRepos = compileGlobs(patterns)
+	}
+}
+
+// WithSubmodules loads the root config of changed submodules from the
+// submodule repository at the pinned commit
+func WithSubmodules(submodules bool) Option {
+	return func(p *plugin) {
+		p.submodules = submodules
+	}
+}
+
+// WithForceRange lists the changed files between before and after instead of
+// the commits of the build, empty values keep the commit of the build. This
+// is meant to reproduce issues, not for production.
+func WithForceRange(before, after string) Option {
+	return func(p *plugin) {
+		p.forceBefore = before
+		p.forceAfter = after
+	}
+}
+
+// WithGlobalConfigs concats the prepend config before and the append config
+// after the configs of every repository, e.g. to enforce org-wide pipelines
+func WithGlobalConfigs(prepend, append string) Option {
+	return func(p *plugin) {
+		p.globalPrepend = prepend
+		p.globalAppend = append
+	}
+}
+
+// WithNamespaceTokens configures SCM access tokens per repository namespace,
+// e.g. an organization, repositories of other namespaces use the default
+// token. Namespaces are matched case insensitive.
+func WithNamespaceTokens(tokens map[string]string) Option {
+	return func(p *plugin) {
+		p.namespaceTokens = make(map[string]string, len(tokens))
+		for namespace, token := range tokens {
+			p.namespaceTokens[strings.ToLower(namespace)] = token
+		}
+	}
+}
+
+// WithFailClosed fails requests on any scm error instead of skipping the
+// file, only missing files are skipped. Without it, e.g. an expired token
+// may resolve to the fallback config or no config at all.
+func WithFailClosed(failClosed bool) Option {
+	return func(p *plugin) {
+		p.failClosed = failClosed
+	}
+}
+
+// WithPrefixDuplicates renames pipelines whose name is already used by a
+// differing pipeline of another file, the name is prefixed with the directory
+// of the file. Dependencies within the file are renamed as well.
+func WithPrefixDuplicates(prefix bool) Option {
+	return func(p *plugin) {
+		p.prefixDuplicates = prefix
+	}
+}
+
+// WithPathPrefix strips a leading path from the changed files, e.g. if the
+// scm reports the paths of a monorepo below a subpath
+func WithPathPrefix(prefix string) Option {
+	return func(p *plugin) {
+		p.pathPrefix = prefix
+	}
+}
+
+// WithEventConfigs looks for a config named after the build event in each
+// directory before the default config names, e.g. .drone.pr.yml for pull
+// requests and .drone.push.yml for pushes
+func WithEventConfigs(eventConfigs bool) Option {
+	return func(p *plugin) {
+		p.eventConfigs = eventConfigs
+	}
+}
+
+// WithPropagationRetry repeats content requests failing with not found or
+// conflict once after delay, if the build was created within window. Right
+// after a push the scm may not serve the new commit on every node yet.
+func WithPropagationRetry(delay, window time.Duration) Option {
+	return func(p *plugin) {
+		p.propagationDelay = delay
+		p.propagationWindow = window
+	}
+}
+
+// WithClientFactory replaces the scm client of the configured provider, e.g.
+// with in-memory services in tests
+func WithClientFactory(factory ClientFactory) Option {
+	return func(p *plugin) {
+		p.clientFactory = factory
+	}
+}
+
+// WithConfigExtensions configures the extensions of the files concatenated
+// from the config directory, e.g. .yml and .yaml
+func WithConfigExtensions(extensions []string) Option {
+	return func(p *plugin) {
+		p.configExtensions = nil
+		for _, ext := range extensions {
+			ext = strings.ToLower(strings.TrimSpace(ext))
+			if ext != "" {
+				p.configExtensions = append(p.configExtensions, "."+strings.TrimPrefix(ext, "."))
+			}
+		}
+	}
+}
+
+// WithForkConfigs configures where the configs of pull requests from forks
+// are read from, either head for the fork or base for the target branch of
+// the base repository. Forks matching one of the trusted forks patterns
+// always use head.
+func WithForkConfigs(mode string, trusted []string) Option {
+	return func(p *plugin) {
+		p.forkConfigs = mode
+		p.trustedForks = compileGlobs(trusted)
+	}
+}
+
+// WithEmptyCommitFullScan scans the whole repository if the scm reports no
+// changed files for a build, e.g. for empty commits. Unlike the fallback it
+// does not apply to builds whose changes were all excluded.
+func WithEmptyCommitFullScan(fullScan bool) Option {
+	return func(p *plugin) {
+		p.emptyCommitFullScan = fullScan
+	}
+}
+
+// WithUUIDGenerator replaces uuid.New as generator of the request uuids, e.g.
+// for deterministic logs in tests
+func WithUUIDGenerator(generator func() uuid.UUID) Option {
+	return func(p *plugin) {
+		p.newUUID = generator
+	}
+}
+
+// WithIncludeRepos allows "# include-repo: repo path @ref" lines to include
+// files of the repositories matching one of the glob patterns
+func WithIncludeRepos(patterns []string) Option {
+	return func(p *plugin) {
+		p.includeRepos = compileGlobs(patterns)
+	}
+}
+
+// WithTreeCache reuses the directory listings of a request, e.g. for the full
+// scan after a walk. Combined with the config cache up to size listings are
+// kept across requests for the ttl of the config cache, a size of 0 disables
+// the tree cache.
+func WithTreeCache(size int) Option {
+	return func(p *plugin) {
+		p.treeCacheSize = size
+	}
+}
+
+// WithSubmoduleRepos allows loading the configs of submodules whose
+// repository matches one of the glob patterns
+func WithSubmoduleRepos(patterns []string) Option {
+	return func(p *plugin) {
+		p.submoduleRepos = compileGlobs(patterns)
+	}
+}
@@ -2,290 +2,1424 @@ package plugin
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"net/http"
+	"os"
 	"path"
-	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/drone/drone-go/drone"
 	"github.com/drone/drone-go/plugin/config"
 	"github.com/drone/go-scm/scm"
-	"github.com/drone/go-scm/scm/driver/github"
-	"github.com/drone/go-scm/scm/transport"
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 )
 
 // New creates a drone plugin
-func New(server, token string, concat bool, fallback bool, maxDepth int) config.Plugin {
-	return &plugin{
-		server: server,
-		token:  token,
-		concat: concat,
-		fallback: fallback,
-		maxDepth: maxDepth,
+func New(options ...Option) config.Plugin {
+	p := &plugin{
+		provider:         providerGithub,
+		maxDepth:         2,
+		concurrency:      4,
+		scmTimeout:       30 * time.Second,
+		order:            orderDiscovery,
+		tokenScheme:      tokenSchemeBearer,
+		fullScanTriggers: []string{"@cron"},
+		configExtensions: []string{".yml", ".yaml", ".star", ".jsonnet"},
+		newUUID:          uuid.New,
 	}
+	for _, opt := range options {
+		opt(p)
+	}
+	p.baseTransport = p.newBaseTransport()
+	if p.treeCacheSize > 0 && p.cache != nil {
+		p.tree = newTreeCache(p.cache.ttl, p.treeCacheSize)
+	}
+	return p
 }
 
 type (
 	plugin struct {
-		server   string
-		token    string
-		concat   bool
-		fallback bool
-		maxDepth int
+		server              string
+		token               string
+		provider            string
+		concat              bool
+		fallback            bool
+		maxDepth            int
+		concurrency         int
+		retryCount          int
+		retryBackoff        time.Duration
+		rateLimitWait       bool
+		rateLimitMaxWait    time.Duration
+		cache               *configCache
+		configNames         []string
+		include             globs
+		exclude             globs
+		starlark            bool
+		jsonnet             bool
+		allowRepos          globs
+		denyRepos           globs
+		githubApp           *githubApp
+		template            string
+		skipNotFound        bool
+		fallbackConfig      string
+		upMaxDepth          int
+		sourcesComment      bool
+		fallbackBranches    globs
+		scmTimeout          time.Duration
+		disableCleanup      bool
+		configRef           string
+		username            string
+		cronPaths           []string
+		order               string
+		configDir           string
+		maxFileSize         int
+		maxConfigSize       int
+		alwaysRoot          bool
+		deepestOnly         bool
+		caCerts             *x509.CertPool
+		insecureSkipVerify  bool
+		baseTransport       http.RoundTripper
+		tokenScheme         string
+		strictAnchors       bool
+		requestIDHeader     string
+		singleConfig        bool
+		submodules          bool
+		forceBefore         string
+		forceAfter          string
+		tokens              []string
+		nextToken           uint32
+		prCache             *configCache
+		flatRepos           globs
+		azureOrganization   string
+		skipInvalid         bool
+		includes            bool
+		inflight            chan struct{}
+		inflightTimeout     time.Duration
+		archive             bool
+		fullScanTriggers    []string
+		globalPrepend       string
+		globalAppend        string
+		namespaceTokens     map[string]string
+		emitDigest          bool
+		failClosed          bool
+		prefixDuplicates    bool
+		pathPrefix          string
+		eventConfigs        bool
+		propagationDelay    time.Duration
+		propagationWindow   time.Duration
+		clientFactory       ClientFactory
+		configExtensions    []string
+		forkConfigs         string
+		trustedForks        globs
+		emptyCommitFullScan bool
+		newUUID             func() uuid.UUID
+		includeRepos        globs
+		treeCacheSize       int
+		tree                *treeCache
+		submoduleRepos      globs
 	}
 
 	droneConfig struct {
 		Name string `yaml:"name"`
 		Kind string `yaml:"kind"`
+		Type string `yaml:"type"`
+	}
+
+	appendedDocument struct {
+		source  string
+		content string
+	}
+
+	droneConfigResult struct {
+		content  string
+		critical bool
+		err      error
 	}
 
 	request struct {
+		// rateLimitWaited is the time waited for rate limit resets, added
+		// atomically. It is the first field to be 64 bit aligned.
+		rateLimitWaited int64
+
 		*config.Request
 		UUID   uuid.UUID
 		Client *scm.Client
+		// Log carries the request uuid, repository and ref as fields
+		Log *logrus.Entry
+
+		missing *missingFiles
+
+		// tree holds the directory listings of the request, it is nil if
+		// the tree cache is disabled
+		tree *treeCache
+
+		// names maps the kind and name to the first appended document
+		names map[string]appendedDocument
+
+		// sources are the files the config was assembled from
+		sources []string
+
+		// configs are the appended documents of each source in discovery
+		// order
+		configs []appendedDocument
+
+		// ref overrides the ref config files are read from, e.g. the pinned
+		// commit of a submodule
+		ref string
+
+		// repo overrides the repository config files are read from, e.g. the
+		// fork of a pull request
+		repo string
+
+		// emptyDiff is set if the scm reported no changed files
+		emptyDiff bool
+
+		// submodules maps the paths of submodules to their repositories
+		submodules map[string]string
+
+		// droneignore are the directories skipped by the full scan
+		droneignore droneignore
+
+		// scmRequests counts the requests to the scm atomically, including
+		// retries and pages
+		scmRequests int32
+
+		// rendered is set atomically once a config depending on the build
+		// was rendered, e.g. from starlark
+		rendered int32
+
+		// propagation waits for the propagation delay once per request
+		propagation sync.Once
+
+		// propagated is set atomically once a content request was retried
+		// after the propagation delay, the commit is served from then on
+		propagated int32
 	}
 )
 
-var dedupRegex = regexp.MustCompile(`(?ms)(---[\s]*){2,}`)
+// orders of the appended configs
+const (
+	orderDiscovery = "discovery"
+	orderPath      = "path"
+)
+
+var (
+	errConfigNotFound  = errors.New("did not find a .drone.yml")
+	errFileNotFound    = errors.New("file not found")
+	errFileTooLarge    = errors.New("file exceeds the maximum file size")
+	errIsDirectory     = errors.New("config file is a directory")
+	errEmptyConfig     = errors.New("config file is empty")
+	errConfigTooLarge  = errors.New("config exceeds the maximum config size")
+	errTooManyInflight = errors.New("too many requests in flight")
+)
 
-// Find is called by drone
+// skipConfig is returned if no config was found and skipping is enabled, the
+// pipeline never matches so drone does not create a build
+const skipConfig = `---
+kind: pipeline
+type: docker
+name: skip
+
+steps:
+- name: skip
+  image: alpine
+  commands:
+  - "true"
+
+trigger:
+  event:
+    exclude:
+    - "*"
+`
+
+// Find is called by drone. If no config was found nil is returned without an
+// error, drone-go responds with 204 No Content and drone falls back to its
+// own config lookup. Errors are reserved for scm or transport failures.
 func (p *plugin) Find(ctx context.Context, droneRequest *config.Request) (*drone.Config, error) {
-	requestUuid := uuid.New()
-	logrus.Infof("%s %s/%s started", requestUuid, droneRequest.Repo.Namespace, droneRequest.Repo.Name)
-	defer logrus.Infof("%s finished", requestUuid)
+	res, err := p.find(ctx, droneRequest)
+	if err != errConfigNotFound {
+		return res, err
+	}
+	if p.skipNotFound {
+		return &drone.Config{Data: skipConfig}, nil
+	}
+	return nil, nil
+}
 
-	// connect to SCM
-	var client *scm.Client
-	if p.server == "" {
-		client = github.NewDefault()
-	} else {
-		var err error
-		client, err = github.New(p.server)
-		if err != nil {
-			logrus.Errorf("%s Unable to connect to SCM: '%v'", requestUuid, err)
-			return nil, err
+// find looks up the config for the request, errConfigNotFound is returned if
+// no config was found
+func (p *plugin) find(ctx context.Context, droneRequest *config.Request) (res *drone.Config, err error) {
+	req := p.newRequest(ctx, droneRequest)
+	req.Log.Info("started")
+	defer func() {
+		calls := atomic.LoadInt32(&req.scmRequests)
+		req.Log.WithField("scm_requests", calls).Info("finished")
+		if req.Client != nil {
+			findScmRequests.WithLabelValues(droneRequest.Repo.Namespace).Observe(float64(calls))
 		}
+	}()
+	defer func() {
+		hits, misses := req.missing.stats()
+		req.Log.Debugf("missing files cache: %d hits, %d misses", hits, misses)
+	}()
+
+	// metrics
+	timer := prometheus.NewTimer(findDuration.WithLabelValues(droneRequest.Repo.Namespace))
+	defer func() {
+		timer.ObserveDuration()
+		findTotal.WithLabelValues(droneRequest.Repo.Namespace, findResult(err)).Inc()
+	}()
+
+	// skip repositories the plugin is not active for, drone falls back to its
+	// own config handling
+	if !p.repoAllowed(droneRequest.Repo.Slug) {
+		req.Log.Info("repository is not allowed, skipping")
+		return nil, nil
 	}
 
-	client.Client = &http.Client{
-		Transport: &transport.BearerToken{
-			Token: p.token,
-		},
+	// the resolved config of a pull request only changes with its head
+	prKey, prCacheable := p.pullRequestCacheKey(req)
+	if prCacheable {
+		if configData, ok := p.prCache.get(prKey); ok {
+			req.Log.Infof("pull request cache hit: #%s at %s", prKey.path, prKey.sha)
+			return &drone.Config{Data: configData}, nil
+		}
 	}
 
-	req := request{droneRequest, requestUuid, client}
+	// limit the requests working against the scm at once, excess requests
+	// are queued
+	if p.inflight != nil {
+		if err := p.acquireInflight(ctx, req); err != nil {
+			return nil, err
+		}
+		defer func() { <-p.inflight }()
+	}
 
-	// get changed files
-	changedFiles, err := p.getScmChanges(ctx, &req)
-	if err != nil {
+	// connect to SCM
+	if err := p.connect(ctx, req); err != nil {
 		return nil, err
 	}
 
+	// pull requests from forks may read their configs from elsewhere
+	p.useForkConfigs(req)
+
+	// get changed files, the single config mode and flat repositories only
+	// need the root config
+	single := p.singleConfig || p.flatRepos.match(req.Repo.Slug)
+	var changedFiles []string
+	if !single {
+		changedFiles, err = p.getScmChanges(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// read the config files from a single download of the repository, it
+	// does not pay off if only the root config is needed
+	if p.archive && !single && !rootChanges(changedFiles) {
+		if dir := p.useArchive(ctx, req); dir != "" {
+			defer os.RemoveAll(dir)
+		}
+	}
+
 	// get drone.yml for changed files or all of them if no changes/cron
 	configData := ""
-	if changedFiles != nil {
-		configData, err = p.getScmConfigData(ctx, &req, changedFiles)
-	} else if req.Build.Trigger == "@cron" {
-		logrus.Warnf("%s @cron, rebuilding all", req.UUID)
-		configData, err = p.getAllConfigData(ctx, &req, "/", 0)
-	} else if p.fallback {
-		logrus.Warnf("%s no changed files and fallback enabled, rebuilding all", req.UUID)
-		configData, err = p.getAllConfigData(ctx, &req, "/", 0)
+	if single {
+		configData, err = p.getRootConfigData(ctx, req)
+	} else if changedFiles != nil {
+		configData, err = p.getScmConfigData(ctx, req, changedFiles)
+	} else if p.fullScan(req) && req.Build.Trigger == "@cron" && len(p.cronPaths) > 0 {
+		req.Log.Warnf("@cron, rebuilding %s", strings.Join(p.cronPaths, ", "))
+		configData, err = p.getCronConfigData(ctx, req)
+	} else if p.fullScan(req) {
+		req.Log.Warnf("%s %s, rebuilding all", req.Build.Trigger, req.Build.Event)
+		configData, err = p.getAllConfigData(ctx, req, "/", 0)
+	} else if isTag(req) {
+		req.Log.Warn("tag, rebuilding all")
+		configData, err = p.getAllConfigData(ctx, req, "/", 0)
+	} else if p.emptyCommitFullScan && req.emptyDiff {
+		req.Log.Warn("empty commit, rebuilding all")
+		configData, err = p.getAllConfigData(ctx, req, "/", 0)
+	} else if p.fallback && p.fallbackAllowed(req) {
+		req.Log.Warn("no changed files and fallback enabled, rebuilding all")
+		configData, err = p.getAllConfigData(ctx, req, "/", 0)
 	}
 	if err != nil {
 		return nil, err
 	}
 
+	configData, err = p.assembleConfig(ctx, req, configData, changedFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	if prCacheable && atomic.LoadInt32(&req.rendered) == 0 {
+		p.prCache.set(prKey, configData)
+	}
+
+	return &drone.Config{Data: configData}, nil
+}
+
+// assembleConfig turns the configs found by the lookup into the config handed
+// to drone, it adds the template for changedFiles as well as the fallback and
+// global configs and checks and cleans up the result. changedFiles is nil if
+// the changes are unknown.
+func (p *plugin) assembleConfig(ctx context.Context, req *request, configData string, changedFiles []string) (string, error) {
+	// render the config template for the changed directories
+	if changedFiles != nil && p.template != "" {
+		rendered, err := p.getTemplateConfigData(ctx, req, changedFiles)
+		if err != nil {
+			return "", err
+		}
+		configData = p.droneConfigAppend(configData, rendered)
+	}
+
+	// drone went away, e.g. on a timeout, failed requests must not be
+	// mistaken for missing files
+	if err := ctx.Err(); err != nil {
+		req.Log.Warnf("request cancelled: %v", err)
+		return "", err
+	}
+
+	// load the fallback config if nothing else was found
+	if configData == "" && p.fallbackConfig != "" {
+		fileContent, critical, err := p.getScmDroneConfig(ctx, req, p.fallbackConfig)
+		if critical {
+			return "", err
+		}
+		if err == nil {
+			req.Log.Infof("no config found, using fallback config %s", p.fallbackConfig)
+			configData = p.appendConfig(req, configData, fileContent, p.fallbackConfig)
+		}
+	}
+
+	// sort by source path, the order of discovery depends on the changed
+	// files
+	if p.order == orderPath {
+		configData = p.sortConfigs(req)
+	}
+
 	// no file found
 	if configData == "" {
-		return nil, errors.New("did not find a .drone.yml")
+		return "", errConfigNotFound
+	}
+
+	// org-wide pipelines, only added to repositories with a config
+	configData = p.addGlobalConfigs(req, configData)
+
+	// drone has to parse the whole config, large monorepos may exceed the
+	// limit with many small files
+	if p.maxConfigSize > 0 && len(configData) > p.maxConfigSize {
+		req.Log.Errorf("config has %d bytes, the maximum config size is %d bytes", len(configData), p.maxConfigSize)
+		return "", errConfigTooLarge
+	}
+
+	// report anchors defined by several files
+	if err := p.checkAnchors(req); err != nil {
+		return "", err
+	}
+
+	// drone rejects dependencies on pipelines missing from the config
+	if err := p.checkDependencies(req); err != nil {
+		return "", err
 	}
 
 	// cleanup
-	configData = strings.ReplaceAll(configData, "...", "")
-	configData = string(dedupRegex.ReplaceAll([]byte(configData), []byte("---")))
+	if !p.disableCleanup {
+		configData = cleanupConfig(configData)
+	}
 
-	return &drone.Config{Data: configData}, nil
+	req.Log.Infof("config sources: %s", strings.Join(req.sources, ", "))
+	if p.sourcesComment {
+		configData = sourcesComment(req.sources) + configData
+	}
+	if p.emitDigest {
+		configData += digestComment(configData, req.sources)
+	}
+
+	return configData, nil
+}
+
+// pullRequestCacheKey returns the key of the resolved config of a pull
+// request, the path is the pull request number. A push to the pull request
+// changes the head and thereby the key.
+func (p *plugin) pullRequestCacheKey(req *request) (configCacheKey, bool) {
+	if p.prCache == nil || req.Build.After == "" || !strings.HasPrefix(req.Build.Ref, p.pullRequestRefPrefix()) {
+		return configCacheKey{}, false
+	}
+	number := strings.Split(strings.TrimPrefix(req.Build.Ref, p.pullRequestRefPrefix()), "/")[0]
+	if _, err := strconv.Atoi(number); err != nil {
+		return configCacheKey{}, false
+	}
+	return configCacheKey{req.Repo.Slug, req.Build.After, number}, true
+}
+
+// newRequest wraps the drone request, the scm client is set by connect
+func (p *plugin) newRequest(ctx context.Context, droneRequest *config.Request) *request {
+	requestUuid := p.requestUUID(ctx)
+	req := &request{
+		Request: droneRequest,
+		UUID:    requestUuid,
+		Log: logrus.WithFields(logrus.Fields{
+			"uuid":      requestUuid,
+			"namespace": droneRequest.Repo.Namespace,
+			"name":      droneRequest.Repo.Name,
+			"ref":       droneRequest.Build.Ref,
+		}),
+		missing: newMissingFiles(),
+	}
+	if p.treeCacheSize > 0 {
+		req.tree = newTreeCache(0, 0)
+	}
+	return req
+}
+
+// connect creates the scm client for the request
+func (p *plugin) connect(ctx context.Context, req *request) error {
+	token, err := p.scmToken(ctx, req.Repo.Slug)
+	if err != nil {
+		req.Log.Errorf("Unable to get SCM token: '%v'", err)
+		return err
+	}
+	req.Client, err = p.scmClient(token, req.Repo.Slug)
+	if err != nil {
+		req.Log.Errorf("Unable to connect to SCM: '%v'", err)
+		return err
+	}
+
+	// count the scm requests of the config request
+	if req.Client.Client != nil {
+		req.Client.Client.Transport = &countingTransport{
+			count: &req.scmRequests,
+			base:  req.Client.Client.Transport,
+		}
+	}
+
+	// stop reading content responses that exceed the maximum file size
+	if p.maxFileSize > 0 && req.Client.Client != nil {
+		req.Client.Client.Transport = &contentLimitTransport{
+			base: req.Client.Client.Transport,
+		}
+	}
+
+	// send the request uuid to correlate the scm requests
+	if p.requestIDHeader != "" && req.Client.Client != nil {
+		req.Client.Client.Transport = &requestIDTransport{
+			header: p.requestIDHeader,
+			id:     req.UUID.String(),
+			base:   req.Client.Client.Transport,
+		}
+	}
+	return nil
+}
+
+// repoAllowed checks the repository slug against the allow and deny lists
+func (p *plugin) repoAllowed(slug string) bool {
+	if len(p.allowRepos) > 0 && !p.allowRepos.match(slug) {
+		return false
+	}
+	return !p.denyRepos.match(slug)
 }
 
 // getScmChanges tries to get a list of changed files from scm
 func (p *plugin) getScmChanges(ctx context.Context, req *request) ([]string, error) {
 	var changedFiles []string
 
-	if req.Build.Trigger == "@cron" {
-		// cron jobs trigger a full build
+	if p.forceBefore != "" || p.forceAfter != "" {
+		// debugging aid to reproduce the configs of another range
+		before, after := req.Build.Before, req.Build.After
+		if p.forceBefore != "" {
+			before = p.forceBefore
+		}
+		if p.forceAfter != "" {
+			after = p.forceAfter
+		}
+		req.Log.Warnf("using the forced range %s...%s for changed files", before, after)
+		changes, err := p.getScmRangeChanges(ctx, req, before, after)
+		if err != nil {
+			return nil, err
+		}
+		changedFiles = p.appendChanges(req, changedFiles, changes)
+	} else if p.fullScan(req) {
+		// cron jobs and the configured triggers trigger a full build
 		changedFiles = []string{}
-	} else if strings.HasPrefix(req.Build.Ref, "refs/pull/") {
-		// use pullrequests api to get changed files
+	} else if isTag(req) {
+		// tags have no meaningful diff, the tagged commit is scanned instead
+		changedFiles = []string{}
+	} else if strings.HasPrefix(req.Build.Ref, p.pullRequestRefPrefix()) {
+		// use pullrequests api to get changed files, gitlab merge requests
+		// are addressed by their iid which is part of the ref as well
 		pullRequestID, err := strconv.Atoi(strings.Split(req.Build.Ref, "/")[2])
 		if err != nil {
-			logrus.Errorf("%s unable to get pull request id %v", req.UUID, err)
+			req.Log.Errorf("unable to get pull request id %v", err)
 			return nil, err
 		}
-		opts := scm.ListOptions{}
-		files, _, err := req.Client.PullRequests.ListChanges(ctx, req.Repo.Slug, pullRequestID, opts)
+		var files []*scm.Change
+		if p.provider == providerGitlab {
+			// the merge request changes endpoint reports the old path of
+			// renamed files as well
+			files, err = p.getGitlabMergeRequestChanges(ctx, req, pullRequestID)
+		} else {
+			files, err = p.listChanges(ctx, req, "list pull request changes", func(opts scm.ListOptions) ([]*scm.Change, *scm.Response, error) {
+				return req.Client.PullRequests.ListChanges(ctx, req.Repo.Slug, pullRequestID, opts)
+			})
+		}
 		if err != nil {
-			logrus.Errorf("%s unable to fetch diff for Pull request %v", req.UUID, err)
+			req.Log.Errorf("unable to fetch diff for Pull request %v", err)
 			return nil, err
 		}
-		for _, file := range files {
-			changedFiles = append(changedFiles, file.Path)
-		}
+		changedFiles = p.appendChanges(req, changedFiles, files)
 	} else {
 		// use diff to get changed files
-		before := req.Build.Before
-		if before == "0000000000000000000000000000000000000000" || before == "" {
-			before = fmt.Sprintf("%s~1", req.Build.After)
-		}
-		opts := scm.ListOptions{}
-		// TODO verify that ListChanges is functionally equivalent to the /compare API
-		changes, _, err := req.Client.Git.ListChanges(ctx, req.Repo.Slug, req.Build.After, opts)
+		changes, err := p.getScmRangeChanges(ctx, req, req.Build.Before, req.Build.After)
 		if err != nil {
-			logrus.Errorf("%s unable to fetch diff: '%v'", req.UUID, err)
 			return nil, err
 		}
-		for _, file := range changes {
-			changedFiles = append(changedFiles, file.Path)
-		}
+		changedFiles = p.appendChanges(req, changedFiles, changes)
+	}
+
+	// the scm reported no changes at all, e.g. for an empty commit, as
+	// opposed to changes that were filtered
+	if len(changedFiles) == 0 && !p.fullScan(req) && !isTag(req) {
+		req.emptyDiff = true
 	}
 
+	changedFiles = p.filterChanges(req, changedFiles)
 	if len(changedFiles) > 0 {
 		changedList := strings.Join(changedFiles, "\n  ")
-		logrus.Debugf("%s changed files: \n  %s", req.UUID, changedList)
+		req.Log.Debugf("changed files: \n  %s", changedList)
 	} else {
 		return nil, nil
 	}
 	return changedFiles, nil
 }
 
+// getScmRangeChanges lists the changes between before and after, or of after
+// alone if there is no before commit
+func (p *plugin) getScmRangeChanges(ctx context.Context, req *request, before, after string) ([]*scm.Change, error) {
+	hasBefore := before != "0000000000000000000000000000000000000000" && before != ""
+	var changes []*scm.Change
+	err := scm.ErrNotSupported
+	if hasBefore {
+		// compare the whole push, listing the changes of the last commit
+		// misses the earlier commits of the push
+		changes, err = p.listChanges(ctx, req, "compare changes", func(opts scm.ListOptions) ([]*scm.Change, *scm.Response, error) {
+			return req.Client.Git.CompareChanges(ctx, req.Repo.Slug, before, after, opts)
+		})
+	}
+	if err == scm.ErrNotSupported {
+		// new branches have no before commit, fall back to the changes
+		// of the pushed commit
+		changes, err = p.listChanges(ctx, req, "list changes", func(opts scm.ListOptions) ([]*scm.Change, *scm.Response, error) {
+			return req.Client.Git.ListChanges(ctx, req.Repo.Slug, after, opts)
+		})
+	}
+	if err != nil {
+		req.Log.Errorf("unable to fetch diff: '%v'", err)
+		return nil, err
+	}
+	return changes, nil
+}
+
+// appendChanges adds the paths of the changes. Renamed files are reported
+// with their new path, deleted files are marked missing so they are not
+// fetched as config candidates.
+func (p *plugin) appendChanges(req *request, changedFiles []string, changes []*scm.Change) []string {
+	for _, change := range changes {
+		file := p.stripPathPrefix(change.Path)
+		if change.Deleted {
+			req.Log.Debugf("%s was deleted", file)
+			if p.configRef == "" && req.ref == "" {
+				req.missing.add(path.Join("/", file))
+			}
+		}
+		changedFiles = append(changedFiles, file)
+	}
+	return changedFiles
+}
+
+// listChanges calls list for every page of changes, the next page is taken
+// from the response
+func (p *plugin) listChanges(ctx context.Context, req *request, name string, list func(opts scm.ListOptions) ([]*scm.Change, *scm.Response, error)) ([]*scm.Change, error) {
+	changes := []*scm.Change{}
+	opts := scm.ListOptions{Size: 100}
+	for {
+		var page []*scm.Change
+		var next scm.Page
+		err := p.retry(ctx, req, name, func() (res *scm.Response, err error) {
+			page, res, err = list(opts)
+			if res != nil {
+				next = res.Page
+			}
+			return res, err
+		})
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, page...)
+
+		// the change listings take page numbers, bitbucket links the next
+		// page as well but ignores the link, it is only followed if the
+		// page has no number
+		switch {
+		case next.Next > opts.Page:
+			opts.Page = next.Next
+		case next.NextURL != "" && next.NextURL != opts.URL:
+			opts.URL = next.NextURL
+		default:
+			return changes, nil
+		}
+		req.Log.Debugf("%s: fetching the next page", name)
+	}
+}
+
+// stripPathPrefix removes the configured path prefix from a changed file,
+// files outside of the prefix are returned unchanged
+func (p *plugin) stripPathPrefix(file string) string {
+	prefix := strings.Trim(p.pathPrefix, "/")
+	if prefix == "" {
+		return file
+	}
+	relative := strings.TrimPrefix(file, "/")
+	if !strings.HasPrefix(relative, prefix+"/") {
+		return file
+	}
+	return relative[len(prefix)+1:]
+}
+
+// fallbackAllowed checks the branch of the build against the fallback
+// branches, all branches are allowed if none are configured
+func (p *plugin) fallbackAllowed(req *request) bool {
+	if len(p.fallbackBranches) == 0 {
+		return true
+	}
+	return p.fallbackBranches.match(req.Build.Target) ||
+		p.fallbackBranches.match(strings.TrimPrefix(req.Build.Ref, "refs/heads/"))
+}
+
+// fullScan checks if the trigger or event of the build is one of the full
+// scan triggers, a leading @ is ignored for events, e.g. @promote matches the
+// promote event
+func (p *plugin) fullScan(req *request) bool {
+	for _, trigger := range p.fullScanTriggers {
+		if trigger == req.Build.Trigger || strings.TrimPrefix(trigger, "@") == req.Build.Event {
+			return true
+		}
+	}
+	return false
+}
+
+// isTag checks if the build was triggered by a tag
+func isTag(req *request) bool {
+	return req.Build.Event == "tag" || strings.HasPrefix(req.Build.Ref, "refs/tags/")
+}
+
+// filterChanges removes changed files that are not included or excluded by
+// the configured patterns
+func (p *plugin) filterChanges(req *request, changedFiles []string) []string {
+	if len(p.include) == 0 && len(p.exclude) == 0 {
+		return changedFiles
+	}
+
+	filtered := []string{}
+	for _, file := range changedFiles {
+		relative := strings.TrimPrefix(file, "/")
+		if len(p.include) > 0 && !p.include.match(relative) {
+			req.Log.Debugf("ignoring %s: not included", file)
+			continue
+		}
+		if p.exclude.match(relative) {
+			req.Log.Debugf("ignoring %s: excluded", file)
+			continue
+		}
+		filtered = append(filtered, file)
+	}
+	return filtered
+}
+
 // getScmFile downloads a file from scm
 func (p *plugin) getScmFile(ctx context.Context, req *request, file string) (content string, err error) {
-	logrus.Debugf("%s checking %s/%s %s", req.UUID, req.Repo.Namespace, req.Repo.Name, file)
+	if req.missing.isDirectory(file) {
+		req.Log.Errorf("%s is a directory", file)
+		return "", errIsDirectory
+	}
+	if req.missing.has(file) {
+		req.Log.Debugf("missing files cache hit: %s", file)
+		return "", errFileNotFound
+	}
+	req.Log.Debugf("checking %s", file)
 
-	data, _, err := req.Client.Contents.Find(ctx, req.Repo.Slug, file, req.Build.After)
-	if data == nil {
+	var data *scm.Content
+	notFound := false
+	contentCtx := p.limitContent(ctx)
+	err = p.retryContent(ctx, req, "get "+file, func() (res *scm.Response, err error) {
+		data, res, err = req.Client.Contents.Find(contentCtx, p.configRepoFor(req), scmPath(file), p.configRefFor(req))
+		notFound = res != nil && res.Status == http.StatusNotFound
+		return res, err
+	})
+	if notFound {
+		req.missing.add(file)
+	}
+	if err == nil && data == nil {
 		err = fmt.Errorf("failed to get %s: is not a file", file)
 	}
+	if err == errFileTooLarge {
+		req.Log.Errorf("%s exceeds the maximum file size of %d bytes", file, p.maxFileSize)
+	}
 	if err != nil {
 		return "", err
 	}
-	return string(data.Data), nil
+	if p.maxFileSize > 0 && len(data.Data) > p.maxFileSize {
+		req.Log.Errorf("%s has %d bytes, the maximum file size is %d bytes", file, len(data.Data), p.maxFileSize)
+		return "", errFileTooLarge
+	}
+	return normalizeContent(data.Data), nil
+}
+
+// failsClosed reports if a failed scm request for file has to fail the
+// request, in fail closed mode only missing files are skipped
+func (p *plugin) failsClosed(req *request, file string, err error) bool {
+	return p.failClosed && err != errFileNotFound && !req.missing.has(file)
 }
 
 // getScmDroneConfig downloads a drone config and validates it
 func (p *plugin) getScmDroneConfig(ctx context.Context, req *request, file string) (configData string, critical bool, err error) {
+	cacheKey := configCacheKey{p.configRepoFor(req), p.configRefFor(req), file}
+	if p.cache != nil {
+		if fileContent, ok := p.cache.get(cacheKey); ok {
+			req.Log.Debugf("cache hit: %s", file)
+			cacheTotal.WithLabelValues("hit").Inc()
+			req.Log.Infof("found %s", file)
+			return fileContent, false, nil
+		}
+		req.Log.Debugf("cache miss: %s", file)
+		cacheTotal.WithLabelValues("miss").Inc()
+	}
+
 	fileContent, err := p.getScmFile(ctx, req, file)
+	if err == errFileTooLarge || err == errIsDirectory {
+		return "", true, err
+	}
 	if err != nil {
-		logrus.Debugf("%s skipping: unable to load file: %s %v", req.UUID, file, err)
+		if p.failsClosed(req, file, err) {
+			req.Log.Errorf("unable to load file, failing closed: %s %v", file, err)
+			return "", true, err
+		}
+		req.Log.Debugf("skipping: unable to load file: %s %v", file, err)
 		return "", false, err
 	}
 
+	// an empty file is treated like a missing one, malformed files fail
+	// validation below
+	if strings.TrimSpace(fileContent) == "" {
+		req.Log.Infof("skipping: empty config file: %s", file)
+		return "", false, errEmptyConfig
+	}
+
+	// render starlark, the result depends on the build so it is not cached
+	rendered := false
+	if p.starlark && isStarlark(file) {
+		fileContent, err = renderStarlark(ctx, req, file, fileContent)
+		if err != nil {
+			req.Log.Errorf("skipping: unable to render starlark file: %s %v", file, err)
+			return "", true, err
+		}
+		rendered = true
+	}
+
+	// render jsonnet, the result depends on the build so it is not cached
+	if p.jsonnet && isJsonnet(file) {
+		fileContent, err = p.renderJsonnet(ctx, req, file, fileContent)
+		if err != nil {
+			req.Log.Errorf("skipping: unable to render jsonnet file: %s %v", file, err)
+			return "", true, err
+		}
+		rendered = true
+	}
+
+	// inline included files, rendered configs are generated by code instead
+	if p.includes && !rendered {
+		fileContent, err = p.resolveIncludes(ctx, req, includeSource{}, file, fileContent, 0)
+		if err != nil {
+			return "", true, err
+		}
+	}
+
 	// validate fileContent, exit early if an error was found
-	dc := droneConfig{}
-	err = yaml.Unmarshal([]byte(fileContent), &dc)
-	if err != nil {
-		logrus.Errorf("%s skipping: unable do parse yml file: %s %v", req.UUID, file, err)
+	if err := validateDroneConfig(fileContent); err != nil {
+		if p.skipInvalid {
+			req.Log.Warnf("skipping: invalid config file: %s %v", file, err)
+			return "", false, err
+		}
+		req.Log.Errorf("skipping: invalid config file: %s %v", file, err)
 		return "", true, err
 	}
-	if dc.Name == "" || dc.Kind == "" {
-		logrus.Errorf("%s skipping: missing 'kind' or 'name' in %s.", req.UUID, file)
-		return "", true, err
+
+	if rendered {
+		atomic.StoreInt32(&req.rendered, 1)
+	} else if p.cache != nil {
+		p.cache.set(cacheKey, fileContent)
 	}
 
-	logrus.Infof("%s found %s/%s %s", req.UUID, req.Repo.Namespace, req.Repo.Name, file)
+	req.Log.Infof("found %s", file)
 	return fileContent, false, nil
 }
 
 // getScmConfigData scans a repository based on the changed files
 func (p *plugin) getScmConfigData(ctx context.Context, req *request, changedFiles []string) (configData string, err error) {
-	// collect drone.yml files
-	configData = ""
-	cache := map[string]bool{}
+	// collect the directories of each changed file, walking upwards
+	walks := [][]string{}
+	walkFiles := []string{}
+	dirs := []string{}
+	candidates := []string{}
+	seen := map[string]bool{}
 	for _, file := range changedFiles {
 		if !strings.HasPrefix(file, "/") {
 			file = "/" + file
 		}
 
+		walk := []string{}
 		done := false
 		dir := file
 		for !done {
 			done = bool(dir == "/")
 			dir = path.Join(dir, "..")
-			file := path.Join(dir, req.Repo.Config)
+			walk = append(walk, dir)
+			if !seen[dir] {
+				seen[dir] = true
+				dirs = append(dirs, dir)
+				for _, name := range p.configNamesFor(req) {
+					candidates = append(candidates, path.Join(dir, name))
+				}
+			}
+			if p.upMaxDepth > 0 && len(walk) >= p.upMaxDepth {
+				break
+			}
+		}
+		walks = append(walks, walk)
+		walkFiles = append(walkFiles, file)
+	}
 
-			// check if file has already been checked
-			_, ok := cache[file]
-			if ok {
-				continue
-			} else {
-				cache[file] = true
+	// the root config is checked last, after the configs of the changed files
+	if p.alwaysRoot && len(changedFiles) > 0 {
+		walks = append(walks, []string{"/"})
+		walkFiles = append(walkFiles, "")
+		if !seen["/"] {
+			seen["/"] = true
+			dirs = append(dirs, "/")
+			for _, name := range p.configNamesFor(req) {
+				candidates = append(candidates, path.Join("/", name))
 			}
+		}
+	}
+
+	// list the directories first, candidates missing from the listing are
+	// not fetched at all
+	p.listDirs(ctx, req, dirs)
 
-			// download file from git
-			fileContent, critical, err := p.getScmDroneConfig(ctx, req, file)
+	// download all candidates at once, errors are only relevant if the walk
+	// below actually reaches the file
+	results := p.getScmDroneConfigs(ctx, req, candidates)
+
+	// collect drone.yml files
+	configData = ""
+	// cache maps the checked directories to whether they had a config
+	cache := map[string]bool{}
+	for i, walk := range walks {
+		// a changed submodule has its config in the submodule repository
+		if p.submodules && walkFiles[i] != "" {
+			fileContent, err := p.getSubmoduleConfigData(ctx, req, walkFiles[i])
 			if err != nil {
-				if critical {
-					return "", err
+				return "", err
+			}
+			configData = p.droneConfigAppend(configData, fileContent)
+			if fileContent != "" && (!p.concat || p.deepestOnly) {
+				continue
+			}
+		}
+
+		for _, dir := range walk {
+			// check if directory has already been checked, a config found
+			// there by an earlier walk ends this walk like its own would
+			if found, ok := cache[dir]; ok {
+				if found && p.deepestOnly {
+					break
 				}
 				continue
 			}
 
-			// append
-			configData = p.droneConfigAppend(configData, fileContent)
-			if !p.concat {
-				logrus.Infof("%s concat is disabled. Using just first .drone.yml.", req.UUID)
+			// use the first candidate that validates
+			found := false
+			for _, name := range p.configNamesFor(req) {
+				result := results[path.Join(dir, name)]
+				if result.err != nil {
+					if result.critical {
+						return "", result.err
+					}
+					continue
+				}
+
+				// append
+				configData = p.appendConfig(req, configData, result.content, path.Join(dir, name))
+				found = true
+				break
+			}
+
+			// fall back to the fragments in the config directory
+			if !found && p.configDir != "" {
+				fileContent, err := p.getConfigDirData(ctx, req, dir)
+				if err != nil {
+					return "", err
+				}
+				configData = p.droneConfigAppend(configData, fileContent)
+				found = fileContent != ""
+			}
+			cache[dir] = found
+			if found && p.deepestOnly {
 				break
 			}
+			if found && !p.concat {
+				req.Log.Info("concat is disabled. Using just first .drone.yml.")
+				break
+			}
+		}
+	}
+
+	// the parent configs were downloaded anyway, tell which ones were skipped
+	if !p.concat {
+		if ignored := ignoredConfigs(req, dirs, p.configNamesFor(req), results); len(ignored) > 0 {
+			req.Log.Warnf("concat is disabled, ignoring %s", strings.Join(ignored, ", "))
 		}
 	}
 	return configData, nil
 }
 
+// ignoredConfigs returns the valid configs of dirs that were not appended
+func ignoredConfigs(req *request, dirs, names []string, results map[string]droneConfigResult) []string {
+	appended := map[string]bool{}
+	for _, source := range req.sources {
+		appended[source] = true
+	}
+	ignored := []string{}
+	for _, dir := range dirs {
+		for _, name := range names {
+			file := path.Join(dir, name)
+			if results[file].err != nil {
+				continue
+			}
+			if !appended[file] {
+				ignored = append(ignored, file)
+			}
+			break
+		}
+	}
+	return ignored
+}
+
+// getScmDroneConfigs downloads and validates multiple drone configs using
+// up to p.concurrency parallel requests
+func (p *plugin) getScmDroneConfigs(ctx context.Context, req *request, files []string) map[string]droneConfigResult {
+	results := make([]droneConfigResult, len(files))
+	sem := make(chan struct{}, p.concurrency)
+	wg := sync.WaitGroup{}
+	for i, file := range files {
+		// skip the remaining files once the request is cancelled
+		if err := acquire(ctx, sem); err != nil {
+			results[i].err = err
+			continue
+		}
+		wg.Add(1)
+		go func(i int, file string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			result := &results[i]
+			result.content, result.critical, result.err = p.getScmDroneConfig(ctx, req, file)
+		}(i, file)
+	}
+	wg.Wait()
+
+	resultMap := make(map[string]droneConfigResult, len(files))
+	for i, file := range files {
+		resultMap[file] = results[i]
+	}
+	return resultMap
+}
+
+// acquire takes a slot of the semaphore unless ctx is done first
+func acquire(ctx context.Context, sem chan struct{}) error {
+	select {
+	case sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// acquireInflight takes a slot of the in-flight limit, it waits up to the
+// inflight timeout
+func (p *plugin) acquireInflight(ctx context.Context, req *request) error {
+	waitCtx := ctx
+	if p.inflightTimeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, p.inflightTimeout)
+		defer cancel()
+	}
+	if err := acquire(waitCtx, p.inflight); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		req.Log.Errorf("no slot of %d in-flight requests freed within %s", cap(p.inflight), p.inflightTimeout)
+		return errTooManyInflight
+	}
+	return nil
+}
+
 // getAllConfigData searches for all or fist 'drone.yml' in the repo
 func (p *plugin) getAllConfigData(ctx context.Context, req *request, dir string, depth int) (configData string, err error) {
-	ls, _, err := req.Client.Contents.Find(ctx, req.Repo.Slug, dir, req.Build.After)
+	if depth > p.maxDepth {
+		req.Log.Infof("skipping scan of %s, max depth %d reached.", dir, depth)
+		return "", nil
+	}
+	depth += 1
+
+	ls, err := p.listDir(ctx, req, dir)
 	if err != nil {
+		req.Log.Errorf("unable to list directory %s: '%v'", dir, err)
 		return "", err
 	}
 
-	if depth > p.maxDepth {
-		logrus.Infof("%s skipping scan of %s, max depth %d reached.", req.UUID, dir, depth)
-		return "", nil
+	// check for a drone.yml in this directory, the first valid candidate wins,
+	// candidates missing from the listing are skipped without a request
+	configData = ""
+	for _, name := range p.configNamesFor(req) {
+		fileContent, critical, err := p.getScmDroneConfig(ctx, req, path.Join(dir, name))
+		if err != nil {
+			if critical {
+				return "", err
+			}
+			continue
+		}
+		configData = p.appendConfig(req, configData, fileContent, path.Join("/", dir, name))
+		break
+	}
+	if configData == "" && p.configDir != "" {
+		configData, err = p.getConfigDirData(ctx, req, dir)
+		if err != nil {
+			return "", err
+		}
+	}
+	if !p.concat && configData != "" {
+		req.Log.Info("concat is disabled. Using just first .drone.yml.")
+		return configData, nil
 	}
-	depth += 1
 
 	// check recursivly for drone.yml
-	configData = ""
+	for _, f := range ls {
+		if p.submodules && f.Kind != scm.ContentKindDirectory {
+			fileContent, err := p.getSubmoduleConfigData(ctx, req, f.Path)
+			if err != nil {
+				return "", err
+			}
+			configData = p.droneConfigAppend(configData, fileContent)
+			if !p.concat && configData != "" {
+				req.Log.Info("concat is disabled. Using just first .drone.yml.")
+				break
+			}
+		}
+		if f.Kind != scm.ContentKindDirectory {
+			continue
+		}
+		if p.configDir != "" && path.Base(f.Path) == p.configDir {
+			continue
+		}
+		ignore, err := p.ignore(ctx, req)
+		if err != nil {
+			return "", err
+		}
+		if ignore.match(f.Path) {
+			req.Log.Debugf("skipping scan of %s, ignored by .droneignore", f.Path)
+			continue
+		}
+		// listings return relative paths, the caches are keyed by absolute
+		// ones like the changed files
+		fileContent, err := p.getAllConfigData(ctx, req, path.Join("/", f.Path), depth)
+		if err != nil {
+			return "", err
+		}
 
-	// TODO this will always crash because go-scm cannot handle a /contents request on a directory
-	err2 := errors.New(string(ls.Data))
-	//for _, f := range ls.Data {
-	//	var fileContent string
-	//	if f. == "dir" {
-	//		fileContent, _ = p.getAllConfigData(ctx, req, *f.Path, depth)
-	//	} else if *f.Type == "file" && *f.Name == req.Repo.Config {
-	//		var critical bool
-	//		fileContent, critical, err = p.getScmDroneConfig(ctx, req, *f.Path)
-	//		if critical {
-	//			return "", err
-	//		}
-	//	}
-	//	// append
-	//	configData = p.droneConfigAppend(configData, fileContent)
-	//	if !p.concat {
-	//		logrus.Infof("%s concat is disabled. Using just first .drone.yml.", req.UUID)
-	//		break
-	//	}
-	//}
-
-	return configData, err2
+		// append
+		configData = p.droneConfigAppend(configData, fileContent)
+		if !p.concat && configData != "" {
+			req.Log.Info("concat is disabled. Using just first .drone.yml.")
+			break
+		}
+	}
 
+	return configData, nil
+}
+
+// listDir lists a directory and marks the config names and the config
+// directory it does not contain as missing, names with a directory are not
+// part of the listing
+func (p *plugin) listDir(ctx context.Context, req *request, dir string) ([]*scm.ContentInfo, error) {
+	key := configCacheKey{p.configRepoFor(req), p.configRefFor(req), dir}
+	ls, cached := req.tree.get(key)
+	if !cached {
+		if ls, cached = p.tree.get(key); cached {
+			req.tree.set(key, ls)
+		}
+	}
+	if cached {
+		req.Log.Debugf("tree cache hit: %s", dir)
+	} else {
+		notFound := false
+		err := p.retryContent(ctx, req, "list "+dir, func() (res *scm.Response, err error) {
+			ls, res, err = req.Client.Contents.List(ctx, key.slug, scmPath(dir), key.sha, scm.ListOptions{})
+			notFound = res != nil && res.Status == http.StatusNotFound
+			return res, err
+		})
+		if notFound {
+			// the directory is gone, e.g. all its files were deleted
+			for _, name := range p.configNamesFor(req) {
+				req.missing.add(path.Join(dir, name))
+			}
+			if p.configDir != "" {
+				req.missing.add(path.Join(dir, p.configDir))
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		req.tree.set(key, ls)
+		p.tree.set(key, ls)
+	}
+
+	files := map[string]bool{}
+	dirs := map[string]bool{}
+	for _, f := range ls {
+		switch f.Kind {
+		case scm.ContentKindFile:
+			files[path.Base(f.Path)] = true
+		case scm.ContentKindDirectory:
+			dirs[path.Base(f.Path)] = true
+		}
+	}
+	for _, name := range p.configNamesFor(req) {
+		if !strings.Contains(name, "/") && dirs[name] {
+			req.missing.addDirectory(path.Join(dir, name))
+		} else if !strings.Contains(name, "/") && !files[name] {
+			req.missing.add(path.Join(dir, name))
+		}
+	}
+	if p.configDir != "" && !strings.Contains(p.configDir, "/") && !dirs[p.configDir] {
+		req.missing.add(path.Join(dir, p.configDir))
+	}
+	return ls, nil
+}
+
+// listDirs lists multiple directories using up to p.concurrency parallel
+// requests, failed listings are ignored and their candidates fetched directly
+func (p *plugin) listDirs(ctx context.Context, req *request, dirs []string) {
+	sem := make(chan struct{}, p.concurrency)
+	wg := sync.WaitGroup{}
+	for _, dir := range dirs {
+		if acquire(ctx, sem) != nil {
+			break
+		}
+		wg.Add(1)
+		go func(dir string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if _, err := p.listDir(ctx, req, dir); err != nil {
+				req.Log.Debugf("unable to list directory %s: %v", dir, err)
+			}
+		}(dir)
+	}
+	wg.Wait()
+}
+
+// getRootConfigData loads the first valid config in the repository root
+func (p *plugin) getRootConfigData(ctx context.Context, req *request) (configData string, err error) {
+	for _, name := range p.configNamesFor(req) {
+		file := path.Join("/", name)
+		fileContent, critical, err := p.getScmDroneConfig(ctx, req, file)
+		if err != nil {
+			if critical {
+				return "", err
+			}
+			continue
+		}
+		return p.appendConfig(req, "", fileContent, file), nil
+	}
+	return "", nil
+}
+
+// getCronConfigData scans the configured cron paths instead of the whole
+// repository
+func (p *plugin) getCronConfigData(ctx context.Context, req *request) (configData string, err error) {
+	for _, dir := range p.cronPaths {
+		fileContent, err := p.getAllConfigData(ctx, req, path.Join("/", dir), 0)
+		if err != nil {
+			return "", err
+		}
+		configData = p.droneConfigAppend(configData, fileContent)
+		if !p.concat && configData != "" {
+			req.Log.Info("concat is disabled. Using just first .drone.yml.")
+			break
+		}
+	}
+	return configData, nil
+}
+
+// configRefFor returns the ref config files are read from, changed files are
+// always taken from the build commit
+func (p *plugin) configRefFor(req *request) string {
+	if req.ref != "" {
+		return req.ref
+	}
+	if p.configRef != "" {
+		return p.configRef
+	}
+	return req.Build.After
+}
+
+// configRepoFor returns the repository config files are read from
+func (p *plugin) configRepoFor(req *request) string {
+	if req.repo != "" {
+		return req.repo
+	}
+	return req.Repo.Slug
+}
+
+// configNamesFor returns the config file names to look for in each directory,
+// the names for the build event are checked first if enabled
+func (p *plugin) configNamesFor(req *request) []string {
+	names := p.configNames
+	if len(names) == 0 {
+		names = []string{req.Repo.Config}
+	}
+	if !p.eventConfigs || req.Build.Event == "" {
+		return names
+	}
+	eventNames := make([]string, 0, 2*len(names))
+	for _, name := range names {
+		eventNames = append(eventNames, eventConfigName(name, req.Build.Event))
+	}
+	return append(eventNames, names...)
+}
+
+// eventConfigName inserts the build event before the extension of a config
+// name, e.g. .drone.pr.yml for pull requests or .drone.push.yml for pushes
+func eventConfigName(name, event string) string {
+	if event == "pull_request" {
+		event = "pr"
+	}
+	ext := path.Ext(name)
+	if ext == "" || ext == path.Base(name) {
+		return name + "." + event
+	}
+	return strings.TrimSuffix(name, ext) + "." + event + ext
+}
+
+// sourcesComment lists the source files as a yaml comment
+func sourcesComment(sources []string) string {
+	comment := "# drone-tree-config sources:\n"
+	for _, source := range sources {
+		comment += "# - " + source + "\n"
+	}
+	return comment
+}
+
+// digestComment reports the sha256 of the config and of the sorted set of
+// source files as a yaml comment, consumers compare them between builds to
+// detect changes of the effective config
+func digestComment(configData string, sources []string) string {
+	sorted := append([]string{}, sources...)
+	sort.Strings(sorted)
+	configSum := sha256.Sum256([]byte(configData))
+	sourcesSum := sha256.Sum256([]byte(strings.Join(sorted, "\n")))
+	return fmt.Sprintf("# drone-tree-config digest: config=sha256:%x sources=sha256:%x\n", configSum, sourcesSum)
+}
+
+// appendConfig appends the documents of a config file and records its source.
+// Documents identical to an already appended document with the same kind and
+// name are skipped, e.g. from copied configs, as drone rejects duplicate
+// pipeline names. Differing documents with the same name are only reported,
+// or renamed if duplicate names are prefixed.
+func (p *plugin) appendConfig(req *request, configData, content, source string) string {
+	if req.names == nil {
+		req.names = map[string]appendedDocument{}
+	}
+
+	documents := splitDocuments(content)
+	if p.prefixDuplicates {
+		if renames := p.duplicateRenames(req, documents, source); len(renames) > 0 {
+			for i, document := range documents {
+				documents[i] = renamePipelines(document, renames)
+			}
+			content = ""
+			for _, document := range documents {
+				content = p.droneConfigAppend(content, document)
+			}
+		}
+	}
+	kept := make([]string, 0, len(documents))
+	for _, document := range documents {
+		dc := droneConfig{}
+		if err := yaml.Unmarshal([]byte(document), &dc); err != nil || dc.Name == "" {
+			kept = append(kept, document)
+			continue
+		}
+		key := dc.Kind + "/" + dc.Name
+		if first, ok := req.names[key]; ok {
+			if first.content == strings.TrimSpace(document) {
+				req.Log.Warnf("skipping %s '%s' of %s, identical to %s", dc.Kind, dc.Name, source, first.source)
+				continue
+			}
+			req.Log.Warnf("%s '%s' of %s is already defined in %s", dc.Kind, dc.Name, source, first.source)
+		} else {
+			req.names[key] = appendedDocument{source, strings.TrimSpace(document)}
+		}
+		kept = append(kept, document)
+	}
+	if len(kept) == 0 {
+		return configData
+	}
+	if len(kept) < len(documents) {
+		content = ""
+		for _, document := range kept {
+			content = p.droneConfigAppend(content, document)
+		}
+	}
+
+	req.sources = append(req.sources, source)
+	req.configs = append(req.configs, appendedDocument{source, content})
+	return p.droneConfigAppend(configData, content)
+}
+
+// sortConfigs concats the appended configs again, sorted by their source
+func (p *plugin) sortConfigs(req *request) string {
+	sort.SliceStable(req.configs, func(i, j int) bool {
+		return req.configs[i].source < req.configs[j].source
+	})
+	configData := ""
+	req.sources = req.sources[:0]
+	for _, c := range req.configs {
+		req.sources = append(req.sources, c.source)
+		configData = p.droneConfigAppend(configData, c.content)
+	}
+	return configData
 }
 
 // droneConfigAppend concats multiple 'drone.yml's to a multi-machine pipeline
@@ -294,7 +1428,12 @@ func (p *plugin) droneConfigAppend(droneConfig string, appends ...string) string
 	for _, a := range appends {
 		a = strings.Trim(a, " \n")
 		if a != "" {
-			if !strings.HasPrefix(a, "---\n") {
+			if strings.HasPrefix(a, "%") {
+				// directives are only allowed after an explicit document end
+				if droneConfig != "" {
+					a = "...\n" + a
+				}
+			} else if !strings.HasPrefix(a, "---\n") {
 				a = "---\n" + a
 			}
 			droneConfig += a
@@ -1,17 +1,33 @@
 package plugin
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"net/http"
 	"net/http/httptest"
 
 	"github.com/drone/drone-go/drone"
 	"github.com/drone/drone-go/plugin/config"
+	"github.com/drone/go-scm/scm"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 )
 
 var noContext = context.Background()
@@ -20,7 +36,7 @@ const mockToken = "7535706b694c63526c6e4f5230374243"
 
 // test commit
 func TestPlugin(t *testing.T) {
-	ts := httptest.NewServer(testMux())
+	ts := newTestServer(testMux())
 	defer ts.Close()
 
 	req := &config.Request{
@@ -35,7 +51,12 @@ func TestPlugin(t *testing.T) {
 			Config:    ".drone.yml",
 		},
 	}
-	plugin := New(ts.URL, mockToken, false, true, 2)
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithFallback(true),
+		WithMaxDepth(2),
+	)
 	droneConfig, err := plugin.Find(noContext, req)
 	if err != nil {
 		t.Error(err)
@@ -48,7 +69,7 @@ func TestPlugin(t *testing.T) {
 }
 
 func TestConcat(t *testing.T) {
-	ts := httptest.NewServer(testMux())
+	ts := newTestServer(testMux())
 	defer ts.Close()
 
 	req := &config.Request{
@@ -63,7 +84,13 @@ func TestConcat(t *testing.T) {
 			Config:    ".drone.yml",
 		},
 	}
-	plugin := New(ts.URL, mockToken, true, true, 2)
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithConcat(true),
+		WithFallback(true),
+		WithMaxDepth(2),
+	)
 	droneConfig, err := plugin.Find(noContext, req)
 	if err != nil {
 		t.Error(err)
@@ -75,14 +102,2431 @@ func TestConcat(t *testing.T) {
 	}
 }
 
+func TestConcatConcurrency(t *testing.T) {
+	ts := newTestServer(testMux())
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	for _, concurrency := range []int{1, 2, 8} {
+		plugin := New(
+			WithServer(ts.URL),
+			WithToken(mockToken),
+			WithConcat(true),
+			WithConcurrency(concurrency),
+		)
+		droneConfig, err := plugin.Find(noContext, req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if want, got := "---\nkind: pipeline\nname: default\n\nsteps:\n- name: build\n  image: golang\n  commands:\n  - go build\n  - go test -short\n\n- name: integration\n  image: golang\n  commands:\n  - go test -v\n---\nkind: pipeline\nname: default\n\nsteps:\n- name: frontend\n  image: node\n  commands:\n  - npm install\n  - npm test\n\n- name: backend\n  image: golang\n  commands:\n  - go build\n  - go test\n", droneConfig.Data; want != got {
+			t.Errorf("concurrency %d: Want %q got %q", concurrency, want, got)
+		}
+	}
+}
+
 func TestPullRequest(t *testing.T) {
-	ts := httptest.NewServer(testMux())
+	ts := newTestServer(testMux())
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Fork: "octocat/dronetest",
+			Ref:  "refs/pull/3/head",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithConcat(true),
+		WithFallback(true),
+		WithMaxDepth(2),
+	)
+	droneConfig, err := plugin.Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if want, got := "---\nkind: pipeline\nname: default\n\nsteps:\n- name: frontend\n  image: node\n  commands:\n  - npm install\n  - npm test\n\n- name: backend\n  image: golang\n  commands:\n  - go build\n  - go test\n", droneConfig.Data; want != got {
+		t.Errorf("Want %q got %q", want, got)
+	}
+}
+
+func TestCron(t *testing.T) {
+	ts := newTestServer(testMux())
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			After:   "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+			Trigger: "@cron",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithFallback(true),
+		WithMaxDepth(2),
+	)
+	droneConfig, err := plugin.Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if want, got := "---\nkind: pipeline\nname: default\n\nsteps:\n- name: frontend\n  image: node\n  commands:\n  - npm install\n  - npm test\n\n- name: backend\n  image: golang\n  commands:\n  - go build\n  - go test\n", droneConfig.Data; want != got {
+		t.Errorf("Want %q got %q", want, got)
+	}
+}
+
+func TestCronConcat(t *testing.T) {
+	ts := newTestServer(testMux())
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			After:   "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+			Trigger: "@cron",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithConcat(true),
+		WithFallback(true),
+		WithMaxDepth(2),
+	)
+	droneConfig, err := plugin.Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if want, got := "---\nkind: pipeline\nname: default\n\nsteps:\n- name: frontend\n  image: node\n  commands:\n  - npm install\n  - npm test\n\n- name: backend\n  image: golang\n  commands:\n  - go build\n  - go test\n---\nkind: pipeline\nname: default\n\nsteps:\n- name: build\n  image: golang\n  commands:\n  - go build\n  - go test -short\n\n- name: integration\n  image: golang\n  commands:\n  - go test -v\n", droneConfig.Data; want != got {
+		t.Errorf("Want %q got %q", want, got)
+	}
+}
+
+func TestCronMaxDepth(t *testing.T) {
+	ts := newTestServer(testMux())
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			After:   "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+			Trigger: "@cron",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithConcat(true),
+		WithFallback(true),
+		WithMaxDepth(0),
+	)
+	droneConfig, err := plugin.Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if want, got := "---\nkind: pipeline\nname: default\n\nsteps:\n- name: frontend\n  image: node\n  commands:\n  - npm install\n  - npm test\n\n- name: backend\n  image: golang\n  commands:\n  - go build\n  - go test\n", droneConfig.Data; want != got {
+		t.Errorf("Want %q got %q", want, got)
+	}
+}
+
+func TestUnsupportedProvider(t *testing.T) {
+	req := &config.Request{
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithToken(mockToken),
+		WithProvider("svn"),
+	)
+	_, err := plugin.Find(noContext, req)
+	if err == nil {
+		t.Error("Want an error for an unsupported provider")
+	}
+}
+
+func TestCache(t *testing.T) {
+	var fetched int32
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/repos/foosinn/dronetest/contents/a/b/.drone.yml" {
+			atomic.AddInt32(&fetched, 1)
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithCacheTTL(time.Minute),
+	)
+	for i := 0; i < 2; i++ {
+		droneConfig, err := plugin.Find(noContext, req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if want, got := "---\nkind: pipeline\nname: default\n\nsteps:\n- name: build\n  image: golang\n  commands:\n  - go build\n  - go test -short\n\n- name: integration\n  image: golang\n  commands:\n  - go test -v\n", droneConfig.Data; want != got {
+			t.Errorf("Want %q got %q", want, got)
+		}
+	}
+
+	if want, got := int32(1), atomic.LoadInt32(&fetched); want != got {
+		t.Errorf("Want %d downloads got %d", want, got)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	var changes, notFound int32
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/foosinn/dronetest/compare/2897b31ec3a1b59279a08a8ad54dc360686327f7...8ecad91991d5da985a2a8dd97cc19029dc1c2899":
+			if atomic.AddInt32(&changes, 1) == 1 {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+		case "/repos/foosinn/dronetest/contents/a/.drone.yml":
+			atomic.AddInt32(&notFound, 1)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithConcat(true),
+		WithRetry(2, time.Millisecond),
+	)
+	_, err := plugin.Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if want, got := int32(2), atomic.LoadInt32(&changes); want != got {
+		t.Errorf("Want %d change requests got %d", want, got)
+	}
+	if want, got := int32(1), atomic.LoadInt32(&notFound); want != got {
+		t.Errorf("Want %d requests for a missing file got %d", want, got)
+	}
+}
+
+func TestRateLimitWait(t *testing.T) {
+	var changes int32
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/repos/foosinn/dronetest/compare/2897b31ec3a1b59279a08a8ad54dc360686327f7...8ecad91991d5da985a2a8dd97cc19029dc1c2899" {
+			if atomic.AddInt32(&changes, 1) == 1 {
+				w.Header().Set("Retry-After", "60")
+				w.Header().Set("X-RateLimit-Limit", "5000")
+				w.Header().Set("X-RateLimit-Remaining", "0")
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithRateLimitWait(true, 10*time.Millisecond),
+	)
+	_, err := plugin.Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if want, got := int32(2), atomic.LoadInt32(&changes); want != got {
+		t.Errorf("Want %d change requests got %d", want, got)
+	}
+}
+
+func TestRateLimitMaxWaitPerRequest(t *testing.T) {
+	plugin := New(WithRateLimitWait(true, 10*time.Millisecond)).(*plugin)
+	res := &scm.Response{Header: http.Header{"Retry-After": []string{"60"}}}
+
+	req := &request{}
+	if want, got := 10*time.Millisecond, plugin.rateLimitDelay(req, res); want != got {
+		t.Errorf("Want a delay of %s got %s", want, got)
+	}
+	if got := plugin.rateLimitDelay(req, res); got != 0 {
+		t.Errorf("Want no delay once the max wait of the request is used up, got %s", got)
+	}
+	if want, got := 10*time.Millisecond, plugin.rateLimitDelay(&request{}, res); want != got {
+		t.Errorf("Want a delay of %s for another request got %s", want, got)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	ts := newTestServer(testMux())
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		},
+		Repo: drone.Repo{
+			Namespace: "metrics",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+	)
+	_, err := plugin.Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if want, got := 1.0, testutil.ToFloat64(findTotal.WithLabelValues("metrics", "success")); want != got {
+		t.Errorf("Want %v successful requests got %v", want, got)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+mockToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = io.WriteString(w, `{"message": "Bad credentials"}`)
+			return
+		}
+		_, _ = io.WriteString(w, `{"login": "foosinn"}`)
+	}))
+	defer ts.Close()
+
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+	)
+	if err := plugin.(Checker).Check(noContext); err != nil {
+		t.Error(err)
+	}
+
+	plugin = New(
+		WithServer(ts.URL),
+		WithToken("invalid"),
+	)
+	if err := plugin.(Checker).Check(noContext); err == nil {
+		t.Error("Want an error for an invalid token")
+	}
+
+	// without a single token the check uses the token list or a namespace
+	// token
+	plugin = New(
+		WithServer(ts.URL),
+		WithTokens([]string{mockToken, "invalid"}),
+	)
+	if err := plugin.(Checker).Check(noContext); err != nil {
+		t.Errorf("token list: %v", err)
+	}
+	plugin = New(
+		WithServer(ts.URL),
+		WithNamespaceTokens(map[string]string{"foosinn": mockToken}),
+	)
+	if err := plugin.(Checker).Check(noContext); err != nil {
+		t.Errorf("namespace tokens: %v", err)
+	}
+}
+
+func TestConfigNames(t *testing.T) {
+	ts := newTestServer(testMux())
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			After:   "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+			Trigger: "@cron",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    "pipeline.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithConcat(true),
+		WithConfigNames([]string{".drone.yaml", ".drone.yml"}),
+	)
+	droneConfig, err := plugin.Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if want, got := "---\nkind: pipeline\nname: default\n\nsteps:\n- name: frontend\n  image: node\n  commands:\n  - npm install\n  - npm test\n\n- name: backend\n  image: golang\n  commands:\n  - go build\n  - go test\n---\nkind: pipeline\nname: default\n\nsteps:\n- name: build\n  image: golang\n  commands:\n  - go build\n  - go test -short\n\n- name: integration\n  image: golang\n  commands:\n  - go test -v\n", droneConfig.Data; want != got {
+		t.Errorf("Want %q got %q", want, got)
+	}
+}
+
+func TestExclude(t *testing.T) {
+	ts := newTestServer(testMux())
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithExclude([]string{"a/**"}),
+	)
+	droneConfig, err := plugin.Find(noContext, req)
+	if err != nil || droneConfig != nil {
+		t.Errorf("Want no config and no error got %v %v", droneConfig, err)
+	}
+
+	plugin = New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithFallback(true),
+		WithExclude([]string{"a/**"}),
+	)
+	droneConfig, err = plugin.Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if want, got := "---\nkind: pipeline\nname: default\n\nsteps:\n- name: frontend\n  image: node\n  commands:\n  - npm install\n  - npm test\n\n- name: backend\n  image: golang\n  commands:\n  - go build\n  - go test\n", droneConfig.Data; want != got {
+		t.Errorf("Want %q got %q", want, got)
+	}
+}
+
+func TestDenyRepos(t *testing.T) {
+	var requests int32
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	for _, opt := range []Option{
+		WithAllowRepos([]string{"bitsbeats/*"}),
+		WithDenyRepos([]string{"foosinn/*"}),
+	} {
+		plugin := New(
+			WithServer(ts.URL),
+			WithToken(mockToken),
+			opt,
+		)
+		droneConfig, err := plugin.Find(noContext, req)
+		if err != nil || droneConfig != nil {
+			t.Errorf("Want no config and no error got %v %v", droneConfig, err)
+		}
+	}
+
+	if want, got := int32(0), atomic.LoadInt32(&requests); want != got {
+		t.Errorf("Want %d scm requests got %d", want, got)
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/foosinn/dronetest/contents/.drone.missing.yml":
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message": "Not Found"}`)
+		case "/repos/foosinn/dronetest/contents/.drone.broken.yml":
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"message": "Resource not accessible by integration"}`)
+		default:
+			mux.ServeHTTP(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithTemplate(".drone.tmpl.yml"),
+	)
+	droneConfig, err := plugin.Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if want, got := "---\nkind: pipeline\nname: default\n\nsteps:\n- name: build\n  image: golang\n  commands:\n  - go build\n  - go test -short\n\n- name: integration\n  image: golang\n  commands:\n  - go test -v\n---\nkind: pipeline\nname: a\n\nsteps:\n- name: test\n  image: golang\n  commands:\n  - cd a\n  - go test ./...\n", droneConfig.Data; want != got {
+		t.Errorf("Want %q got %q", want, got)
+	}
+
+	// repositories without the template only use their configs
+	droneConfig, err = New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithTemplate(".drone.missing.yml"),
+	).Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if want, got := "---\nkind: pipeline\nname: default\n\nsteps:\n- name: build\n  image: golang\n  commands:\n  - go build\n  - go test -short\n\n- name: integration\n  image: golang\n  commands:\n  - go test -v\n", droneConfig.Data; want != got {
+		t.Errorf("Want %q got %q", want, got)
+	}
+
+	// other failures still fail the request
+	_, err = New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithTemplate(".drone.broken.yml"),
+	).Find(noContext, req)
+	if err == nil {
+		t.Error("Want an error for a template that failed to load")
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	ts := newTestServer(testMux())
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    "missing.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithSkipNotFound(true),
+	)
+	droneConfig, err := plugin.Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if want, got := skipConfig, droneConfig.Data; want != got {
+		t.Errorf("Want %q got %q", want, got)
+	}
+
+	// scm errors are not reported as missing config
+	req.Repo.Slug = "foosinn/missing"
+	if _, err := plugin.Find(noContext, req); err == nil {
+		t.Error("Want an error for an unknown repository")
+	}
+}
+
+func TestFallbackConfig(t *testing.T) {
+	ts := newTestServer(testMux())
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithExclude([]string{"a/**"}),
+		WithFallbackConfig("/afolder/.drone.yml"),
+	)
+	droneConfig, err := plugin.Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if want, got := "---\nkind: pipeline\nname: default\n\nsteps:\n- name: build\n  image: golang\n  commands:\n  - go build\n  - go test -short\n\n- name: integration\n  image: golang\n  commands:\n  - go test -v\n", droneConfig.Data; want != got {
+		t.Errorf("Want %q got %q", want, got)
+	}
+}
+
+func TestUpMaxDepth(t *testing.T) {
+	ts := newTestServer(testMux())
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+
+	// a/b/c/d/file only checks a/b/c/d and a/b/c
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithUpMaxDepth(2),
+	)
+	droneConfig, err := plugin.Find(noContext, req)
+	if err != nil || droneConfig != nil {
+		t.Errorf("Want no config and no error got %v %v", droneConfig, err)
+	}
+
+	plugin = New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithUpMaxDepth(3),
+	)
+	droneConfig, err = plugin.Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if want, got := "---\nkind: pipeline\nname: default\n\nsteps:\n- name: build\n  image: golang\n  commands:\n  - go build\n  - go test -short\n\n- name: integration\n  image: golang\n  commands:\n  - go test -v\n", droneConfig.Data; want != got {
+		t.Errorf("Want %q got %q", want, got)
+	}
+}
+
+func TestTag(t *testing.T) {
+	var changes int32
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/commits/") {
+			atomic.AddInt32(&changes, 1)
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Event:  "tag",
+			Ref:    "refs/tags/v1.0.0",
+			Before: "0000000000000000000000000000000000000000",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithConcat(true),
+	)
+	droneConfig, err := plugin.Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if want, got := "---\nkind: pipeline\nname: default\n\nsteps:\n- name: frontend\n  image: node\n  commands:\n  - npm install\n  - npm test\n\n- name: backend\n  image: golang\n  commands:\n  - go build\n  - go test\n---\nkind: pipeline\nname: default\n\nsteps:\n- name: build\n  image: golang\n  commands:\n  - go build\n  - go test -short\n\n- name: integration\n  image: golang\n  commands:\n  - go test -v\n", droneConfig.Data; want != got {
+		t.Errorf("Want %q got %q", want, got)
+	}
+	if want, got := int32(0), atomic.LoadInt32(&changes); want != got {
+		t.Errorf("Want %d change requests got %d", want, got)
+	}
+}
+
+// newTestServer serves handler below /api/v3 like a github enterprise server
+func newTestServer(handler http.Handler) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/api/v3/", http.StripPrefix("/api/v3", handler))
+	return httptest.NewServer(mux)
+}
+
+func TestMissingFiles(t *testing.T) {
+	var fetched int32
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/repos/foosinn/dronetest/contents/missing.yml" {
+			atomic.AddInt32(&fetched, 1)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    "missing.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithFallbackConfig("/missing.yml"),
+	)
+	droneConfig, err := plugin.Find(noContext, req)
+	if err != nil || droneConfig != nil {
+		t.Errorf("Want no config and no error got %v %v", droneConfig, err)
+	}
+
+	// the listing of / already shows /missing.yml to be missing
+	if want, got := int32(0), atomic.LoadInt32(&fetched); want != got {
+		t.Errorf("Want %d requests for /missing.yml got %d", want, got)
+	}
+}
+
+func TestSourcesComment(t *testing.T) {
+	ts := newTestServer(testMux())
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			After:   "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+			Trigger: "@cron",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithConcat(true),
+		WithSourcesComment(true),
+	)
+	droneConfig, err := plugin.Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if want, got := "# drone-tree-config sources:\n# - /.drone.yml\n# - /afolder/.drone.yml\n---\n", droneConfig.Data; !strings.HasPrefix(got, want) {
+		t.Errorf("Want prefix %q got %q", want, got)
+	}
+}
+
+func TestFallbackBranches(t *testing.T) {
+	ts := newTestServer(testMux())
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+			Ref:    "refs/heads/feature/foo",
+			Target: "feature/foo",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithFallback(true),
+		WithFallbackBranches([]string{"master", "release/*"}),
+		WithExclude([]string{"a/**"}),
+	)
+	droneConfig, err := plugin.Find(noContext, req)
+	if err != nil || droneConfig != nil {
+		t.Errorf("Want no config and no error got %v %v", droneConfig, err)
+	}
+
+	req.Build.Ref = "refs/heads/release/1.0"
+	req.Build.Target = "release/1.0"
+	droneConfig, err = plugin.Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if want, got := "---\nkind: pipeline\nname: default\n\nsteps:\n- name: frontend\n  image: node\n  commands:\n  - npm install\n  - npm test\n\n- name: backend\n  image: golang\n  commands:\n  - go build\n  - go test\n", droneConfig.Data; want != got {
+		t.Errorf("Want %q got %q", want, got)
+	}
+}
+
+func TestScmTimeout(t *testing.T) {
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+
+	// client timeout
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithScmTimeout(50*time.Millisecond),
+	)
+	start := time.Now()
+	if _, err := plugin.Find(noContext, req); err == nil {
+		t.Error("Want an error for a slow scm")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Want the request to abort after the timeout, took %s", elapsed)
+	}
+
+	// deadline of the drone request
+	plugin = New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithScmTimeout(0),
+	)
+	ctx, cancel := context.WithTimeout(noContext, 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if _, err := plugin.Find(ctx, req); err == nil {
+		t.Error("Want an error for a slow scm")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Want the request to abort after the deadline, took %s", elapsed)
+	}
+}
+
+func TestConfigRef(t *testing.T) {
+	var wrongRef int32
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/contents/") && r.URL.Query().Get("ref") != "master" {
+			atomic.AddInt32(&wrongRef, 1)
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithConfigRef("master"),
+	)
+	droneConfig, err := plugin.Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if want, got := "---\nkind: pipeline\nname: default\n\nsteps:\n- name: build\n  image: golang\n  commands:\n  - go build\n  - go test -short\n\n- name: integration\n  image: golang\n  commands:\n  - go test -v\n", droneConfig.Data; want != got {
+		t.Errorf("Want %q got %q", want, got)
+	}
+	if want, got := int32(0), atomic.LoadInt32(&wrongRef); want != got {
+		t.Errorf("Want %d content requests for other refs got %d", want, got)
+	}
+}
+
+func TestDeletedFiles(t *testing.T) {
+	var fetched int32
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/foosinn/dronetest/pulls/4/files":
+			f, _ := os.Open("testdata/pull_4_files.json")
+			_, _ = io.Copy(w, f)
+			return
+		case "/repos/foosinn/dronetest/contents/service":
+			w.WriteHeader(http.StatusNotFound)
+			return
+		case "/repos/foosinn/dronetest/contents/service/.drone.yml":
+			atomic.AddInt32(&fetched, 1)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Ref:   "refs/pull/4/head",
+			After: "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithConcat(true),
+	)
+	droneConfig, err := plugin.Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if want, got := "---\nkind: pipeline\nname: default\n\nsteps:\n- name: frontend\n  image: node\n  commands:\n  - npm install\n  - npm test\n\n- name: backend\n  image: golang\n  commands:\n  - go build\n  - go test\n---\nkind: pipeline\nname: default\n\nsteps:\n- name: build\n  image: golang\n  commands:\n  - go build\n  - go test -short\n\n- name: integration\n  image: golang\n  commands:\n  - go test -v\n", droneConfig.Data; want != got {
+		t.Errorf("Want %q got %q", want, got)
+	}
+	if want, got := int32(0), atomic.LoadInt32(&fetched); want != got {
+		t.Errorf("Want %d requests for the deleted config got %d", want, got)
+	}
+}
+
+func TestUsername(t *testing.T) {
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "foosinn" || password != mockToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = io.WriteString(w, `{"message": "Bad credentials"}`)
+			return
+		}
+		_, _ = io.WriteString(w, `{"login": "foosinn"}`)
+	}))
+	defer ts.Close()
+
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithUsername("foosinn"),
+	)
+	if err := plugin.(Checker).Check(noContext); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCronPaths(t *testing.T) {
+	ts := newTestServer(testMux())
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			After:   "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+			Trigger: "@cron",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithConcat(true),
+		WithCronPaths([]string{"afolder"}),
+		WithSourcesComment(true),
+	)
+	droneConfig, err := plugin.Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if want, got := "# drone-tree-config sources:\n# - /afolder/.drone.yml\n---\nkind: pipeline\nname: default\n\nsteps:\n- name: build\n  image: golang\n  commands:\n  - go build\n  - go test -short\n\n- name: integration\n  image: golang\n  commands:\n  - go test -v\n", droneConfig.Data; want != got {
+		t.Errorf("Want %q got %q", want, got)
+	}
+}
+
+func TestDuplicateDocuments(t *testing.T) {
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/repos/foosinn/dronetest/contents/afolder/.drone.yml" {
+			// a copy of the root config
+			f, _ := os.Open("testdata/.drone.yml.json")
+			_, _ = io.Copy(w, f)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			After:   "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+			Trigger: "@cron",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithConcat(true),
+	)
+	droneConfig, err := plugin.Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if want, got := "---\nkind: pipeline\nname: default\n\nsteps:\n- name: frontend\n  image: node\n  commands:\n  - npm install\n  - npm test\n\n- name: backend\n  image: golang\n  commands:\n  - go build\n  - go test\n", droneConfig.Data; want != got {
+		t.Errorf("Want %q got %q", want, got)
+	}
+}
+
+func TestOrderPath(t *testing.T) {
+	ts := newTestServer(testMux())
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithConcat(true),
+		WithOrder(orderPath),
+		WithSourcesComment(true),
+	)
+	droneConfig, err := plugin.Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if want, got := "# drone-tree-config sources:\n# - /.drone.yml\n# - /a/b/.drone.yml\n---\nkind: pipeline\nname: default\n\nsteps:\n- name: frontend\n", droneConfig.Data; !strings.HasPrefix(got, want) {
+		t.Errorf("Want prefix %q got %q", want, got)
+	}
+	if !strings.HasSuffix(droneConfig.Data, "  - go test -v\n") {
+		t.Errorf("Want the /a/b config last got %q", droneConfig.Data)
+	}
+}
+
+func TestConfigDir(t *testing.T) {
+	mux := testMux()
+	files := map[string]string{
+		"/repos/foosinn/dronetest/contents/a/b/c/d":                   "testdata/a_b_c_d.json",
+		"/repos/foosinn/dronetest/contents/a/b/c/d/.drone":            "testdata/a_b_c_d_.drone.json",
+		"/repos/foosinn/dronetest/contents/a/b/c/d/.drone/build.yml":  "testdata/a_b_.drone.yml.json",
+		"/repos/foosinn/dronetest/contents/a/b/c/d/.drone/deploy.yml": "testdata/.drone.yml.json",
+	}
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if file, ok := files[r.URL.Path]; ok {
+			f, _ := os.Open(file)
+			_, _ = io.Copy(w, f)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithConfigDir(".drone"),
+		WithSourcesComment(true),
+	)
+	droneConfig, err := plugin.Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if want, got := "# drone-tree-config sources:\n# - /a/b/c/d/.drone/build.yml\n# - /a/b/c/d/.drone/deploy.yml\n---\n", droneConfig.Data; !strings.HasPrefix(got, want) {
+		t.Errorf("Want prefix %q got %q", want, got)
+	}
+	if !strings.Contains(droneConfig.Data, "- name: integration\n") || !strings.Contains(droneConfig.Data, "- name: frontend\n") {
+		t.Errorf("Want both fragments got %q", droneConfig.Data)
+	}
+}
+
+func TestMaxFileSize(t *testing.T) {
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/repos/foosinn/dronetest/contents/.drone.yml" {
+			content := "kind: pipeline\nname: default\n# " + strings.Repeat("x", 4096) + "\n"
+			_ = json.NewEncoder(w).Encode(map[string]string{
+				"name":     ".drone.yml",
+				"path":     ".drone.yml",
+				"type":     "file",
+				"content":  base64.StdEncoding.EncodeToString([]byte(content)),
+				"encoding": "base64",
+			})
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			After:   "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+			Trigger: "@cron",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithMaxFileSize(1024),
+	)
+	_, err := plugin.Find(noContext, req)
+	if want, got := errFileTooLarge, err; want != got {
+		t.Errorf("Want %v got %v", want, got)
+	}
+}
+
+func TestMaxFileSizeResponse(t *testing.T) {
+	// the padding makes the responses larger than allowed for the small files
+	padding := strings.Repeat("x", 1<<20)
+	files := map[string]string{
+		"foosinn/dronetest/a/.drone.yml": "kind: pipeline\nname: default\n",
+		"foosinn/dronetest/b/.drone.yml": "kind: pipeline\nname: default\n# include-repo: org/drone-shared ci/steps.yml\n",
+		"org/drone-shared/ci/steps.yml":  "- name: build\n",
+	}
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.Replace(strings.TrimPrefix(r.URL.Path, "/repos/"), "/contents/", "/", 1)
+		if content, ok := files[key]; ok {
+			_, _ = fmt.Fprintf(w, `{"type": "file", "path": %q, "content": %q, "padding": %q}`, key, base64.StdEncoding.EncodeToString([]byte(content)), padding)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	for _, changed := range []string{"a/file", "b/file"} {
+		req := &config.Request{
+			Build: drone.Build{
+				After: "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+			},
+			Repo: drone.Repo{
+				Namespace: "foosinn",
+				Name:      "dronetest",
+				Slug:      "foosinn/dronetest",
+				Config:    ".drone.yml",
+			},
+		}
+		plugin := New(
+			WithServer(ts.URL),
+			WithToken(mockToken),
+			WithUpMaxDepth(1),
+			WithIncludes(true),
+			WithIncludeRepos([]string{"org/*"}),
+			WithMaxFileSize(1024),
+		)
+		_, err := plugin.(Validator).Validate(noContext, req, []string{changed})
+		if err == nil || !strings.Contains(err.Error(), errFileTooLarge.Error()) {
+			t.Errorf("%s: want %v got %v", changed, errFileTooLarge, err)
+		}
+	}
+}
+
+func TestMaxConfigSize(t *testing.T) {
+	ts := newTestServer(testMux())
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			After:   "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+			Trigger: "@cron",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithConcat(true),
+		WithMaxFileSize(1024),
+		WithMaxConfigSize(300),
+	)
+	_, err := plugin.Find(noContext, req)
+	if want, got := errConfigTooLarge, err; want != got {
+		t.Errorf("Want %v got %v", want, got)
+	}
+}
+
+func TestDeepestOnly(t *testing.T) {
+	ts := newTestServer(testMux())
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	for _, tc := range []struct {
+		alwaysRoot bool
+		want       string
+	}{
+		{false, "# drone-tree-config sources:\n# - /a/b/.drone.yml\n---\n"},
+		{true, "# drone-tree-config sources:\n# - /a/b/.drone.yml\n# - /.drone.yml\n---\n"},
+	} {
+		plugin := New(
+			WithServer(ts.URL),
+			WithToken(mockToken),
+			WithConcat(true),
+			WithDeepestOnly(true),
+			WithAlwaysRoot(tc.alwaysRoot),
+			WithSourcesComment(true),
+		)
+		droneConfig, err := plugin.Find(noContext, req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if want, got := tc.want, droneConfig.Data; !strings.HasPrefix(got, want) {
+			t.Errorf("Want prefix %q got %q", want, got)
+		}
+	}
+}
+
+func TestAlwaysRoot(t *testing.T) {
+	ts := newTestServer(testMux())
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithConcat(true),
+		WithUpMaxDepth(3),
+		WithAlwaysRoot(true),
+		WithSourcesComment(true),
+	)
+	droneConfig, err := plugin.Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if want, got := "# drone-tree-config sources:\n# - /a/b/.drone.yml\n# - /.drone.yml\n---\n", droneConfig.Data; !strings.HasPrefix(got, want) {
+		t.Errorf("Want prefix %q got %q", want, got)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	mux := testMux()
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{}, 16)
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/repos/foosinn/dronetest/contents/") {
+			// hang until the client gives up
+			started <- struct{}{}
+			select {
+			case <-r.Context().Done():
+			case <-release:
+			}
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithConcat(true),
+		WithConcurrency(1),
+		WithRetry(3, time.Second),
+	)
+
+	ctx, cancel := context.WithCancel(noContext)
+	go func() {
+		<-started
+		cancel()
+	}()
+	start := time.Now()
+	droneConfig, err := plugin.Find(ctx, req)
+	if want, got := context.Canceled, err; want != got {
+		t.Errorf("Want %v got %v %v", want, got, droneConfig)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Want an early return got %s", elapsed)
+	}
+}
+
+func TestTokenScheme(t *testing.T) {
+	tests := []struct {
+		scheme string
+		header string
+		want   string
+	}{
+		{tokenSchemeBearer, "Authorization", "Bearer " + mockToken},
+		{tokenSchemeToken, "Authorization", "token " + mockToken},
+		{tokenSchemePrivateToken, "Private-Token", mockToken},
+	}
+	for _, test := range tests {
+		ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get(test.header) != test.want {
+				w.WriteHeader(http.StatusUnauthorized)
+				_, _ = io.WriteString(w, `{"message": "Bad credentials"}`)
+				return
+			}
+			_, _ = io.WriteString(w, `{"login": "foosinn"}`)
+		}))
+
+		plugin := New(
+			WithServer(ts.URL),
+			WithToken(mockToken),
+			WithTokenScheme(test.scheme),
+		)
+		if err := plugin.(Checker).Check(noContext); err != nil {
+			t.Errorf("%s: %v", test.scheme, err)
+		}
+		ts.Close()
+	}
+}
+
+func TestNewBranch(t *testing.T) {
+	var compared, listed int32
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/repos/foosinn/dronetest/compare/"):
+			atomic.AddInt32(&compared, 1)
+		case strings.HasPrefix(r.URL.Path, "/repos/foosinn/dronetest/commits/"):
+			atomic.AddInt32(&listed, 1)
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		before   string
+		compared int32
+		listed   int32
+	}{
+		{"2897b31ec3a1b59279a08a8ad54dc360686327f7", 1, 0},
+		{"0000000000000000000000000000000000000000", 0, 1},
+		{"", 0, 1},
+	}
+	for _, test := range tests {
+		atomic.StoreInt32(&compared, 0)
+		atomic.StoreInt32(&listed, 0)
+		req := &config.Request{
+			Build: drone.Build{
+				Before: test.before,
+				After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+				Ref:    "refs/heads/feature/foo",
+			},
+			Repo: drone.Repo{
+				Namespace: "foosinn",
+				Name:      "dronetest",
+				Slug:      "foosinn/dronetest",
+				Config:    ".drone.yml",
+			},
+		}
+		plugin := New(
+			WithServer(ts.URL),
+			WithToken(mockToken),
+		)
+		droneConfig, err := plugin.Find(noContext, req)
+		if err != nil || droneConfig == nil {
+			t.Errorf("%q: want a config got %v %v", test.before, droneConfig, err)
+		}
+		if atomic.LoadInt32(&compared) != test.compared || atomic.LoadInt32(&listed) != test.listed {
+			t.Errorf("%q: want %d compare and %d commit requests got %d and %d", test.before,
+				test.compared, test.listed, atomic.LoadInt32(&compared), atomic.LoadInt32(&listed))
+		}
+	}
+}
+
+func TestPagination(t *testing.T) {
+	var pages int32
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/foosinn/dronetest/pulls/5/files" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		atomic.AddInt32(&pages, 1)
+		files := map[string]string{"": "README.md", "2": "docs/index.md", "3": "a/b/main.go"}
+		page := r.URL.Query().Get("page")
+		if next := map[string]string{"": "2", "2": "3"}[page]; next != "" {
+			w.Header().Set("Link", fmt.Sprintf(`<%s?page=%s>; rel="next"`, r.URL.Path, next))
+		}
+		fmt.Fprintf(w, `[{"filename": "%s", "status": "modified"}]`, files[page])
+	}))
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+			Ref:    "refs/pull/5/head",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithConcat(true),
+		WithSourcesComment(true),
+	)
+	droneConfig, err := plugin.Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if want, got := int32(3), atomic.LoadInt32(&pages); want != got {
+		t.Errorf("Want %d pages got %d", want, got)
+	}
+	if want, got := "# drone-tree-config sources:\n# - /.drone.yml\n# - /a/b/.drone.yml\n---\n", droneConfig.Data; !strings.HasPrefix(got, want) {
+		t.Errorf("Want prefix %q got %q", want, got)
+	}
+}
+
+func TestListChangesPages(t *testing.T) {
+	p := New().(*plugin)
+	req := p.newRequest(noContext, &config.Request{Repo: drone.Repo{Slug: "foosinn/dronetest"}})
+
+	// bitbucket numbers and links the next page, the number is used
+	requested := []int{}
+	changes, err := p.listChanges(noContext, req, "list changes", func(opts scm.ListOptions) ([]*scm.Change, *scm.Response, error) {
+		requested = append(requested, opts.Page)
+		res := &scm.Response{Status: http.StatusOK}
+		if opts.Page < 2 {
+			res.Page = scm.Page{Next: 2, NextURL: "https://api.bitbucket.org/2.0/diffstat?page=2"}
+		}
+		return []*scm.Change{{Path: fmt.Sprintf("page%d/file", opts.Page)}}, res, nil
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if want, got := []int{0, 2}, requested; !reflect.DeepEqual(want, got) {
+		t.Errorf("Want pages %v got %v", want, got)
+	}
+	if want, got := 2, len(changes); want != got {
+		t.Errorf("Want %d changes got %d", want, got)
+	}
+}
+
+func TestRequestIDHeader(t *testing.T) {
+	ids := make(chan string, 64)
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ids <- r.Header.Get("X-Request-Id")
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithRequestIDHeader("X-Request-Id"),
+	)
+	if _, err := plugin.Find(noContext, req); err != nil {
+		t.Error(err)
+		return
+	}
+	close(ids)
+
+	first := <-ids
+	if _, err := uuid.Parse(first); err != nil {
+		t.Errorf("Want a uuid got %q", first)
+	}
+	for id := range ids {
+		if id != first {
+			t.Errorf("Want %s for every request got %s", first, id)
+		}
+	}
+}
+
+func TestSingleConfig(t *testing.T) {
+	var requests int32
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithConcat(true),
+		WithSingleConfig(true),
+	)
+	droneConfig, err := plugin.Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if want, got := "---\nkind: pipeline\nname: default\n\nsteps:\n- name: frontend\n  image: node\n  commands:\n  - npm install\n  - npm test\n\n- name: backend\n  image: golang\n  commands:\n  - go build\n  - go test\n", droneConfig.Data; want != got {
+		t.Errorf("Want %q got %q", want, got)
+	}
+	if want, got := int32(1), atomic.LoadInt32(&requests); want != got {
+		t.Errorf("Want %d scm request got %d", want, got)
+	}
+}
+
+func TestIgnoredConfigs(t *testing.T) {
+	req := &request{sources: []string{"/a/b/.drone.yml"}}
+	results := map[string]droneConfigResult{
+		"/a/b/.drone.yml": {content: "kind: pipeline"},
+		"/a/.drone.yml":   {err: errFileNotFound},
+		"/.drone.yml":     {content: "kind: pipeline"},
+	}
+	got := ignoredConfigs(req, []string{"/a/b", "/a", "/"}, []string{".drone.yml"}, results)
+	if want := []string{"/.drone.yml"}; !reflect.DeepEqual(want, got) {
+		t.Errorf("Want %v got %v", want, got)
+	}
+}
+
+func TestForceRange(t *testing.T) {
+	ts := newTestServer(testMux())
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			After:   "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+			Trigger: "@cron",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithForceRange("2897b31ec3a1b59279a08a8ad54dc360686327f7", ""),
+		WithSourcesComment(true),
+	)
+	droneConfig, err := plugin.Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if want, got := "# drone-tree-config sources:\n# - /a/b/.drone.yml\n---\n", droneConfig.Data; !strings.HasPrefix(got, want) {
+		t.Errorf("Want prefix %q got %q", want, got)
+	}
+}
+
+func TestSameDirectoryOnly(t *testing.T) {
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/repos/foosinn/dronetest/pulls/7/files" {
+			_, _ = io.WriteString(w, `[{"filename": "a/b/main.go", "status": "modified"}, {"filename": "a/c/d/main.go", "status": "modified"}]`)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+			Ref:    "refs/pull/7/head",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+
+	// only the directories of the changed files are checked, not the root
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithConcat(true),
+		WithUpMaxDepth(1),
+		WithSourcesComment(true),
+	)
+	droneConfig, err := plugin.Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if want, got := "# drone-tree-config sources:\n# - /a/b/.drone.yml\n---\n", droneConfig.Data; !strings.HasPrefix(got, want) {
+		t.Errorf("Want prefix %q got %q", want, got)
+	}
+}
+
+func TestConfigIsDirectory(t *testing.T) {
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/repos/foosinn/dronetest/contents/a/b" {
+			_, _ = io.WriteString(w, `[{"type": "dir", "name": ".drone.yml", "path": "a/b/.drone.yml"}]`)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+	)
+	_, err := plugin.Find(noContext, req)
+	if want, got := errIsDirectory, err; want != got {
+		t.Errorf("Want %v got %v", want, got)
+	}
+}
+
+func TestTokens(t *testing.T) {
+	var mu sync.Mutex
+	seen := map[string]int{}
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen[r.Header.Get("Authorization")]++
+		mu.Unlock()
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	plugin := New(
+		WithServer(ts.URL),
+		WithTokens([]string{"first", " second ", ""}),
+	)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := &config.Request{
+				Build: drone.Build{
+					Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+					After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+				},
+				Repo: drone.Repo{
+					Namespace: "foosinn",
+					Name:      "dronetest",
+					Slug:      "foosinn/dronetest",
+					Config:    ".drone.yml",
+				},
+			}
+			if _, err := plugin.Find(noContext, req); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(seen) != 2 || seen["Bearer first"] == 0 || seen["Bearer second"] == 0 {
+		t.Errorf("Want requests with both tokens, got %v", seen)
+	}
+}
+
+func TestPullRequestCache(t *testing.T) {
+	var requests int32
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithPullRequestCacheTTL(time.Minute),
+	)
+	find := func(after string) string {
+		req := &config.Request{
+			Build: drone.Build{
+				After: after,
+				Ref:   "refs/pull/3/head",
+			},
+			Repo: drone.Repo{
+				Namespace: "foosinn",
+				Name:      "dronetest",
+				Slug:      "foosinn/dronetest",
+				Config:    ".drone.yml",
+			},
+		}
+		droneConfig, err := plugin.Find(noContext, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return droneConfig.Data
+	}
+
+	first := find("8ecad91991d5da985a2a8dd97cc19029dc1c2899")
+	resolved := atomic.LoadInt32(&requests)
+	if resolved == 0 {
+		t.Fatal("Want scm requests for the first build")
+	}
+	if got := find("8ecad91991d5da985a2a8dd97cc19029dc1c2899"); got != first {
+		t.Errorf("Want %q got %q", first, got)
+	}
+	if want, got := resolved, atomic.LoadInt32(&requests); want != got {
+		t.Errorf("Want %d scm requests for the cached build, got %d", want, got)
+	}
+
+	// a push to the pull request changes the head
+	find("2897b31ec3a1b59279a08a8ad54dc360686327f7")
+	if got := atomic.LoadInt32(&requests); got == resolved {
+		t.Error("Want scm requests after the head changed")
+	}
+}
+
+func TestFlatRepos(t *testing.T) {
+	ts := newTestServer(testMux())
+	defer ts.Close()
+
+	tests := []struct {
+		patterns []string
+		want     string
+	}{
+		{
+			[]string{"foosinn/*"},
+			"---\nkind: pipeline\nname: default\n\nsteps:\n- name: frontend\n  image: node\n  commands:\n  - npm install\n  - npm test\n\n- name: backend\n  image: golang\n  commands:\n  - go build\n  - go test\n",
+		},
+		{
+			[]string{"bitsbeats/*"},
+			"---\nkind: pipeline\nname: default\n\nsteps:\n- name: build\n  image: golang\n  commands:\n  - go build\n  - go test -short\n\n- name: integration\n  image: golang\n  commands:\n  - go test -v\n",
+		},
+	}
+	for _, test := range tests {
+		req := &config.Request{
+			Build: drone.Build{
+				Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+				After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+			},
+			Repo: drone.Repo{
+				Namespace: "foosinn",
+				Name:      "dronetest",
+				Slug:      "foosinn/dronetest",
+				Config:    ".drone.yml",
+			},
+		}
+		plugin := New(
+			WithServer(ts.URL),
+			WithToken(mockToken),
+			WithFlatRepos(test.patterns),
+		)
+		droneConfig, err := plugin.Find(noContext, req)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if want, got := test.want, droneConfig.Data; want != got {
+			t.Errorf("%v: want %q got %q", test.patterns, want, got)
+		}
+	}
+}
+
+func TestSkipInvalid(t *testing.T) {
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/repos/foosinn/dronetest/contents/a/b/.drone.yml" {
+			content := base64.StdEncoding.EncodeToString([]byte("kind: banana\nname: default\n"))
+			_, _ = fmt.Fprintf(w, `{"type": "file", "path": "a/b/.drone.yml", "content": %q}`, content)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	for _, skip := range []bool{false, true} {
+		req := &config.Request{
+			Build: drone.Build{
+				Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+				After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+			},
+			Repo: drone.Repo{
+				Namespace: "foosinn",
+				Name:      "dronetest",
+				Slug:      "foosinn/dronetest",
+				Config:    ".drone.yml",
+			},
+		}
+		plugin := New(
+			WithServer(ts.URL),
+			WithToken(mockToken),
+			WithConcat(true),
+			WithSkipInvalid(skip),
+		)
+		droneConfig, err := plugin.Find(noContext, req)
+		if !skip {
+			if err == nil {
+				t.Error("Want an error for the invalid config")
+			}
+			continue
+		}
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if want, got := "---\nkind: pipeline\nname: default\n\nsteps:\n- name: frontend\n  image: node\n  commands:\n  - npm install\n  - npm test\n\n- name: backend\n  image: golang\n  commands:\n  - go build\n  - go test\n", droneConfig.Data; want != got {
+			t.Errorf("Want %q got %q", want, got)
+		}
+	}
+}
+
+func TestRepoConfigPath(t *testing.T) {
+	var droneYml int32
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/foosinn/dronetest/contents/ci/pipeline.yaml":
+			f, _ := os.Open("testdata/.drone.yml.json")
+			_, _ = io.Copy(w, f)
+			return
+		case "/repos/foosinn/dronetest/contents/a/b/ci/pipeline.yaml":
+			f, _ := os.Open("testdata/a_b_.drone.yml.json")
+			_, _ = io.Copy(w, f)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/.drone.yml") {
+			atomic.AddInt32(&droneYml, 1)
+		}
+		if strings.HasSuffix(r.URL.Path, "/pipeline.yaml") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name    string
+		trigger string
+		want    string
+	}{
+		{
+			"changed files",
+			"",
+			"---\nkind: pipeline\nname: default\n\nsteps:\n- name: build\n  image: golang\n  commands:\n  - go build\n  - go test -short\n\n- name: integration\n  image: golang\n  commands:\n  - go test -v\n---\nkind: pipeline\nname: default\n\nsteps:\n- name: frontend\n  image: node\n  commands:\n  - npm install\n  - npm test\n\n- name: backend\n  image: golang\n  commands:\n  - go build\n  - go test\n",
+		},
+		{
+			"full scan",
+			"@cron",
+			"---\nkind: pipeline\nname: default\n\nsteps:\n- name: frontend\n  image: node\n  commands:\n  - npm install\n  - npm test\n\n- name: backend\n  image: golang\n  commands:\n  - go build\n  - go test\n",
+		},
+	}
+	for _, test := range tests {
+		req := &config.Request{
+			Build: drone.Build{
+				Before:  "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+				After:   "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+				Trigger: test.trigger,
+			},
+			Repo: drone.Repo{
+				Namespace: "foosinn",
+				Name:      "dronetest",
+				Slug:      "foosinn/dronetest",
+				Config:    "ci/pipeline.yaml",
+			},
+		}
+		plugin := New(
+			WithServer(ts.URL),
+			WithToken(mockToken),
+			WithConcat(true),
+			WithMaxDepth(2),
+		)
+		droneConfig, err := plugin.Find(noContext, req)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if want, got := test.want, droneConfig.Data; want != got {
+			t.Errorf("%s: want %q got %q", test.name, want, got)
+		}
+	}
+	if got := atomic.LoadInt32(&droneYml); got != 0 {
+		t.Errorf("Want no requests for .drone.yml got %d", got)
+	}
+}
+
+func TestMaxInflight(t *testing.T) {
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	var once sync.Once
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/repos/foosinn/dronetest/compare/") {
+			once.Do(func() { close(started) })
+			<-unblock
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	newReq := func() *config.Request {
+		return &config.Request{
+			Build: drone.Build{
+				Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+				After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+			},
+			Repo: drone.Repo{
+				Namespace: "foosinn",
+				Name:      "dronetest",
+				Slug:      "foosinn/dronetest",
+				Config:    ".drone.yml",
+			},
+		}
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithMaxInflight(1, 50*time.Millisecond),
+	)
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := plugin.Find(noContext, newReq())
+		errs <- err
+	}()
+	<-started
+
+	if _, err := plugin.Find(noContext, newReq()); err != errTooManyInflight {
+		t.Errorf("Want %v got %v", errTooManyInflight, err)
+	}
+	close(unblock)
+	if err := <-errs; err != nil {
+		t.Error(err)
+	}
+
+	// the slot is released after the first request finished
+	if _, err := plugin.Find(noContext, newReq()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFullScanTriggers(t *testing.T) {
+	ts := newTestServer(testMux())
+	defer ts.Close()
+
+	tests := []struct {
+		triggers []string
+		want     string
+	}{
+		{
+			[]string{"@cron"},
+			"---\nkind: pipeline\nname: default\n\nsteps:\n- name: build\n  image: golang\n  commands:\n  - go build\n  - go test -short\n\n- name: integration\n  image: golang\n  commands:\n  - go test -v\n---\nkind: pipeline\nname: default\n\nsteps:\n- name: frontend\n  image: node\n  commands:\n  - npm install\n  - npm test\n\n- name: backend\n  image: golang\n  commands:\n  - go build\n  - go test\n",
+		},
+		{
+			[]string{"@cron", "@promote"},
+			"---\nkind: pipeline\nname: default\n\nsteps:\n- name: frontend\n  image: node\n  commands:\n  - npm install\n  - npm test\n\n- name: backend\n  image: golang\n  commands:\n  - go build\n  - go test\n---\nkind: pipeline\nname: default\n\nsteps:\n- name: build\n  image: golang\n  commands:\n  - go build\n  - go test -short\n\n- name: integration\n  image: golang\n  commands:\n  - go test -v\n",
+		},
+	}
+	for _, test := range tests {
+		req := &config.Request{
+			Build: drone.Build{
+				Before:  "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+				After:   "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+				Event:   "promote",
+				Trigger: "octocat",
+			},
+			Repo: drone.Repo{
+				Namespace: "foosinn",
+				Name:      "dronetest",
+				Slug:      "foosinn/dronetest",
+				Config:    ".drone.yml",
+			},
+		}
+		plugin := New(
+			WithServer(ts.URL),
+			WithToken(mockToken),
+			WithConcat(true),
+			WithMaxDepth(2),
+			WithFullScanTriggers(test.triggers),
+		)
+		droneConfig, err := plugin.Find(noContext, req)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if want, got := test.want, droneConfig.Data; want != got {
+			t.Errorf("%v: want %q got %q", test.triggers, want, got)
+		}
+	}
+}
+
+func TestNearestConfigWins(t *testing.T) {
+	for _, tc := range []struct {
+		files string
+		want  string
+	}{
+		// every service contributes its nearest config, the root is skipped
+		{
+			`[{"filename": "a/b/c/d/file"}, {"filename": "afolder/main.go"}]`,
+			"# drone-tree-config sources:\n# - /a/b/.drone.yml\n# - /afolder/.drone.yml\n---\n",
+		},
+		// files of the same service add neither the parents nor the root
+		{
+			`[{"filename": "a/b/c/d/file"}, {"filename": "a/b/x"}]`,
+			"# drone-tree-config sources:\n# - /a/b/.drone.yml\n---\n",
+		},
+		// the root config is the fallback of files without a service config
+		{
+			`[{"filename": "a/b/c/d/file"}, {"filename": "docs/index.md"}]`,
+			"# drone-tree-config sources:\n# - /a/b/.drone.yml\n# - /.drone.yml\n---\n",
+		},
+	} {
+		mux := testMux()
+		ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case strings.HasPrefix(r.URL.Path, "/repos/foosinn/dronetest/compare/"):
+				_, _ = fmt.Fprintf(w, `{"files": %s}`, tc.files)
+			case r.URL.Path == "/repos/foosinn/dronetest/contents/docs":
+				_, _ = io.WriteString(w, `[{"type": "file", "name": "index.md", "path": "docs/index.md"}]`)
+			case r.URL.Path == "/repos/foosinn/dronetest/contents/afolder/.drone.yml":
+				content := base64.StdEncoding.EncodeToString([]byte("kind: pipeline\nname: afolder\n"))
+				_, _ = fmt.Fprintf(w, `{"type": "file", "path": "afolder/.drone.yml", "content": %q}`, content)
+			default:
+				mux.ServeHTTP(w, r)
+			}
+		}))
+
+		req := &config.Request{
+			Build: drone.Build{
+				Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+				After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+			},
+			Repo: drone.Repo{
+				Namespace: "foosinn",
+				Name:      "dronetest",
+				Slug:      "foosinn/dronetest",
+				Config:    ".drone.yml",
+			},
+		}
+		plugin := New(
+			WithServer(ts.URL),
+			WithToken(mockToken),
+			WithConcat(true),
+			WithDeepestOnly(true),
+			WithSourcesComment(true),
+		)
+		droneConfig, err := plugin.Find(noContext, req)
+		ts.Close()
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if want, got := tc.want, droneConfig.Data; !strings.HasPrefix(got, want) {
+			t.Errorf("Want prefix %q got %q", want, got)
+		}
+	}
+}
+
+func TestScmRequestCount(t *testing.T) {
+	var requests int32
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		mux.ServeHTTP(w, r)
+	}))
 	defer ts.Close()
 
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
 	req := &config.Request{
 		Build: drone.Build{
-			Fork: "octocat/dronetest",
-			Ref:  "refs/pull/3/head",
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		},
+		Repo: drone.Repo{
+			Namespace: "requests",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+	)
+	if _, err := plugin.Find(noContext, req); err != nil {
+		t.Fatal(err)
+	}
+
+	var logged interface{}
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "finished" {
+			logged = entry.Data["scm_requests"]
+		}
+	}
+	if want, got := atomic.LoadInt32(&requests), logged; want != got {
+		t.Errorf("Want %v scm requests logged got %v", want, got)
+	}
+}
+
+func TestBOMAndCRLF(t *testing.T) {
+	for _, fixture := range []string{"testdata/a_b_.drone.yml_bom.json", "testdata/a_b_.drone.yml_crlf.json"} {
+		mux := testMux()
+		ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/repos/foosinn/dronetest/contents/a/b/.drone.yml" {
+				f, _ := os.Open(fixture)
+				_, _ = io.Copy(w, f)
+				return
+			}
+			mux.ServeHTTP(w, r)
+		}))
+
+		req := &config.Request{
+			Build: drone.Build{
+				Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+				After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+			},
+			Repo: drone.Repo{
+				Namespace: "foosinn",
+				Name:      "dronetest",
+				Slug:      "foosinn/dronetest",
+				Config:    ".drone.yml",
+			},
+		}
+		plugin := New(
+			WithServer(ts.URL),
+			WithToken(mockToken),
+			WithConcat(true),
+		)
+		droneConfig, err := plugin.Find(noContext, req)
+		ts.Close()
+		if err != nil {
+			t.Errorf("%s: %v", fixture, err)
+			continue
+		}
+
+		if want, got := "---\nkind: pipeline\nname: default\n\nsteps:\n- name: build\n  image: golang\n  commands:\n  - go build\n  - go test -short\n\n- name: integration\n  image: golang\n  commands:\n  - go test -v\n---\nkind: pipeline\nname: default\n\nsteps:\n- name: frontend\n  image: node\n  commands:\n  - npm install\n  - npm test\n\n- name: backend\n  image: golang\n  commands:\n  - go build\n  - go test\n", droneConfig.Data; want != got {
+			t.Errorf("%s: want %q got %q", fixture, want, got)
+		}
+	}
+}
+
+func TestGlobalConfigs(t *testing.T) {
+	ts := newTestServer(testMux())
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	prepend := "kind: pipeline\nname: policy\n"
+	append := "kind: pipeline\nname: notify\ndepends_on:\n- default\n"
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithExclude([]string{"a/**"}),
+		WithFallbackConfig("/afolder/.drone.yml"),
+		WithGlobalConfigs(prepend, append),
+	)
+	droneConfig, err := plugin.Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if want, got := "---\nkind: pipeline\nname: policy\n---\nkind: pipeline\nname: default\n\nsteps:\n- name: build\n  image: golang\n  commands:\n  - go build\n  - go test -short\n\n- name: integration\n  image: golang\n  commands:\n  - go test -v\n---\nkind: pipeline\nname: notify\ndepends_on:\n- default\n", droneConfig.Data; want != got {
+		t.Errorf("Want %q got %q", want, got)
+	}
+
+	// repositories without a config are left to drone
+	plugin = New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithExclude([]string{"**"}),
+		WithGlobalConfigs(prepend, append),
+	)
+	droneConfig, err = plugin.Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if droneConfig != nil {
+		t.Errorf("Want no config got %q", droneConfig.Data)
+	}
+}
+
+func TestEmptyConfig(t *testing.T) {
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/repos/foosinn/dronetest/contents/a/b/.drone.yml" {
+			fmt.Fprintf(w, `{"type": "file", "path": "a/b/.drone.yml", "content": %q}`, base64.StdEncoding.EncodeToString([]byte(" \n\n\t\n")))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
 		},
 		Repo: drone.Repo{
 			Namespace: "foosinn",
@@ -91,26 +2535,30 @@ func TestPullRequest(t *testing.T) {
 			Config:    ".drone.yml",
 		},
 	}
-	plugin := New(ts.URL, mockToken, true, true, 2)
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+	)
 	droneConfig, err := plugin.Find(noContext, req)
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
+	// the walk continues past the empty file up to the root config
 	if want, got := "---\nkind: pipeline\nname: default\n\nsteps:\n- name: frontend\n  image: node\n  commands:\n  - npm install\n  - npm test\n\n- name: backend\n  image: golang\n  commands:\n  - go build\n  - go test\n", droneConfig.Data; want != got {
 		t.Errorf("Want %q got %q", want, got)
 	}
 }
 
-func TestCron(t *testing.T) {
-	ts := httptest.NewServer(testMux())
+func TestEmitDigest(t *testing.T) {
+	ts := newTestServer(testMux())
 	defer ts.Close()
 
 	req := &config.Request{
 		Build: drone.Build{
-			After:   "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
-			Trigger: "@cron",
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
 		},
 		Repo: drone.Repo{
 			Namespace: "foosinn",
@@ -119,22 +2567,389 @@ func TestCron(t *testing.T) {
 			Config:    ".drone.yml",
 		},
 	}
-	plugin := New(ts.URL, mockToken, false, true, 2)
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithConcat(true),
+		WithEmitDigest(true),
+	)
 	droneConfig, err := plugin.Find(noContext, req)
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
+	i := strings.LastIndex(strings.TrimSuffix(droneConfig.Data, "\n"), "\n") + 1
+	configData, comment := droneConfig.Data[:i], droneConfig.Data[i:]
+	want := fmt.Sprintf(
+		"# drone-tree-config digest: config=sha256:%x sources=sha256:%x\n",
+		sha256.Sum256([]byte(configData)),
+		sha256.Sum256([]byte("/.drone.yml\n/a/b/.drone.yml")),
+	)
+	if want != comment {
+		t.Errorf("Want %q got %q", want, comment)
+	}
+
+	// the digest is stable between runs
+	again, err := plugin.Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if droneConfig.Data != again.Data {
+		t.Errorf("Want %q got %q", droneConfig.Data, again.Data)
+	}
+}
+
+func TestFailClosed(t *testing.T) {
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/repos/foosinn/dronetest/contents/a/b/.drone.yml":
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"message": "Bad credentials"}`)
+			return
+		case r.URL.Path != "/repos/foosinn/dronetest/contents/.drone.yml" && strings.HasSuffix(r.URL.Path, "/.drone.yml"):
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message": "Not Found"}`)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+
+	// by default the failed file is skipped like a missing one
+	droneConfig, err := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+	).Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
 	if want, got := "---\nkind: pipeline\nname: default\n\nsteps:\n- name: frontend\n  image: node\n  commands:\n  - npm install\n  - npm test\n\n- name: backend\n  image: golang\n  commands:\n  - go build\n  - go test\n", droneConfig.Data; want != got {
 		t.Errorf("Want %q got %q", want, got)
 	}
+
+	// the fallback config must not hide the failed request
+	_, err = New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithFailClosed(true),
+		WithFallbackConfig("/afolder/.drone.yml"),
+	).Find(noContext, req)
+	if err == nil || !strings.Contains(err.Error(), "401 Unauthorized") {
+		t.Errorf("Want an error with the status of the failed scm request got %v", err)
+	}
+
+	// drivers without content for failed requests report the status too
+	repo := &memoryRepo{changes: []string{"a/file"}}
+	_, err = New(
+		WithClientFactory(func(token, slug string) (*scm.Client, error) {
+			client, err := repo.client()(token, slug)
+			if err != nil {
+				return nil, err
+			}
+			client.Contents = &forbiddenContentService{}
+			return client, nil
+		}),
+		WithFailClosed(true),
+	).Find(noContext, req)
+	if err == nil || !strings.Contains(err.Error(), "403 Forbidden") {
+		t.Errorf("Want an error with the status of the failed scm request got %v", err)
+	}
+
+	// missing files are still skipped, e.g. a/b/c/d/.drone.yml
+	ok := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/foosinn/dronetest/contents/.drone.yml", "/repos/foosinn/dronetest/contents/a/b/.drone.yml":
+		default:
+			if strings.HasSuffix(r.URL.Path, "/.drone.yml") {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"message": "Not Found"}`)
+				return
+			}
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer ok.Close()
+	droneConfig, err = New(
+		WithServer(ok.URL),
+		WithToken(mockToken),
+		WithFailClosed(true),
+	).Find(noContext, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if droneConfig == nil {
+		t.Error("Want a config")
+	}
 }
 
-func TestCronConcat(t *testing.T) {
-	ts := httptest.NewServer(testMux())
+func TestPathPrefix(t *testing.T) {
+	compare, err := ioutil.ReadFile("testdata/compare.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/repos/foosinn/dronetest/compare/2897b31ec3a1b59279a08a8ad54dc360686327f7...8ecad91991d5da985a2a8dd97cc19029dc1c2899" {
+			_, _ = w.Write(bytes.Replace(compare, []byte(`"a/b/c/d/file"`), []byte(`"monorepo/a/b/c/d/file"`), -1))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	for _, prefix := range []string{"monorepo", "/monorepo/"} {
+		plugin := New(
+			WithServer(ts.URL),
+			WithToken(mockToken),
+			WithConcat(true),
+			WithPathPrefix(prefix),
+		)
+		droneConfig, err := plugin.Find(noContext, req)
+		if err != nil {
+			t.Errorf("%s: %v", prefix, err)
+			continue
+		}
+
+		// the walk starts at a/b/c/d instead of monorepo/a/b/c/d
+		if want, got := "---\nkind: pipeline\nname: default\n\nsteps:\n- name: build\n  image: golang\n  commands:\n  - go build\n  - go test -short\n\n- name: integration\n  image: golang\n  commands:\n  - go test -v\n---\nkind: pipeline\nname: default\n\nsteps:\n- name: frontend\n  image: node\n  commands:\n  - npm install\n  - npm test\n\n- name: backend\n  image: golang\n  commands:\n  - go build\n  - go test\n", droneConfig.Data; want != got {
+			t.Errorf("%s: want %q got %q", prefix, want, got)
+		}
+	}
+
+	p := New(WithPathPrefix("monorepo/")).(*plugin)
+	for file, want := range map[string]string{
+		"monorepo/a/file":  "a/file",
+		"/monorepo/a/file": "a/file",
+		"monorepo2/a/file": "monorepo2/a/file",
+		"other/file":       "other/file",
+	} {
+		if got := p.stripPathPrefix(file); want != got {
+			t.Errorf("%s: want %s got %s", file, want, got)
+		}
+	}
+}
+
+func TestEventConfigs(t *testing.T) {
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/foosinn/dronetest/contents/a/b":
+			fmt.Fprint(w, `[{"type": "file", "path": "a/b/.drone.yml"}, {"type": "file", "path": "a/b/.drone.pr.yml"}, {"type": "dir", "path": "a/b/c"}]`)
+			return
+		case "/repos/foosinn/dronetest/contents/a/b/.drone.pr.yml":
+			content := "kind: pipeline\nname: pr\n"
+			fmt.Fprintf(w, `{"type": "file", "path": "a/b/.drone.pr.yml", "content": %q}`, base64.StdEncoding.EncodeToString([]byte(content)))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		event string
+		want  string
+	}{
+		{
+			"pull_request",
+			"---\nkind: pipeline\nname: pr\n---\nkind: pipeline\nname: default\n\nsteps:\n- name: frontend\n  image: node\n  commands:\n  - npm install\n  - npm test\n\n- name: backend\n  image: golang\n  commands:\n  - go build\n  - go test\n",
+		},
+		{
+			"push",
+			"---\nkind: pipeline\nname: default\n\nsteps:\n- name: build\n  image: golang\n  commands:\n  - go build\n  - go test -short\n\n- name: integration\n  image: golang\n  commands:\n  - go test -v\n---\nkind: pipeline\nname: default\n\nsteps:\n- name: frontend\n  image: node\n  commands:\n  - npm install\n  - npm test\n\n- name: backend\n  image: golang\n  commands:\n  - go build\n  - go test\n",
+		},
+	}
+	for _, test := range tests {
+		req := &config.Request{
+			Build: drone.Build{
+				Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+				After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+				Event:  test.event,
+			},
+			Repo: drone.Repo{
+				Namespace: "foosinn",
+				Name:      "dronetest",
+				Slug:      "foosinn/dronetest",
+				Config:    ".drone.yml",
+			},
+		}
+		plugin := New(
+			WithServer(ts.URL),
+			WithToken(mockToken),
+			WithConcat(true),
+			WithEventConfigs(true),
+		)
+		droneConfig, err := plugin.Find(noContext, req)
+		if err != nil {
+			t.Errorf("%s: %v", test.event, err)
+			continue
+		}
+		if want, got := test.want, droneConfig.Data; want != got {
+			t.Errorf("%s: want %q got %q", test.event, want, got)
+		}
+	}
+
+	for name, want := range map[string]string{
+		".drone.yml":       ".drone.pr.yml",
+		"ci/pipeline.yaml": "ci/pipeline.pr.yaml",
+		".drone":           ".drone.pr",
+		"Dronefile":        "Dronefile.pr",
+	} {
+		if got := eventConfigName(name, "pull_request"); want != got {
+			t.Errorf("%s: want %s got %s", name, want, got)
+		}
+	}
+}
+
+func TestPropagationRetry(t *testing.T) {
+	tests := []struct {
+		name    string
+		created int64
+		want    bool
+	}{
+		{"recent push", time.Now().Unix(), true},
+		{"old build", time.Now().Add(-time.Hour).Unix(), false},
+		{"unknown age", 0, false},
+	}
+	for _, test := range tests {
+		var requests int32
+		mux := testMux()
+		ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/repos/foosinn/dronetest/contents/.drone.yml" && atomic.AddInt32(&requests, 1) == 1 {
+				w.WriteHeader(http.StatusConflict)
+				fmt.Fprint(w, `{"message": "Git Repository is empty."}`)
+				return
+			}
+			mux.ServeHTTP(w, r)
+		}))
+
+		req := &config.Request{
+			Build: drone.Build{
+				After:   "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+				Created: test.created,
+			},
+			Repo: drone.Repo{
+				Namespace: "foosinn",
+				Name:      "dronetest",
+				Slug:      "foosinn/dronetest",
+				Config:    ".drone.yml",
+			},
+		}
+		plugin := New(
+			WithServer(ts.URL),
+			WithToken(mockToken),
+			WithSingleConfig(true),
+			WithPropagationRetry(10*time.Millisecond, time.Minute),
+		)
+		droneConfig, err := plugin.Find(noContext, req)
+		ts.Close()
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got := droneConfig != nil; test.want != got {
+			t.Errorf("%s: want a config %t got %t", test.name, test.want, got)
+		}
+	}
+}
+
+func TestPropagationRetryOnce(t *testing.T) {
+	var mu sync.Mutex
+	requests := map[string]int{}
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/repos/foosinn/dronetest/pulls/6/files":
+			_, _ = io.WriteString(w, `[{"filename": "a/file", "status": "modified"}, {"filename": "b/file", "status": "modified"}, {"filename": "c/file", "status": "modified"}]`)
+		case strings.HasSuffix(r.URL.Path, "/.drone.yml"):
+			mu.Lock()
+			requests[r.URL.Path]++
+			mu.Unlock()
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message": "Not Found"}`)
+		default:
+			mux.ServeHTTP(w, r)
+		}
+	}))
 	defer ts.Close()
 
+	req := &config.Request{
+		Build: drone.Build{
+			Before:  "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:   "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+			Ref:     "refs/pull/6/head",
+			Created: time.Now().Unix(),
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithConcurrency(1),
+		WithPropagationRetry(10*time.Millisecond, time.Minute),
+	)
+	if _, err := plugin.Find(noContext, req); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// only the first missing config is requested again after the delay
+	repeated := 0
+	for file, count := range requests {
+		if count > 2 {
+			t.Errorf("Want at most 2 requests for %s got %d", file, count)
+		}
+		if count == 2 {
+			repeated++
+		}
+	}
+	if len(requests) < 2 || repeated != 1 {
+		t.Errorf("Want one of several configs requested again got %v", requests)
+	}
+}
+
+func TestConfigExtensions(t *testing.T) {
+	repo := &memoryRepo{files: map[string]string{
+		"a/.drone/build.yml":     "kind: pipeline\nname: build\n",
+		"a/.drone/build.yml.bak": "kind: pipeline\nname: backup\n",
+		"a/.drone/deploy.yaml":   "kind: pipeline\nname: deploy\n",
+		"a/.drone/notes.txt":     "notes\n",
+		"a/.drone/test.star":     "def main(ctx):\n  return {'kind': 'pipeline', 'name': 'test'}\n",
+	}}
 	req := &config.Request{
 		Build: drone.Build{
 			After:   "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
@@ -147,15 +2962,287 @@ func TestCronConcat(t *testing.T) {
 			Config:    ".drone.yml",
 		},
 	}
-	plugin := New(ts.URL, mockToken, true, true, 2)
-	droneConfig, err := plugin.Find(noContext, req)
+
+	tests := []struct {
+		name    string
+		options []Option
+		want    []string
+	}{
+		{"default", nil, []string{"build", "deploy"}},
+		{"starlark", []Option{WithStarlark(true)}, []string{"build", "deploy", "test"}},
+		{"yml only", []Option{WithConfigExtensions([]string{"YML", " "})}, []string{"build"}},
+	}
+	for _, test := range tests {
+		options := append([]Option{
+			WithClientFactory(repo.client()),
+			WithConcat(true),
+			WithConfigDir(".drone"),
+		}, test.options...)
+		droneConfig, err := New(options...).Find(noContext, req)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got := pipelineNames(t, droneConfig.Data); !reflect.DeepEqual(test.want, got) {
+			t.Errorf("%s: want pipelines %v got %v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestForkPullRequest(t *testing.T) {
+	pipeline := func(w http.ResponseWriter, name string) {
+		content := "kind: pipeline\nname: " + name + "\n"
+		fmt.Fprintf(w, `{"type": "file", "path": ".drone.yml", "content": %q}`, base64.StdEncoding.EncodeToString([]byte(content)))
+	}
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/repos/octocat/dronetest/contents/.drone.yml":
+			pipeline(w, "fork")
+		case r.URL.Path == "/repos/foosinn/dronetest/contents/.drone.yml" && r.URL.Query().Get("ref") == "main":
+			pipeline(w, "main")
+		case r.URL.Path == "/repos/foosinn/dronetest/contents/.drone.yml":
+			pipeline(w, "head")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name    string
+		fork    string
+		mode    string
+		trusted []string
+		want    string
+	}{
+		{"same repository", "foosinn/dronetest", forkConfigsHead, nil, "head"},
+		{"fork default", "octocat/dronetest", "", nil, "head"},
+		{"fork head", "octocat/dronetest", forkConfigsHead, nil, "fork"},
+		{"fork base", "octocat/dronetest", forkConfigsBase, nil, "main"},
+		{"trusted fork base", "octocat/dronetest", forkConfigsBase, []string{"octocat/*"}, "fork"},
+	}
+	for _, test := range tests {
+		req := &config.Request{
+			Build: drone.Build{
+				After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+				Ref:    "refs/pull/3/head",
+				Fork:   test.fork,
+				Target: "main",
+			},
+			Repo: drone.Repo{
+				Namespace: "foosinn",
+				Name:      "dronetest",
+				Slug:      "foosinn/dronetest",
+				Config:    ".drone.yml",
+			},
+		}
+		plugin := New(
+			WithServer(ts.URL),
+			WithToken(mockToken),
+			WithSingleConfig(true),
+			WithForkConfigs(test.mode, test.trusted),
+		)
+		droneConfig, err := plugin.Find(noContext, req)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if want, got := "---\nkind: pipeline\nname: "+test.want+"\n", droneConfig.Data; want != got {
+			t.Errorf("%s: want %q got %q", test.name, want, got)
+		}
+	}
+}
+
+func TestEmptyCommitFullScan(t *testing.T) {
+	files := map[string]string{
+		".drone.yml":   "kind: pipeline\nname: root\n",
+		"a/.drone.yml": "kind: pipeline\nname: a\n",
+		"a/file":       "",
+	}
+	tests := []struct {
+		name    string
+		changes []string
+		exclude []string
+		want    []string
+	}{
+		{"empty merge commit", nil, nil, []string{"root", "a"}},
+		{"excluded changes", []string{"a/file"}, []string{"a/**"}, nil},
+	}
+	for _, test := range tests {
+		repo := &memoryRepo{files: files, changes: test.changes}
+		req := &config.Request{
+			Build: drone.Build{
+				Before:  "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+				After:   "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+				Message: "Merge branch 'feature'",
+			},
+			Repo: drone.Repo{
+				Namespace: "foosinn",
+				Name:      "dronetest",
+				Slug:      "foosinn/dronetest",
+				Config:    ".drone.yml",
+			},
+		}
+
+		// without the option empty commits have no config
+		droneConfig, err := New(
+			WithClientFactory(repo.client()),
+			WithExclude(test.exclude),
+		).Find(noContext, req)
+		if err != nil || droneConfig != nil {
+			t.Errorf("%s: want no config got %v, %v", test.name, droneConfig, err)
+		}
+
+		droneConfig, err = New(
+			WithClientFactory(repo.client()),
+			WithConcat(true),
+			WithExclude(test.exclude),
+			WithEmptyCommitFullScan(true),
+		).Find(noContext, req)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if test.want == nil {
+			if droneConfig != nil {
+				t.Errorf("%s: want no config got %q", test.name, droneConfig.Data)
+			}
+			continue
+		}
+		if droneConfig == nil {
+			t.Errorf("%s: want a config", test.name)
+			continue
+		}
+		if got := pipelineNames(t, droneConfig.Data); !reflect.DeepEqual(test.want, got) {
+			t.Errorf("%s: want pipelines %v got %v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/repos/foosinn/dronetest/compare/") {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"message": "Resource not accessible by integration"}`)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	_, err := New(WithServer(ts.URL), WithToken(mockToken)).Find(noContext, req)
+	if err == nil {
+		t.Error("Want an error for a forbidden diff")
+		return
+	}
+	if want := "compare changes: 403 Forbidden: "; !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("Want an error starting with %q got %q", want, err.Error())
+	}
+}
+
+// forbiddenContentService rejects every content request like a token
+// without access, the content is nil like most drivers return it
+type forbiddenContentService struct {
+	scm.ContentService
+}
+
+func (s *forbiddenContentService) Find(ctx context.Context, repo, file, ref string) (*scm.Content, *scm.Response, error) {
+	return nil, &scm.Response{Status: http.StatusForbidden}, errors.New("Resource not accessible by integration")
+}
+
+func (s *forbiddenContentService) List(ctx context.Context, repo, dir, ref string, opts scm.ListOptions) ([]*scm.ContentInfo, *scm.Response, error) {
+	return nil, &scm.Response{Status: http.StatusForbidden}, errors.New("Resource not accessible by integration")
+}
+
+func TestStatusErrorContents(t *testing.T) {
+	p := New(WithClientFactory(func(token, slug string) (*scm.Client, error) {
+		return &scm.Client{Contents: &forbiddenContentService{}}, nil
+	})).(*plugin)
+	client, err := p.scmClient("", "foosinn/dronetest")
 	if err != nil {
 		t.Error(err)
 		return
 	}
+	req := &request{
+		Log: logrus.NewEntry(logrus.StandardLogger()),
+		Request: &config.Request{
+			Build: drone.Build{After: "8ecad91991d5da985a2a8dd97cc19029dc1c2899"},
+			Repo:  drone.Repo{Slug: "foosinn/dronetest"},
+		},
+		Client:  client,
+		missing: newMissingFiles(),
+	}
+	_, err = p.getScmFile(noContext, req, "/.drone.yml")
+	if err == nil {
+		t.Error("Want an error for a forbidden file")
+		return
+	}
+	if want := "get /.drone.yml: 403 Forbidden: "; !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("Want an error starting with %q got %q", want, err.Error())
+	}
+}
 
-	if want, got := "---\nkind: pipeline\nname: default\n\nsteps:\n- name: frontend\n  image: node\n  commands:\n  - npm install\n  - npm test\n\n- name: backend\n  image: golang\n  commands:\n  - go build\n  - go test\n---\nkind: pipeline\nname: default\n\nsteps:\n- name: build\n  image: golang\n  commands:\n  - go build\n  - go test -short\n\n- name: integration\n  image: golang\n  commands:\n  - go test -v\n", droneConfig.Data; want != got {
-		t.Errorf("Want %q got %q", want, got)
+func TestRequestUUID(t *testing.T) {
+	ids := make(chan string, 64)
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ids <- r.Header.Get("X-Request-Id")
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	generated := uuid.MustParse("00000000-0000-0000-0000-000000000001")
+	incoming := "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want string
+	}{
+		{"generated", noContext, generated.String()},
+		{"incoming", ContextWithRequestID(noContext, incoming), incoming},
+		{"invalid incoming", ContextWithRequestID(noContext, "drone-1"), generated.String()},
+	}
+	for _, test := range tests {
+		req := &config.Request{
+			Build: drone.Build{
+				Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+				After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+			},
+			Repo: drone.Repo{
+				Namespace: "foosinn",
+				Name:      "dronetest",
+				Slug:      "foosinn/dronetest",
+				Config:    ".drone.yml",
+			},
+		}
+		plugin := New(
+			WithServer(ts.URL),
+			WithToken(mockToken),
+			WithRequestIDHeader("X-Request-Id"),
+			WithUUIDGenerator(func() uuid.UUID { return generated }),
+		)
+		if _, err := plugin.Find(test.ctx, req); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		for len(ids) > 0 {
+			if id := <-ids; id != test.want {
+				t.Errorf("%s: want %s for every request got %s", test.name, test.want, id)
+			}
+		}
 	}
 }
 
@@ -186,6 +3273,11 @@ func testMux() *http.ServeMux {
 			f, _ := os.Open("testdata/.drone.yml.json")
 			_, _ = io.Copy(w, f)
 		})
+	mux.HandleFunc("/repos/foosinn/dronetest/contents/.drone.tmpl.yml",
+		func(w http.ResponseWriter, r *http.Request) {
+			f, _ := os.Open("testdata/.drone.tmpl.yml.json")
+			_, _ = io.Copy(w, f)
+		})
 	mux.HandleFunc("/repos/foosinn/dronetest/pulls/3/files",
 		func(w http.ResponseWriter, r *http.Request) {
 			f, _ := os.Open("testdata/pull_3_files.json")
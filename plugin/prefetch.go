@@ -0,0 +1,51 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/config"
+)
+
+// Prefetcher is implemented by plugins that can warm their cache ahead of the
+// builds
+type Prefetcher interface {
+	Prefetch(ctx context.Context, slug, sha, configPath string) error
+}
+
+// Prefetch scans the whole repository at the commit like a cron build to fill
+// the config cache, configPath defaults to .drone.yml
+func (p *plugin) Prefetch(ctx context.Context, slug, sha, configPath string) error {
+	if p.cache == nil {
+		return errors.New("prefetching requires the config cache")
+	}
+	parts := strings.Split(slug, "/")
+	if len(parts) < 2 || sha == "" {
+		return fmt.Errorf("invalid prefetch of '%s' at '%s': expected a repository slug and commit", slug, sha)
+	}
+	if configPath == "" {
+		configPath = ".drone.yml"
+	}
+	if !p.repoAllowed(slug) {
+		return fmt.Errorf("repository '%s' is not allowed", slug)
+	}
+
+	req := p.newRequest(ctx, &config.Request{
+		Build: drone.Build{After: sha, Trigger: "@prefetch"},
+		Repo: drone.Repo{
+			Namespace: strings.Join(parts[:len(parts)-1], "/"),
+			Name:      parts[len(parts)-1],
+			Slug:      slug,
+			Config:    configPath,
+		},
+	})
+	req.Log.Info("prefetching")
+	if err := p.connect(ctx, req); err != nil {
+		return err
+	}
+	_, err := p.getAllConfigData(ctx, req, "/", 0)
+	return err
+}
@@ -0,0 +1,88 @@
+package plugin
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/config"
+)
+
+func TestPrefetch(t *testing.T) {
+	var contents int32
+	mux := testMux()
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.URL.Path, "/compare/"):
+			_, _ = io.WriteString(w, `{"files": [{"filename": "afolder/file", "status": "modified"}]}`)
+			return
+		case strings.HasSuffix(r.URL.Path, "/pulls/5/files"):
+			_, _ = io.WriteString(w, `[{"filename": "afolder/.drone.yml", "status": "modified"}]`)
+			return
+		case strings.HasSuffix(r.URL.Path, "/.droneignore"):
+			// read once by each full scan
+		case strings.Contains(r.URL.Path, "/contents/"):
+			atomic.AddInt32(&contents, 1)
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+		WithConcat(true),
+		WithCacheTTL(time.Minute),
+		WithTreeCache(10),
+	)
+	if err := plugin.(Prefetcher).Prefetch(noContext, "foosinn/dronetest", "8ecad91991d5da985a2a8dd97cc19029dc1c2899", ""); err != nil {
+		t.Fatal(err)
+	}
+	prefetched := atomic.LoadInt32(&contents)
+	if prefetched == 0 {
+		t.Fatal("Want configs to be requested by the prefetch")
+	}
+
+	// builds of the prefetched commit find the configs without a contents
+	// request, the changed files are absolute paths unlike the listings
+	builds := []drone.Build{
+		{After: "8ecad91991d5da985a2a8dd97cc19029dc1c2899", Trigger: "@cron"},
+		{Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7", After: "8ecad91991d5da985a2a8dd97cc19029dc1c2899", Ref: "refs/heads/master"},
+		{After: "8ecad91991d5da985a2a8dd97cc19029dc1c2899", Ref: "refs/pull/5/head"},
+	}
+	for _, build := range builds {
+		req := &config.Request{
+			Build: build,
+			Repo: drone.Repo{
+				Namespace: "foosinn",
+				Name:      "dronetest",
+				Slug:      "foosinn/dronetest",
+				Config:    ".drone.yml",
+			},
+		}
+		droneConfig, err := plugin.Find(noContext, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if droneConfig == nil || !strings.Contains(droneConfig.Data, "go test -short") {
+			t.Errorf("%s: Want the afolder config got %v", build.Ref+build.Trigger, droneConfig)
+		}
+		if want, got := prefetched, atomic.LoadInt32(&contents); want != got {
+			t.Errorf("%s: Want the build to use the prefetched configs, got %d new requests", build.Ref+build.Trigger, got-want)
+		}
+	}
+
+	for _, invalid := range []struct{ slug, sha string }{{"dronetest", "8ecad91"}, {"foosinn/dronetest", ""}} {
+		if err := plugin.(Prefetcher).Prefetch(noContext, invalid.slug, invalid.sha, ""); err == nil {
+			t.Errorf("Want an error for %s at %q", invalid.slug, invalid.sha)
+		}
+	}
+	uncached := New(WithServer(ts.URL), WithToken(mockToken))
+	if err := uncached.(Prefetcher).Prefetch(noContext, "foosinn/dronetest", "8ecad91", ""); err == nil {
+		t.Error("Want an error without cache")
+	}
+}
@@ -0,0 +1,28 @@
+package plugin
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+type requestIDKey struct{}
+
+// ContextWithRequestID returns a context carrying the id of the incoming
+// drone request, Find reuses it as request uuid instead of generating one
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestUUID returns the uuid of the incoming request if the context carries
+// a valid one, otherwise a new uuid of the configured generator
+func (p *plugin) requestUUID(ctx context.Context) uuid.UUID {
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok && id != "" {
+		if requestUuid, err := uuid.Parse(id); err == nil {
+			return requestUuid
+		}
+		logrus.Debugf("ignoring request id %q, it is not a uuid", id)
+	}
+	return p.newUUID()
+}
@@ -0,0 +1,175 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/drone/go-scm/scm"
+)
+
+// retry calls fn until it succeeds, fails with a non retriable error or the
+// configured retry count is exhausted, the backoff doubles after every attempt.
+// If enabled, requests that hit the rate limit are repeated after it was reset.
+// Failed requests return a statusError with the status of the response.
+func (p *plugin) retry(ctx context.Context, req *request, name string, fn func() (*scm.Response, error)) error {
+	backoff := p.retryBackoff
+	for attempt := 1; ; {
+		res, err := fn()
+		err = newStatusError(name, res, err)
+
+		// wait for the rate limit reset
+		if delay := p.rateLimitDelay(req, res); delay > 0 {
+			req.Log.Warnf("%s rate limit reached, waiting %s", name, delay)
+			if !sleep(ctx, delay) {
+				return err
+			}
+			if err != nil && rateLimited(res) {
+				continue
+			}
+		}
+
+		if err == nil || attempt > p.retryCount || !retriable(ctx, res) {
+			return err
+		}
+
+		req.Log.Debugf("%s failed, retry %d/%d in %s: %v", name, attempt, p.retryCount, backoff, err)
+		if !sleep(ctx, backoff) {
+			return err
+		}
+		backoff *= 2
+		attempt++
+	}
+}
+
+// statusError is a failed scm request with the status code of the response,
+// e.g. to tell missing permissions from server errors
+type statusError struct {
+	name   string
+	status int
+	err    error
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s: %d %s: %v", e.name, e.status, http.StatusText(e.status), e.err)
+}
+
+// newStatusError wraps err with the status of res, errors without a response
+// and errors that are compared by the callers are returned unchanged
+func newStatusError(name string, res *scm.Response, err error) error {
+	if err == nil || res == nil || res.Status == 0 || err == scm.ErrNotSupported || err == errFileTooLarge {
+		return err
+	}
+	if _, ok := err.(*statusError); ok {
+		return err
+	}
+	return &statusError{name: name, status: res.Status, err: err}
+}
+
+// retriable reports if a failed scm request may succeed on another attempt,
+// a missing response indicates a network error
+func retriable(ctx context.Context, res *scm.Response) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if res == nil {
+		return true
+	}
+	return res.Status == http.StatusTooManyRequests || res.Status >= http.StatusInternalServerError
+}
+
+// rateLimited reports if a scm request was rejected by the rate limit
+func rateLimited(res *scm.Response) bool {
+	return res != nil && (res.Status == http.StatusForbidden || res.Status == http.StatusTooManyRequests)
+}
+
+// rateLimitDelay returns how long to wait before the next scm request. The
+// max wait applies to the whole request, the delay is taken from what is left
+// of it after the previous waits of all scm calls.
+func (p *plugin) rateLimitDelay(req *request, res *scm.Response) time.Duration {
+	if !p.rateLimitWait || res == nil {
+		return 0
+	}
+
+	delay := time.Duration(0)
+	if retryAfter, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+		delay = time.Duration(retryAfter) * time.Second
+	} else if res.Rate.Limit > 0 && res.Rate.Remaining == 0 && res.Rate.Reset > 0 {
+		delay = time.Until(time.Unix(res.Rate.Reset, 0))
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	// concurrent calls reserve their delay so the total stays in the limit
+	for {
+		waited := atomic.LoadInt64(&req.rateLimitWaited)
+		reserved := delay
+		if left := p.rateLimitMaxWait - time.Duration(waited); reserved > left {
+			reserved = left
+		}
+		if reserved <= 0 {
+			return 0
+		}
+		if atomic.CompareAndSwapInt64(&req.rateLimitWaited, waited, waited+int64(reserved)) {
+			return reserved
+		}
+	}
+}
+
+// sleep waits for d, returns false if the context was canceled before
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// retryContent retries a content request like retry. Requests that fail with
+// not found or conflict right after a push are repeated once more after the
+// propagation delay, the scm may not serve the new commit on every node yet.
+// The delay is waited once per request, after the first repeated request the
+// commit counts as propagated and later requests are not repeated.
+func (p *plugin) retryContent(ctx context.Context, req *request, name string, fn func() (*scm.Response, error)) error {
+	status := 0
+	call := func() (*scm.Response, error) {
+		res, err := fn()
+		status = 0
+		if res != nil {
+			status = res.Status
+		}
+		return res, err
+	}
+	err := p.retry(ctx, req, name, call)
+	if err == nil || atomic.LoadInt32(&req.propagated) == 1 || !p.propagating(req, status) {
+		return err
+	}
+
+	req.propagation.Do(func() {
+		req.Log.Infof("%s failed with status %d right after the push, retrying in %s", name, status, p.propagationDelay)
+		sleep(ctx, p.propagationDelay)
+	})
+	if ctx.Err() != nil {
+		return err
+	}
+	err = p.retry(ctx, req, name, fn)
+	atomic.StoreInt32(&req.propagated, 1)
+	return err
+}
+
+// propagating reports if a failed content request may be caused by a commit
+// that was pushed within the propagation window
+func (p *plugin) propagating(req *request, status int) bool {
+	if p.propagationDelay <= 0 || req.Build.Created == 0 {
+		return false
+	}
+	if status != http.StatusNotFound && status != http.StatusConflict {
+		return false
+	}
+	return time.Since(time.Unix(req.Build.Created, 0)) < p.propagationWindow
+}
@@ -0,0 +1,184 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// starlarkMaxSteps limits the execution steps of a starlark config, the same
+// default drone uses
+const starlarkMaxSteps = 50000
+
+// isStarlark reports if file is a starlark config
+func isStarlark(file string) bool {
+	switch path.Ext(file) {
+	case ".star", ".starlark":
+		return true
+	default:
+		return false
+	}
+}
+
+// renderStarlark executes the main function of a starlark config and returns
+// the emitted pipelines as yaml documents, like drone does for .drone.star.
+// Execution stops after starlarkMaxSteps steps or once ctx is done.
+func renderStarlark(ctx context.Context, req *request, file string, source string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	thread := &starlark.Thread{Name: file}
+	thread.SetMaxExecutionSteps(starlarkMaxSteps)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			thread.Cancel(ctx.Err().Error())
+		case <-done:
+		}
+	}()
+
+	globals, err := starlark.ExecFile(thread, file, source, nil)
+	if err != nil {
+		return "", err
+	}
+
+	main, ok := globals["main"]
+	if !ok {
+		return "", errors.New("starlark: missing main function")
+	}
+	if _, ok := main.(starlark.Callable); !ok {
+		return "", errors.New("starlark: main must be a function")
+	}
+
+	v, err := starlark.Call(thread, main, starlark.Tuple{starlarkContext(req)}, nil)
+	if err != nil {
+		return "", err
+	}
+
+	// json is valid yaml, every returned dict becomes one document
+	buf := new(bytes.Buffer)
+	switch v := v.(type) {
+	case *starlark.List:
+		for i := 0; i < v.Len(); i++ {
+			if _, ok := v.Index(i).(*starlark.Dict); !ok {
+				return "", fmt.Errorf("starlark: invalid return type %s in list", v.Index(i).Type())
+			}
+			buf.WriteString("---\n")
+			if err := writeStarlarkJSON(buf, v.Index(i)); err != nil {
+				return "", err
+			}
+			buf.WriteString("\n")
+		}
+	case *starlark.Dict:
+		buf.WriteString("---\n")
+		if err := writeStarlarkJSON(buf, v); err != nil {
+			return "", err
+		}
+		buf.WriteString("\n")
+	default:
+		return "", fmt.Errorf("starlark: invalid return type %s", v.Type())
+	}
+	return buf.String(), nil
+}
+
+// starlarkContext creates the ctx argument passed to main
+func starlarkContext(req *request) starlark.Value {
+	build := req.Build
+	repo := req.Repo
+	return starlarkstruct.FromStringDict(starlark.String("context"), starlark.StringDict{
+		"build": starlarkstruct.FromStringDict(starlark.String("build"), starlark.StringDict{
+			"event":        starlark.String(build.Event),
+			"action":       starlark.String(build.Action),
+			"trigger":      starlark.String(build.Trigger),
+			"link":         starlark.String(build.Link),
+			"branch":       starlark.String(build.Target),
+			"source":       starlark.String(build.Source),
+			"target":       starlark.String(build.Target),
+			"before":       starlark.String(build.Before),
+			"after":        starlark.String(build.After),
+			"ref":          starlark.String(build.Ref),
+			"commit":       starlark.String(build.After),
+			"title":        starlark.String(build.Title),
+			"message":      starlark.String(build.Message),
+			"source_repo":  starlark.String(build.Fork),
+			"author_login": starlark.String(build.Author),
+			"sender":       starlark.String(build.Sender),
+		}),
+		"repo": starlarkstruct.FromStringDict(starlark.String("repo"), starlark.StringDict{
+			"uid":          starlark.String(repo.UID),
+			"name":         starlark.String(repo.Name),
+			"namespace":    starlark.String(repo.Namespace),
+			"slug":         starlark.String(repo.Slug),
+			"git_http_url": starlark.String(repo.HTTPURL),
+			"git_ssh_url":  starlark.String(repo.SSHURL),
+			"link":         starlark.String(repo.Link),
+			"branch":       starlark.String(repo.Branch),
+			"config":       starlark.String(repo.Config),
+			"private":      starlark.Bool(repo.Private),
+			"visibility":   starlark.String(repo.Visibility),
+			"active":       starlark.Bool(repo.Active),
+			"trusted":      starlark.Bool(repo.Trusted),
+			"protected":    starlark.Bool(repo.Protected),
+		}),
+	})
+}
+
+// writeStarlarkJSON encodes a starlark value as json, keeping the key order
+// of dicts
+func writeStarlarkJSON(buf *bytes.Buffer, v starlark.Value) error {
+	switch v := v.(type) {
+	case starlark.NoneType:
+		buf.WriteString("null")
+	case starlark.Bool:
+		fmt.Fprintf(buf, "%t", v)
+	case starlark.Int:
+		buf.WriteString(v.String())
+	case starlark.Float:
+		fmt.Fprintf(buf, "%g", float64(v))
+	case starlark.String:
+		data, _ := json.Marshal(string(v))
+		buf.Write(data)
+	case starlark.Indexable: // lists and tuples
+		buf.WriteString("[")
+		for i := 0; i < v.Len(); i++ {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			if err := writeStarlarkJSON(buf, v.Index(i)); err != nil {
+				return err
+			}
+		}
+		buf.WriteString("]")
+	case *starlark.Dict:
+		buf.WriteString("{")
+		for i, item := range v.Items() {
+			key, ok := item[0].(starlark.String)
+			if !ok {
+				return fmt.Errorf("starlark: invalid dict key type %s", item[0].Type())
+			}
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			if err := writeStarlarkJSON(buf, key); err != nil {
+				return err
+			}
+			buf.WriteString(": ")
+			if err := writeStarlarkJSON(buf, item[1]); err != nil {
+				return err
+			}
+		}
+		buf.WriteString("}")
+	default:
+		return fmt.Errorf("starlark: unsupported value type %s", strings.ToLower(v.Type()))
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/config"
+	"github.com/sirupsen/logrus"
+)
+
+func TestRenderStarlark(t *testing.T) {
+	req := &request{
+		Log: logrus.NewEntry(logrus.StandardLogger()),
+		Request: &config.Request{
+			Build: drone.Build{
+				Event:  "push",
+				Target: "master",
+			},
+			Repo: drone.Repo{
+				Namespace: "foosinn",
+				Name:      "dronetest",
+				Slug:      "foosinn/dronetest",
+			},
+		},
+	}
+	source := `
+def main(ctx):
+    return [pipeline(ctx, "build"), pipeline(ctx, "test")]
+
+def pipeline(ctx, name):
+    return {
+        "kind": "pipeline",
+        "name": name,
+        "steps": [{"name": ctx.build.event, "image": "golang", "commands": ["go " + name]}],
+        "trigger": {"branch": [ctx.build.branch]},
+    }
+`
+	configData, err := renderStarlark(noContext, req, ".drone.star", source)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	want := "---\n" +
+		`{"kind": "pipeline", "name": "build", "steps": [{"name": "push", "image": "golang", "commands": ["go build"]}], "trigger": {"branch": ["master"]}}` +
+		"\n---\n" +
+		`{"kind": "pipeline", "name": "test", "steps": [{"name": "push", "image": "golang", "commands": ["go test"]}], "trigger": {"branch": ["master"]}}` +
+		"\n"
+	if configData != want {
+		t.Errorf("Want %q got %q", want, configData)
+	}
+
+	if _, err := renderStarlark(noContext, req, ".drone.star", "x = 1\n"); err == nil {
+		t.Error("Want an error for a missing main function")
+	}
+
+	loop := "def main(ctx):\n    for x in range(100000000):\n        pass\n    return {}\n"
+	if _, err := renderStarlark(noContext, req, ".drone.star", loop); err == nil {
+		t.Error("Want an error for exceeding the execution steps")
+	}
+
+	canceled, cancel := context.WithCancel(noContext)
+	cancel()
+	if _, err := renderStarlark(canceled, req, ".drone.star", source); err == nil {
+		t.Error("Want an error for a canceled context")
+	}
+}
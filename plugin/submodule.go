@@ -0,0 +1,167 @@
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/drone/drone-go/plugin/config"
+	"github.com/drone/go-scm/scm"
+)
+
+// getSubmoduleConfigData loads the root config of the submodule at file from
+// the submodule repository at the pinned commit. Submodules are taken from
+// .gitmodules, the config is empty if file is no submodule.
+func (p *plugin) getSubmoduleConfigData(ctx context.Context, req *request, file string) (string, error) {
+	file = path.Join("/", file)
+	submodules, err := p.gitmodules(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	slug, ok := submodules[file]
+	if !ok {
+		return "", nil
+	}
+	if !p.submoduleRepos.match(slug) {
+		req.Log.Warnf("skipping submodule %s: repository %s is not allowed", file, slug)
+		return "", nil
+	}
+
+	// the content of a submodule is the commit it is pinned to
+	var content *scm.Content
+	err = p.retry(ctx, req, "get submodule "+file, func() (res *scm.Response, err error) {
+		content, res, err = req.Client.Contents.Find(ctx, p.configRepoFor(req), scmPath(file), p.configRefFor(req))
+		return res, err
+	})
+	if err != nil && p.failsClosed(req, file, err) {
+		req.Log.Errorf("unable to resolve the commit of submodule %s, failing closed: %v", file, err)
+		return "", err
+	}
+	commit := ""
+	if content != nil {
+		// github reports the commit of a submodule as its blob sha
+		commit = content.Sha
+		if commit == "" {
+			commit = content.BlobID
+		}
+	}
+	if err != nil || commit == "" {
+		req.Log.Warnf("unable to resolve the commit of submodule %s: %v", file, err)
+		return "", nil
+	}
+
+	sub := &request{
+		Request: &config.Request{Build: req.Build, Repo: req.Repo},
+		UUID:    req.UUID,
+		Client:  req.Client,
+		Log:     req.Log.WithField("submodule", slug),
+		missing: newMissingFiles(),
+		ref:     commit,
+	}
+	sub.Repo.Slug = slug
+	for _, name := range p.configNamesFor(req) {
+		fileContent, critical, err := p.getScmDroneConfig(ctx, sub, path.Join("/", name))
+		if err != nil {
+			if critical {
+				return "", err
+			}
+			continue
+		}
+		req.Log.Infof("found %s in submodule %s at %s", name, slug, commit)
+		return p.appendConfig(req, "", fileContent, path.Join(file, name)), nil
+	}
+	return "", nil
+}
+
+// gitmodules returns the repositories of the submodules by their path, they
+// are read from .gitmodules once per request. Errors are only returned in
+// fail closed mode.
+func (p *plugin) gitmodules(ctx context.Context, req *request) (map[string]string, error) {
+	if req.submodules != nil {
+		return req.submodules, nil
+	}
+	content, err := p.getScmFile(ctx, req, "/.gitmodules")
+	if err != nil {
+		if p.failsClosed(req, "/.gitmodules", err) {
+			req.Log.Errorf("unable to load .gitmodules, failing closed: %v", err)
+			return nil, err
+		}
+		req.Log.Debugf("no submodules: %v", err)
+		req.submodules = map[string]string{}
+		return req.submodules, nil
+	}
+	req.submodules = parseGitmodules(content, p.configRepoFor(req), p.scmHost())
+	return req.submodules, nil
+}
+
+// parseGitmodules maps the paths of the submodules to their repositories,
+// relative urls are resolved against slug. Submodules on other hosts than the
+// scm server are skipped.
+func parseGitmodules(content, slug, host string) map[string]string {
+	submodules := map[string]string{}
+	var subPath, subURL string
+	add := func() {
+		if subPath != "" && subURL != "" {
+			if sub := submoduleSlug(subURL, slug, host); sub != "" {
+				submodules[path.Join("/", subPath)] = sub
+			}
+		}
+		subPath, subURL = "", ""
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			add()
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch strings.TrimSpace(parts[0]) {
+		case "path":
+			subPath = strings.TrimSpace(parts[1])
+		case "url":
+			subURL = strings.TrimSpace(parts[1])
+		}
+	}
+	add()
+	return submodules
+}
+
+// submoduleSlug returns the namespace and name of a submodule url, e.g.
+// https://github.com/foo/bar.git, git@github.com:foo/bar.git or ../bar.git.
+// Absolute urls have to point to host, it is empty for urls of other hosts.
+func submoduleSlug(rawURL, slug, host string) string {
+	rawURL = strings.TrimSuffix(strings.TrimSuffix(rawURL, "/"), ".git")
+	repoPath := ""
+	switch {
+	case strings.HasPrefix(rawURL, "../") || strings.HasPrefix(rawURL, "./"):
+		repoPath = path.Join(slug, rawURL)
+	case strings.Contains(rawURL, "://"):
+		u, err := url.Parse(rawURL)
+		if err != nil || host == "" || !strings.EqualFold(u.Hostname(), host) {
+			return ""
+		}
+		repoPath = u.Path
+	case strings.Contains(rawURL, ":"):
+		// scp like syntax, e.g. git@github.com:foo/bar
+		parts := strings.SplitN(rawURL, ":", 2)
+		urlHost := parts[0][strings.Index(parts[0], "@")+1:]
+		if host == "" || !strings.EqualFold(urlHost, host) {
+			return ""
+		}
+		repoPath = parts[1]
+	default:
+		return ""
+	}
+	parts := strings.Split(strings.Trim(repoPath, "/"), "/")
+	if len(parts) < 2 {
+		return ""
+	}
+	return strings.Join(parts[len(parts)-2:], "/")
+}
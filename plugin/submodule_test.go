@@ -0,0 +1,138 @@
+package plugin
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/config"
+)
+
+func TestParseGitmodules(t *testing.T) {
+	gitmodules := `[submodule "api"]
+	path = services/api
+	url = https://github.com/foosinn/api.git
+[submodule "web"]
+	url = git@github.com:foosinn/web.git
+	path = services/web
+[submodule "lib"]
+	path = lib
+	url = ../lib
+[submodule "local"]
+	path = local
+	url = /srv/git/local.git
+[submodule "foreign"]
+	path = foreign
+	url = https://evil.example.com/foosinn/foreign.git
+[submodule "foreign-ssh"]
+	path = foreign-ssh
+	url = git@evil.example.com:foosinn/foreign.git
+`
+	want := map[string]string{
+		"/services/api": "foosinn/api",
+		"/services/web": "foosinn/web",
+		"/lib":          "foosinn/lib",
+	}
+	if got := parseGitmodules(gitmodules, "foosinn/dronetest", "github.com"); !reflect.DeepEqual(want, got) {
+		t.Errorf("Want %v got %v", want, got)
+	}
+
+	// without a known scm host only relative urls are resolved
+	want = map[string]string{"/lib": "foosinn/lib"}
+	if got := parseGitmodules(gitmodules, "foosinn/dronetest", ""); !reflect.DeepEqual(want, got) {
+		t.Errorf("Want %v got %v", want, got)
+	}
+}
+
+func TestSubmodules(t *testing.T) {
+	tests := []struct {
+		name    string
+		repos   []string
+		want    string
+		wantRef bool
+	}{
+		{
+			name:    "allowed",
+			repos:   []string{"foosinn/*"},
+			want:    "# drone-tree-config sources:\n# - /sub/.drone.yml\n---\nkind: pipeline\nname: default\n\nsteps:\n- name: build\n",
+			wantRef: true,
+		},
+		{
+			name:  "not allowed",
+			repos: []string{"other/*"},
+			want:  "# drone-tree-config sources:\n# - /.drone.yml\n---\n",
+		},
+		{
+			name: "not allowed by default",
+			want: "# drone-tree-config sources:\n# - /.drone.yml\n---\n",
+		},
+	}
+
+	const pinned = "9fceb02d0ae598e95dc970b74767f19372d61af8"
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ref string
+			mux := testMux()
+			ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/repos/foosinn/dronetest/pulls/6/files":
+					_, _ = io.WriteString(w, `[{"filename": "sub", "status": "modified"}]`)
+				case "/repos/foosinn/dronetest/contents/.gitmodules":
+					content := "[submodule \"sub\"]\n\tpath = sub\n\turl = ../dronesub.git\n"
+					fmt.Fprintf(w, `{"path": ".gitmodules", "content": "%s"}`, base64.StdEncoding.EncodeToString([]byte(content)))
+				case "/repos/foosinn/dronetest/contents/sub":
+					fmt.Fprintf(w, `{"type": "submodule", "path": "sub", "sha": "%s"}`, pinned)
+				case "/repos/foosinn/dronesub/contents/.drone.yml":
+					ref = r.URL.Query().Get("ref")
+					f, _ := os.Open("testdata/a_b_.drone.yml.json")
+					_, _ = io.Copy(w, f)
+				default:
+					mux.ServeHTTP(w, r)
+				}
+			}))
+			defer ts.Close()
+
+			req := &config.Request{
+				Build: drone.Build{
+					Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+					After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+					Ref:    "refs/pull/6/head",
+				},
+				Repo: drone.Repo{
+					Namespace: "foosinn",
+					Name:      "dronetest",
+					Slug:      "foosinn/dronetest",
+					Config:    ".drone.yml",
+				},
+			}
+			plugin := New(
+				WithServer(ts.URL),
+				WithToken(mockToken),
+				WithSubmodules(true),
+				WithSubmoduleRepos(tt.repos),
+				WithSourcesComment(true),
+			)
+			droneConfig, err := plugin.Find(noContext, req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if want, got := tt.want, droneConfig.Data; !strings.HasPrefix(got, want) {
+				t.Errorf("Want prefix %q got %q", want, got)
+			}
+			if tt.wantRef && ref != pinned {
+				t.Errorf("Want the submodule config at %s got %s", pinned, ref)
+			}
+			if !tt.wantRef && ref != "" {
+				t.Errorf("Want no request for the submodule config got one at %s", ref)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// templateData is passed to the config template for each changed directory
+type templateData struct {
+	// Dir is the path of the directory relative to the repository root
+	Dir string
+	// Name is the base name of the directory
+	Name string
+}
+
+// getTemplateConfigData renders the config template once for every changed
+// top level directory
+func (p *plugin) getTemplateConfigData(ctx context.Context, req *request, changedFiles []string) (string, error) {
+	dirs := templateDirs(changedFiles)
+	if len(dirs) == 0 {
+		return "", nil
+	}
+
+	// the template is configured for all repositories, those without it
+	// only use their configs
+	source, err := p.getScmFile(ctx, req, p.template)
+	if err == errFileNotFound || (err != nil && req.missing.has(p.template)) {
+		req.Log.Debugf("no template %s in the repository", p.template)
+		return "", nil
+	}
+	if err != nil {
+		req.Log.Errorf("unable to load template: %s %v", p.template, err)
+		return "", err
+	}
+	tmpl, err := template.New(p.template).Option("missingkey=error").Parse(source)
+	if err != nil {
+		req.Log.Errorf("unable to parse template: %s %v", p.template, err)
+		return "", err
+	}
+
+	configData := ""
+	for _, dir := range dirs {
+		buf := bytes.Buffer{}
+		err := tmpl.Execute(&buf, templateData{Dir: dir, Name: path.Base(dir)})
+		if err != nil {
+			req.Log.Errorf("unable to render template %s for %s: %v", p.template, dir, err)
+			return "", err
+		}
+		if err := validateDroneConfig(buf.String()); err != nil {
+			req.Log.Errorf("invalid config rendered from template %s for %s: %v", p.template, dir, err)
+			return "", err
+		}
+		req.Log.Infof("rendered %s for %s", p.template, dir)
+		configData = p.appendConfig(req, configData, buf.String(), p.template+" ("+dir+")")
+	}
+	return configData, nil
+}
+
+// templateDirs returns the sorted top level directories of the changed files
+func templateDirs(changedFiles []string) []string {
+	seen := map[string]bool{}
+	dirs := []string{}
+	for _, file := range changedFiles {
+		parts := strings.SplitN(strings.TrimPrefix(file, "/"), "/", 2)
+		if len(parts) < 2 || seen[parts[0]] {
+			continue
+		}
+		seen[parts[0]] = true
+		dirs = append(dirs, parts[0])
+	}
+	sort.Strings(dirs)
+	return dirs
+}
@@ -0,0 +1,46 @@
+package plugin
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ParseCACerts adds the PEM encoded certificates to the system roots
+func ParseCACerts(data []byte) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("scm ca certificate contains no PEM encoded certificates")
+	}
+	return pool, nil
+}
+
+// newBaseTransport returns the transport for scm requests, the settings match
+// http.DefaultTransport apart from the tls config, both honor the proxy
+// environment variables
+func (p *plugin) newBaseTransport() http.RoundTripper {
+	if p.caCerts == nil && !p.insecureSkipVerify {
+		return http.DefaultTransport
+	}
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig: &tls.Config{
+			RootCAs:            p.caCerts,
+			InsecureSkipVerify: p.insecureSkipVerify,
+		},
+	}
+}
@@ -0,0 +1,141 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/config"
+	"gopkg.in/yaml.v3"
+)
+
+// Validator is implemented by plugins that can resolve the config for a list
+// of changed files without a build, e.g. to test a repository offline
+type Validator interface {
+	Validate(ctx context.Context, req *config.Request, changedFiles []string) (*drone.Config, error)
+}
+
+var (
+	// droneKinds are the document kinds drone understands
+	droneKinds = map[string]bool{
+		"pipeline":  true,
+		"secret":    true,
+		"signature": true,
+	}
+
+	// dronePipelineTypes are the known runner types, an empty type defaults
+	// to docker
+	dronePipelineTypes = map[string]bool{
+		"docker":       true,
+		"kubernetes":   true,
+		"exec":         true,
+		"ssh":          true,
+		"digitalocean": true,
+		"macstadium":   true,
+	}
+)
+
+// validateDroneConfig checks every document of a config file, errors name
+// the failing document counting from 1 and the position of the problem
+func validateDroneConfig(content string) error {
+	dec := yaml.NewDecoder(strings.NewReader(content))
+	documents := 0
+	for {
+		var node yaml.Node
+		err := dec.Decode(&node)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("document %d: %v", documents+1, err)
+		}
+		if len(node.Content) == 0 {
+			continue
+		}
+		var dc *droneConfig
+		if err := node.Content[0].Decode(&dc); err != nil {
+			return fmt.Errorf("document %d: %v", documents+1, err)
+		}
+		if dc == nil {
+			// empty document, e.g. between two separators
+			continue
+		}
+		documents++
+		if err := dc.validate(node.Content[0]); err != nil {
+			return fmt.Errorf("document %d: %v", documents, err)
+		}
+	}
+	if documents == 0 {
+		return errors.New("no documents found")
+	}
+	return nil
+}
+
+// validate checks a single document, node is the mapping of the document
+// and used to locate the problem
+func (dc *droneConfig) validate(node *yaml.Node) error {
+	if dc.Kind == "" {
+		return positionError(node, "missing 'kind'")
+	}
+	if !droneKinds[dc.Kind] {
+		return positionError(mappingValue(node, "kind"), fmt.Sprintf("unknown kind '%s'", dc.Kind))
+	}
+	if dc.Name == "" && dc.Kind != "signature" {
+		return positionError(node, "missing 'name'")
+	}
+	if dc.Kind == "pipeline" && dc.Type != "" && !dronePipelineTypes[dc.Type] {
+		return positionError(mappingValue(node, "type"), fmt.Sprintf("unknown pipeline type '%s'", dc.Type))
+	}
+	return nil
+}
+
+// mappingValue returns the value of key in the mapping node, nil if the key
+// is missing
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// positionError appends the line and column of node to the message
+func positionError(node *yaml.Node, msg string) error {
+	if node == nil {
+		return errors.New(msg)
+	}
+	return fmt.Errorf("%s at line %d, column %d", msg, node.Line, node.Column)
+}
+
+// Validate resolves the config for the changed files at the commit of the
+// request and assembles it like Find does for a push
+func (p *plugin) Validate(ctx context.Context, droneRequest *config.Request, changedFiles []string) (*drone.Config, error) {
+	req := p.newRequest(ctx, droneRequest)
+	if err := p.connect(ctx, req); err != nil {
+		return nil, err
+	}
+
+	changedFiles = p.filterChanges(req, changedFiles)
+	configData, err := p.getScmConfigData(ctx, req, changedFiles)
+	if err != nil {
+		return nil, err
+	}
+	configData, err = p.assembleConfig(ctx, req, configData, changedFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &drone.Config{Data: configData}, nil
+}
+
+// ValidateConfig checks every document of a config, e.g. of operator
+// provided global configs before they are used
+func ValidateConfig(content string) error {
+	return validateDroneConfig(content)
+}
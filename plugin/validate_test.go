@@ -0,0 +1,160 @@
+package plugin
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/config"
+)
+
+func TestValidateDroneConfig(t *testing.T) {
+	tests := []struct {
+		config string
+		valid  bool
+	}{
+		{"kind: pipeline\nname: default\n", true},
+		{"kind: pipeline\ntype: kubernetes\nname: default\n", true},
+		{"---\nkind: pipeline\nname: a\n---\nkind: secret\nname: b\n---\nkind: signature\nhmac: 1234\n", true},
+		{"---\n---\nkind: pipeline\nname: default\n", true},
+		{"", false},
+		{"name: default\n", false},
+		{"kind: pipeline\n", false},
+		{"kind: banana\nname: default\n", false},
+		{"kind: pipeline\ntype: banana\nname: default\n", false},
+		{"kind: pipeline\nname: a\n---\nkind: banana\nname: b\n", false},
+	}
+	for _, test := range tests {
+		err := validateDroneConfig(test.config)
+		if test.valid && err != nil {
+			t.Errorf("Want %q to be valid got %v", test.config, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("Want %q to be invalid", test.config)
+		}
+	}
+}
+
+func TestValidateDroneConfigDocument(t *testing.T) {
+	tests := []struct {
+		config string
+		err    string
+	}{
+		{"kind: pipeline\nname: a\n---\nkind: pipeline\n", "document 2: missing 'name'"},
+		{"---\nkind: pipeline\nname: a\n---\n---\nkind: pipeline\nname: b\n---\nname: c\n", "document 3: missing 'kind'"},
+		{"kind: pipeline\nname: a\n---\nkind: [pipeline\n", "document 2: "},
+	}
+	for _, test := range tests {
+		err := validateDroneConfig(test.config)
+		if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("Want error %q for %q got %v", test.err, test.config, err)
+		}
+	}
+}
+
+func TestValidateDroneConfigPosition(t *testing.T) {
+	tests := []struct {
+		config string
+		err    string
+	}{
+		{"kind: pipeline\nname: a\n---\nname: b\n", "document 2: missing 'kind' at line 4, column 1"},
+		{"kind: pipeline\nname: a\n---\nkind: banana\nname: b\n", "document 2: unknown kind 'banana' at line 4, column 7"},
+		{"kind: pipeline\nname: default\ntype:   banana\n", "document 1: unknown pipeline type 'banana' at line 3, column 9"},
+		{"kind: pipeline\nname: [a, b]\n", "document 1: yaml: unmarshal errors:\n  line 2: "},
+		{"kind: pipeline\nname: a\n---\nkind: [pipeline\n", "document 2: yaml: line "},
+	}
+	for _, test := range tests {
+		err := validateDroneConfig(test.config)
+		if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("Want error %q for %q got %v", test.err, test.config, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	ts := newTestServer(testMux())
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			After: "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithToken(mockToken),
+	)
+	droneConfig, err := plugin.(Validator).Validate(noContext, req, []string{"a/b/c/d/file"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if want, got := "---\nkind: pipeline\nname: default\n\nsteps:\n- name: build\n  image: golang\n  commands:\n  - go build\n  - go test -short\n\n- name: integration\n  image: golang\n  commands:\n  - go test -v\n", droneConfig.Data; want != got {
+		t.Errorf("Want %q got %q", want, got)
+	}
+
+	req.Repo.Config = "missing.yml"
+	if _, err := plugin.(Validator).Validate(noContext, req, []string{"a/b/c/d/file"}); err != errConfigNotFound {
+		t.Errorf("Want %v got %v", errConfigNotFound, err)
+	}
+}
+
+func TestValidateAssembly(t *testing.T) {
+	ts := newTestServer(testMux())
+	defer ts.Close()
+
+	req := &config.Request{
+		Build: drone.Build{
+			After: "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	tests := []struct {
+		name    string
+		options []Option
+		want    string
+		err     error
+	}{
+		{
+			name:    "global configs",
+			options: []Option{WithGlobalConfigs("kind: pipeline\nname: policy\n", "")},
+			want:    "---\nkind: pipeline\nname: policy\n---\nkind: pipeline\nname: default\n",
+		},
+		{
+			name:    "max config size",
+			options: []Option{WithMaxConfigSize(16)},
+			err:     errConfigTooLarge,
+		},
+	}
+	for _, test := range tests {
+		plugin := New(append([]Option{
+			WithServer(ts.URL),
+			WithToken(mockToken),
+		}, test.options...)...)
+		droneConfig, err := plugin.(Validator).Validate(noContext, req, []string{"a/b/c/d/file"})
+		if test.err != nil {
+			if err != test.err {
+				t.Errorf("%s: want %v got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got := droneConfig.Data; !strings.HasPrefix(got, test.want) {
+			t.Errorf("%s: want prefix %q got %q", test.name, test.want, got)
+		}
+	}
+}